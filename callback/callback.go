@@ -0,0 +1,82 @@
+package callback
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Preamble is written by a runner before anything else to tell the server
+// that the connection is a runner calling back rather than an SSH client.
+const Preamble = "TCP"
+
+// ExitRequest is the global request the server sends to tell a runner to exit.
+const ExitRequest = "exit@runners"
+
+// Runner identifies the runner calling back. It is sent as a single JSON line
+// directly after the preamble.
+type Runner struct {
+	Name  string `json:"name,omitempty"`
+	OS    string `json:"os,omitempty"`
+	Arch  string `json:"arch,omitempty"`
+	RunID string `json:"run_id,omitempty"`
+
+	// Session is the token of the session the runner was dispatched for.
+	Session string `json:"session,omitempty"`
+}
+
+// FromEnv reads the runner identity from the GitHub Actions environment.
+func FromEnv() Runner {
+	return Runner{
+		Name:    os.Getenv("RUNNER_NAME"),
+		OS:      os.Getenv("RUNNER_OS"),
+		Arch:    os.Getenv("RUNNER_ARCH"),
+		RunID:   os.Getenv("GITHUB_RUN_ID"),
+		Session: os.Getenv("SESSION"),
+	}
+}
+
+func (r Runner) String() string {
+	if r.Name == "" {
+		return "unknown"
+	}
+
+	return fmt.Sprintf("%s (%s/%s)", r.Name, r.OS, r.Arch)
+}
+
+// Write sends the preamble and runner identity.
+func Write(w io.Writer, runner Runner) error {
+	header, err := json.Marshal(runner)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(append(append([]byte(Preamble), header...), '\n'))
+	return err
+}
+
+// Read reads the runner identity following the preamble, if there is one.
+// Older runners start the SSH handshake directly after the preamble, their
+// identity is empty and carries no session token.
+func Read(r *bufio.Reader) (Runner, error) {
+	var runner Runner
+
+	next, err := r.Peek(1)
+	if err != nil {
+		return runner, err
+	}
+
+	if next[0] != '{' {
+		return runner, nil
+	}
+
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return runner, err
+	}
+
+	err = json.Unmarshal(line, &runner)
+	return runner, err
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/trunners/runners/logger"
+)
+
+// directTCPIP is the extra data of a "direct-tcpip" channel (RFC 4254 section 7.2).
+type directTCPIP struct {
+	Host       string
+	Port       uint32
+	OriginHost string
+	OriginPort uint32
+}
+
+// forward connects a "direct-tcpip" channel to its destination.
+func forward(ctx context.Context, channel ssh.NewChannel) {
+	log := logger.FromContext(ctx)
+
+	var dest directTCPIP
+	err := ssh.Unmarshal(channel.ExtraData(), &dest)
+	if err != nil {
+		log.WarnContext(ctx, "Invalid direct-tcpip request", "error", err)
+
+		err = channel.Reject(ssh.ConnectionFailed, "invalid direct-tcpip request")
+		if err != nil {
+			log.WarnContext(ctx, "Could not reject channel", "error", err)
+		}
+
+		return
+	}
+
+	address := net.JoinHostPort(dest.Host, strconv.FormatUint(uint64(dest.Port), 10))
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		log.WarnContext(ctx, "Could not connect forwarded port", "address", address, "error", err)
+
+		err = channel.Reject(ssh.ConnectionFailed, err.Error())
+		if err != nil {
+			log.WarnContext(ctx, "Could not reject channel", "error", err)
+		}
+
+		return
+	}
+
+	connection, requests, err := channel.Accept()
+	if err != nil {
+		log.ErrorContext(ctx, "Could not accept channel", "error", err)
+		_ = conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	log.InfoContext(ctx, "Forwarding port", "address", address)
+
+	var once sync.Once
+	var wg sync.WaitGroup
+	cleanup := func() {
+		_ = conn.Close()
+		_ = connection.Close()
+	}
+
+	wg.Go(func() {
+		_, err := io.Copy(connection, conn)
+		if err != nil {
+			log.WarnContext(ctx, "Error copying from forwarded port", "error", err)
+		}
+
+		once.Do(cleanup)
+	})
+
+	wg.Go(func() {
+		_, err := io.Copy(conn, connection)
+		if err != nil {
+			log.WarnContext(ctx, "Error copying to forwarded port", "error", err)
+		}
+
+		once.Do(cleanup)
+	})
+
+	wg.Wait()
+	log.InfoContext(ctx, "Forward closed", "address", address)
+}
@@ -3,17 +3,15 @@ package main
 import (
 	"context"
 	"fmt"
-	"io"
 	"net"
 	"os"
-	"os/exec"
 	"os/signal"
 	"sync"
 	"syscall"
 
-	"github.com/creack/pty"
 	"golang.org/x/crypto/ssh"
 
+	"github.com/trunners/runners/callback"
 	"github.com/trunners/runners/client/config"
 	"github.com/trunners/runners/logger"
 )
@@ -32,7 +30,7 @@ func main() {
 	}
 	log.InfoContext(ctx, "Connected to remote server", "address", server.RemoteAddr())
 
-	_, err = server.Write([]byte("TCP"))
+	err = callback.Write(server, callback.FromEnv())
 	if err != nil {
 		log.ErrorContext(ctx, "Could not notify server of new connection", "error", err)
 		os.Exit(1)
@@ -48,7 +46,7 @@ func main() {
 
 	wg := sync.WaitGroup{}
 	wg.Go(func() {
-		ssh.DiscardRequests(reqs)
+		requests(ctx, reqs, cancel)
 	})
 
 	wg.Go(func() {
@@ -65,112 +63,41 @@ func main() {
 	wg.Wait()
 }
 
-func channel(ctx context.Context, chans <-chan ssh.NewChannel, shell string) {
-	for channel := range chans {
-		go pipe(ctx, channel, shell)
-	}
-}
-
-func pipe(ctx context.Context, channel ssh.NewChannel, shell string) {
+// requests handles global requests of the server, which tells the runner to
+// exit when the session timed out.
+func requests(ctx context.Context, reqs <-chan *ssh.Request, cancel context.CancelFunc) {
 	log := logger.FromContext(ctx)
 
-	if t := channel.ChannelType(); t != "session" {
-		log.WarnContext(ctx, "Unknown channel type", "type", t)
-
-		err := channel.Reject(ssh.UnknownChannelType, fmt.Sprintf("unknown channel type: %s", t))
-		if err != nil {
-			log.WarnContext(ctx, "Could not reject channel", "error", err)
-		}
-
-		return
-	}
-
-	connection, requests, err := channel.Accept()
-	if err != nil {
-		log.ErrorContext(ctx, "Could not accept channel", "error", err)
-		return
-	}
-
-	shellcmd := exec.CommandContext(ctx, shell)
-
-	cleanup := func() {
-		err = connection.Close()
-		if err != nil {
-			log.ErrorContext(ctx, "Could not close connection", "error", err)
+	for req := range reqs {
+		if req.Type == callback.ExitRequest {
+			log.InfoContext(ctx, "Server asked to exit")
+			cancel()
 		}
 
-		_, err = shellcmd.Process.Wait()
-		if err != nil {
-			log.ErrorContext(ctx, "Could not wait for bash process", "error", err)
+		if req.WantReply {
+			_ = req.Reply(req.Type == callback.ExitRequest, nil)
 		}
 	}
+}
 
-	shellpty, err := pty.Start(shellcmd)
-	if err != nil {
-		log.ErrorContext(ctx, "Could not start pty", "error", err)
-		cleanup()
-		return
-	}
-
-	var once sync.Once
-	var wg sync.WaitGroup
-
-	wg.Go(func() {
-		_, err = io.Copy(connection, shellpty)
-		if err != nil {
-			log.WarnContext(ctx, "Error copying from shell to connection", "error", err)
-		}
-
-		once.Do(cleanup)
-	})
-
-	wg.Go(func() {
-		_, err = io.Copy(shellpty, connection)
-		if err != nil {
-			log.WarnContext(ctx, "Error copying from connection to shell", "error", err)
-		}
-
-		once.Do(cleanup)
-	})
+func channel(ctx context.Context, chans <-chan ssh.NewChannel, shell string) {
+	log := logger.FromContext(ctx)
 
-	wg.Go(func() {
-		request(ctx, shellpty, requests)
-	})
+	for channel := range chans {
+		switch t := channel.ChannelType(); t {
+		case "session":
+			go session(ctx, channel, shell)
 
-	wg.Wait()
-	log.InfoContext(ctx, "Session closed")
-}
+		case "direct-tcpip":
+			go forward(ctx, channel)
 
-func request(ctx context.Context, shell *os.File, requests <-chan *ssh.Request) {
-	log := logger.FromContext(ctx)
-	var err error
-
-	for req := range requests {
-		switch req.Type {
-		case "shell":
-			// We only accept the default shell
-			// (i.e. no command in the Payload)
-			if len(req.Payload) == 0 {
-				err = req.Reply(true, nil)
-				if err != nil {
-					log.ErrorContext(ctx, "Could not reply to shell request", "error", err)
-				}
-			}
+		default:
+			log.WarnContext(ctx, "Unknown channel type", "type", t)
 
-		case "pty-req":
-			termLen := req.Payload[3]
-			w, h := parseDims(req.Payload[termLen+4:])
-			SetWinsize(shell.Fd(), w, h)
-			// Responding true (OK) here will let the client
-			// know we have a pty ready for input
-			err = req.Reply(true, nil)
+			err := channel.Reject(ssh.UnknownChannelType, fmt.Sprintf("unknown channel type: %s", t))
 			if err != nil {
-				log.ErrorContext(ctx, "Could not reply to pty request", "error", err)
+				log.WarnContext(ctx, "Could not reject channel", "error", err)
 			}
-
-		case "window-change":
-			w, h := parseDims(req.Payload)
-			SetWinsize(shell.Fd(), w, h)
 		}
 	}
 }
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+
+	"github.com/creack/pty"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/trunners/runners/logger"
+)
+
+// ptyRequest is the payload of a "pty-req" request (RFC 4254 section 6.2).
+type ptyRequest struct {
+	Term    string
+	Columns uint32
+	Rows    uint32
+	Width   uint32
+	Height  uint32
+	Modes   string
+}
+
+// envRequest is the payload of an "env" request (RFC 4254 section 6.4).
+type envRequest struct {
+	Name  string
+	Value string
+}
+
+// commandRequest is the payload of an "exec" request (RFC 4254 section 6.5).
+type commandRequest struct {
+	Command string
+}
+
+// process is the shell or command run for a session channel.
+type process struct {
+	shell   string
+	channel ssh.Channel
+	env     []string
+	pty     *ptyRequest
+	file    *os.File
+	cmd     *exec.Cmd
+}
+
+// session runs the shell, or the command of an exec request, for a session
+// channel. The process is killed when the channel is closed.
+func session(ctx context.Context, channel ssh.NewChannel, shell string) {
+	log := logger.FromContext(ctx)
+
+	connection, requests, err := channel.Accept()
+	if err != nil {
+		log.ErrorContext(ctx, "Could not accept channel", "error", err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	p := &process{
+		shell:   shell,
+		channel: connection,
+	}
+
+	for req := range requests {
+		ok := p.request(ctx, req)
+		if req.WantReply {
+			err = req.Reply(ok, nil)
+			if err != nil {
+				log.ErrorContext(ctx, "Could not reply to request", "type", req.Type, "error", err)
+			}
+		}
+	}
+
+	log.InfoContext(ctx, "Session closed")
+}
+
+// request handles a session request, returning whether it succeeded.
+func (p *process) request(ctx context.Context, req *ssh.Request) bool {
+	log := logger.FromContext(ctx)
+
+	switch req.Type {
+	case "pty-req":
+		var pty ptyRequest
+		if p.cmd != nil || ssh.Unmarshal(req.Payload, &pty) != nil {
+			return false
+		}
+
+		// Responding true (OK) here will let the client
+		// know we have a pty ready for input
+		p.pty = &pty
+		return true
+
+	case "env":
+		var env envRequest
+		if p.cmd != nil || ssh.Unmarshal(req.Payload, &env) != nil {
+			return false
+		}
+
+		p.env = append(p.env, env.Name+"="+env.Value)
+		return true
+
+	case "window-change":
+		w, h := parseDims(req.Payload)
+		switch {
+		case p.file != nil:
+			SetWinsize(p.file.Fd(), w, h)
+		case p.pty != nil:
+			p.pty.Columns, p.pty.Rows = w, h
+		}
+
+		return true
+
+	case "shell", "exec":
+		var args []string
+		if req.Type == "exec" {
+			var command commandRequest
+			if ssh.Unmarshal(req.Payload, &command) != nil {
+				return false
+			}
+			args = []string{"-c", command.Command}
+		}
+
+		if p.cmd != nil {
+			return false
+		}
+
+		err := p.start(ctx, args)
+		if err != nil {
+			log.ErrorContext(ctx, "Could not start process", "error", err)
+			return false
+		}
+
+		return true
+
+	default:
+		return false
+	}
+}
+
+// start runs the shell with args, on a pty if one was requested.
+func (p *process) start(ctx context.Context, args []string) error {
+	p.cmd = exec.CommandContext(ctx, p.shell, args...)
+	p.cmd.Env = append(os.Environ(), p.env...)
+
+	if p.pty == nil {
+		return p.startPipes(ctx)
+	}
+
+	p.cmd.Env = append(p.cmd.Env, "TERM="+p.pty.Term)
+
+	var err error
+	p.file, err = pty.StartWithSize(p.cmd, &pty.Winsize{
+		Cols: uint16(p.pty.Columns), //nolint:gosec // conversion is safe
+		Rows: uint16(p.pty.Rows),    //nolint:gosec // conversion is safe
+	})
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		_, err := io.Copy(p.file, p.channel)
+		if err != nil {
+			logger.FromContext(ctx).WarnContext(ctx, "Error copying from connection to shell", "error", err)
+		}
+	}()
+
+	var output sync.WaitGroup
+	output.Go(func() {
+		_, err := io.Copy(p.channel, p.file)
+		if err != nil && !errors.Is(err, os.ErrClosed) {
+			logger.FromContext(ctx).DebugContext(ctx, "Shell output closed", "error", err)
+		}
+	})
+
+	go p.exit(ctx, output.Wait)
+
+	return nil
+}
+
+// startPipes runs the command without a pty, with stderr on the extended data stream.
+func (p *process) startPipes(ctx context.Context) error {
+	stdin, err := p.cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	p.cmd.Stdout = p.channel
+	p.cmd.Stderr = p.channel.Stderr()
+
+	err = p.cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		_, _ = io.Copy(stdin, p.channel)
+		_ = stdin.Close()
+	}()
+
+	go p.exit(ctx, func() {})
+
+	return nil
+}
+
+// exit waits for the process and its output, then reports the exit status
+// and closes the channel.
+func (p *process) exit(ctx context.Context, output func()) {
+	log := logger.FromContext(ctx)
+
+	err := p.cmd.Wait()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		log.ErrorContext(ctx, "Could not wait for process", "error", err)
+	}
+
+	output()
+	if p.file != nil {
+		err = p.file.Close()
+		if err != nil {
+			log.WarnContext(ctx, "Could not close pty", "error", err)
+		}
+	}
+
+	if code := p.cmd.ProcessState.ExitCode(); code >= 0 {
+		status := ssh.Marshal(struct{ Status uint32 }{uint32(code)}) //nolint:gosec // checked above
+		_, err = p.channel.SendRequest("exit-status", false, status)
+		if err != nil {
+			log.WarnContext(ctx, "Could not send exit status", "error", err)
+		}
+	}
+
+	err = p.channel.Close()
+	if err != nil && !errors.Is(err, io.EOF) {
+		log.ErrorContext(ctx, "Could not close connection", "error", err)
+	}
+}
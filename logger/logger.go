@@ -13,12 +13,16 @@ const (
 	timeFormat = "[15:04:05]"
 )
 
+// Level is the minimum level logged by the loggers created by New, info
+// unless it is set.
+var Level = new(slog.LevelVar)
+
 // New creates a new slog.Logger that supports contextual fields.
 func New() *slog.Logger {
 	output := termenv.NewOutput(os.Stdout)
 	colors := colors(output)
 	handler := Handler{
-		Handler: slog.NewTextHandler(os.Stdout, nil),
+		Handler: slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: Level}),
 		output:  output,
 		colors:  colors,
 	}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/trunners/runners/logger"
+	"github.com/trunners/runners/server/pool"
+)
+
+var errTerminated = errors.New("terminated by an administrator")
+
+// sessions are the active sessions of the broker and the targets that are
+// drained of new sessions. Closing is done once the broker shuts down.
+type sessions struct {
+	mu      sync.Mutex
+	active  map[string]*session
+	drained map[string]bool
+
+	closing context.Context //nolint:containedctx // signals the shutdown to all sessions
+	stop    context.CancelFunc
+}
+
+func newSessions() *sessions {
+	closing, stop := context.WithCancel(context.Background())
+	return &sessions{
+		active:  map[string]*session{},
+		drained: map[string]bool{},
+		closing: closing,
+		stop:    stop,
+	}
+}
+
+// add lists a session until remove is called.
+func (a *sessions) add(s *session) (remove func()) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.active[s.id] = s
+	return func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+
+		delete(a.active, s.id)
+	}
+}
+
+func (a *sessions) get(id string) (*session, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	s, ok := a.active[id]
+	return s, ok
+}
+
+func (a *sessions) list() []*session {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	list := slices.Collect(maps.Values(a.active))
+	slices.SortFunc(list, func(x, y *session) int {
+		return x.started.Compare(y.started)
+	})
+
+	return list
+}
+
+// drain refuses new sessions to target, or accepts them again.
+func (a *sessions) drain(target string, drain bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if drain {
+		a.drained[target] = true
+	} else {
+		delete(a.drained, target)
+	}
+}
+
+func (a *sessions) draining(target string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.drained[target]
+}
+
+// count is a writer counting the bytes written to it.
+type count struct {
+	atomic.Int64
+}
+
+func (c *count) Write(p []byte) (int, error) {
+	c.Add(int64(len(p)))
+	return len(p), nil
+}
+
+// sessionInfo describes an active session.
+type sessionInfo struct {
+	ID       string    `json:"id"`
+	User     string    `json:"user"`
+	Target   string    `json:"target"`
+	Runner   string    `json:"runner,omitempty"`
+	RunID    int64     `json:"run_id,omitempty"`
+	RunURL   string    `json:"run_url,omitempty"`
+	Started  time.Time `json:"started"`
+	BytesIn  int64     `json:"bytes_in"`
+	BytesOut int64     `json:"bytes_out"`
+}
+
+func (s *session) info() sessionInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return sessionInfo{
+		ID:       s.id,
+		User:     s.user,
+		Target:   s.target,
+		Runner:   s.runnerName,
+		RunID:    s.runID,
+		RunURL:   s.runURL,
+		Started:  s.started,
+		BytesIn:  s.in.Load(),
+		BytesOut: s.out.Load(),
+	}
+}
+
+// runnersInfo is what the pool holds, with the sessions of parked runners.
+type runnersInfo struct {
+	pool.State
+
+	Parked []parkedInfo `json:"parked"`
+}
+
+// parkedInfo is a parked runner and the session whose run it belongs to.
+type parkedInfo struct {
+	pool.Parked
+
+	Session string `json:"session,omitempty"`
+}
+
+// targetInfo describes a target of the config.
+type targetInfo struct {
+	Name     string `json:"name"`
+	Sessions int    `json:"sessions"`
+	Drained  bool   `json:"drained"`
+}
+
+// admin serves the admin API to operators holding the admin token.
+type admin struct {
+	settings *settings
+	pool     *pool.Pool
+	sessions *sessions
+}
+
+// serveAdmin serves the admin API on listener until ctx is done.
+func serveAdmin(ctx context.Context, listener net.Listener, a *admin) error {
+	logger.FromContext(ctx).InfoContext(ctx, "Serving admin API", "address", listener.Addr())
+	return serveHTTP(ctx, a.handler(), listener)
+}
+
+func (a *admin) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /sessions", a.listSessions)
+	mux.HandleFunc("DELETE /sessions/{id}", a.terminateSession)
+	mux.HandleFunc("GET /runners", a.listRunners)
+	mux.HandleFunc("GET /targets", a.listTargets)
+	mux.HandleFunc("PUT /targets/{target}/drain", a.drainTarget)
+	mux.HandleFunc("DELETE /targets/{target}/drain", a.drainTarget)
+	mux.HandleFunc("GET /config", a.showConfig)
+	mux.HandleFunc("POST /config/reload", a.reloadConfig)
+
+	return bearer(func() string { return a.settings.Load().AdminToken }, mux)
+}
+
+func (a *admin) listSessions(w http.ResponseWriter, _ *http.Request) {
+	list := []sessionInfo{}
+	for _, s := range a.sessions.list() {
+		list = append(list, s.info())
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+// terminateSession ends a session, which also cancels its workflow run.
+func (a *admin) terminateSession(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	s, ok := a.sessions.get(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "no such session")
+		return
+	}
+
+	logger.FromContext(ctx).InfoContext(ctx, "Terminating session", "session", s.id, "user", s.user)
+	s.end(ctx, errTerminated, "The session was terminated by an administrator.")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *admin) listRunners(w http.ResponseWriter, _ *http.Request) {
+	runs := map[string]string{}
+	for _, s := range a.sessions.list() {
+		info := s.info()
+		if info.RunID != 0 {
+			runs[strconv.FormatInt(info.RunID, 10)] = info.ID
+		}
+	}
+
+	state := a.pool.State()
+	list := runnersInfo{State: state, Parked: []parkedInfo{}}
+	for _, parked := range state.Parked {
+		list.Parked = append(list.Parked, parkedInfo{Parked: parked, Session: runs[parked.Runner.RunID]})
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (a *admin) listTargets(w http.ResponseWriter, _ *http.Request) {
+	counts := map[string]int{}
+	for _, s := range a.sessions.list() {
+		counts[s.info().Target]++
+	}
+
+	list := []targetInfo{}
+	for _, name := range slices.Sorted(maps.Keys(a.settings.Load().Workflows)) {
+		list = append(list, targetInfo{
+			Name:     name,
+			Sessions: counts[name],
+			Drained:  a.sessions.draining(name),
+		})
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+// drainTarget refuses new sessions to a target while active ones continue,
+// until the drain is deleted.
+func (a *admin) drainTarget(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	target := r.PathValue("target")
+	if _, ok := a.settings.Load().Workflows[target]; !ok {
+		writeError(w, http.StatusNotFound, "no such target")
+		return
+	}
+
+	drain := r.Method == http.MethodPut
+	logger.FromContext(ctx).InfoContext(ctx, "Draining target", "target", target, "drain", drain)
+	a.sessions.drain(target, drain)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// reloadConfig reloads the config like SIGHUP does, telling why it is kept
+// if the new one is invalid.
+func (a *admin) reloadConfig(w http.ResponseWriter, r *http.Request) {
+	err := a.settings.reload(r.Context())
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// showConfig shows the effective config with secrets redacted. Keys are
+// shown by their fingerprints.
+func (a *admin) showConfig(w http.ResponseWriter, _ *http.Request) {
+	cfg := a.settings.Load()
+
+	redacted := func(secret string) string {
+		if secret == "" {
+			return ""
+		}
+		return "REDACTED"
+	}
+
+	var hostKeys []string
+	for _, hostKey := range cfg.HostKeys {
+		hostKeys = append(hostKeys, ssh.FingerprintSHA256(hostKey.Signer.PublicKey()))
+	}
+
+	var userCAs []string
+	for _, key := range cfg.UserCAs {
+		userCAs = append(userCAs, ssh.FingerprintSHA256(key))
+	}
+
+	var authorizedKeys []string
+	for _, key := range cfg.AuthorizedKeys {
+		authorizedKeys = append(authorizedKeys, key.User+" "+ssh.FingerprintSHA256(key.Key))
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"github_token":    redacted(cfg.GithubToken),
+		"admin_token":     redacted(cfg.AdminToken),
+		"github_users":    cfg.GithubUsers != nil,
+		"enrollment":      cfg.Enrollment != nil,
+		"host":            cfg.Host,
+		"port":            cfg.Port,
+		"recordings":      cfg.Recordings,
+		"audit_log":       redactURL(cfg.AuditLog),
+		"state":           cfg.State,
+		"metrics_address": cfg.MetricsAddress,
+		"admin_address":   cfg.AdminAddress,
+		"host_keys":       hostKeys,
+		"user_cas":        userCAs,
+		"ca":              cfg.CA != nil,
+		"authorized_keys": authorizedKeys,
+		"access":          cfg.Access,
+		"workflows":       cfg.Workflows,
+	})
+}
+
+// redactURL hides the credentials and query of an HTTP URL such as the
+// audit log endpoint.
+func redactURL(location string) string {
+	u, err := url.Parse(location)
+	if err != nil || u.Host == "" {
+		return location
+	}
+
+	if u.RawQuery != "" {
+		u.RawQuery = "REDACTED"
+	}
+
+	return u.Redacted()
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	_ = encoder.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,127 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/trunners/runners/logger"
+)
+
+// Event types.
+const (
+	SessionStart   = "session.start"
+	SessionEnd     = "session.end"
+	Dispatch       = "workflow.dispatch"
+	RunnerConnect  = "runner.connect"
+	ChannelOpen    = "channel.open"
+	ChannelReject  = "channel.reject"
+	ChannelClose   = "channel.close"
+	ChannelRequest = "channel.request"
+	CertIssue      = "certificate.issue"
+)
+
+// Event is a single line of the audit log.
+type Event struct {
+	Time        time.Time  `json:"time"`
+	Event       string     `json:"event"`
+	Session     string     `json:"session"`
+	User        string     `json:"user,omitempty"`
+	Fingerprint string     `json:"fingerprint,omitempty"`
+	RemoteIP    string     `json:"remote_ip,omitempty"`
+	Target      string     `json:"target,omitempty"`
+	RunID       int64      `json:"run_id,omitempty"`
+	Runner      string     `json:"runner,omitempty"`
+	Channel     string     `json:"channel,omitempty"`
+	Request     string     `json:"request,omitempty"`
+	Command     string     `json:"command,omitempty"`
+	Forward     string     `json:"forward,omitempty"`
+	BytesIn     int64      `json:"bytes_in,omitempty"`
+	BytesOut    int64      `json:"bytes_out,omitempty"`
+	Start       *time.Time `json:"start,omitempty"`
+	End         *time.Time `json:"end,omitempty"`
+	ExitStatus  *uint32    `json:"exit_status,omitempty"`
+	Serial      uint64     `json:"serial,omitempty"`
+	Reason      string     `json:"reason,omitempty"`
+}
+
+// Sink receives encoded audit events, one JSON document per call.
+type Sink interface {
+	Write(ctx context.Context, line []byte) error
+	Close() error
+}
+
+// Logger writes audit events to a sink. A nil Logger discards all events.
+type Logger struct {
+	mu   sync.Mutex
+	sink Sink
+}
+
+// Open creates a Logger for location, which is either "-" or "stderr" for
+// standard error, an http(s) URL to POST events to, or a file path. Standard
+// output is refused, the log is written there and would mix with the events.
+// An empty location returns a nil Logger.
+func Open(ctx context.Context, location string) (*Logger, error) {
+	var sink Sink
+	var err error
+
+	switch {
+	case location == "":
+		return nil, nil //nolint:nilnil // a nil logger discards events
+	case location == "stdout":
+		return nil, errors.New("standard output carries the log, write audit events to stderr instead")
+	case location == "-" || location == "stderr":
+		sink = stderrSink{}
+	case strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://"):
+		sink = newHTTPSink(ctx, location)
+	default:
+		sink, err = newFileSink(location)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &Logger{sink: sink}, nil
+}
+
+// Log writes the event, setting its time if it is empty.
+func (l *Logger) Log(ctx context.Context, event Event) {
+	if l == nil {
+		return
+	}
+
+	log := logger.FromContext(ctx)
+
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+
+	line, err := json.Marshal(event)
+	if err != nil {
+		log.ErrorContext(ctx, "Could not encode audit event", "error", err)
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	err = l.sink.Write(ctx, line)
+	if err != nil {
+		log.ErrorContext(ctx, "Could not write audit event", "error", err)
+	}
+}
+
+// Close flushes and closes the sink.
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.sink.Close()
+}
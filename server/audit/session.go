@@ -0,0 +1,119 @@
+package audit
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Session holds the fields shared by all events of a single SSH connection.
+// A nil Session discards all events.
+type Session struct {
+	logger *Logger
+
+	mu    sync.Mutex
+	base  Event
+	start time.Time
+
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+}
+
+// Session starts a new audit session and logs its start.
+func (l *Logger) Session(ctx context.Context, base Event) *Session {
+	if l == nil {
+		return nil
+	}
+
+	s := &Session{
+		logger: l,
+		base:   base,
+		start:  time.Now().UTC(),
+	}
+
+	s.Log(ctx, Event{Event: SessionStart, Start: &s.start})
+
+	return s
+}
+
+// SetRun records the ID of the workflow run dispatched for the session.
+func (s *Session) SetRun(id int64) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.base.RunID = id
+}
+
+// SetTarget records the target with the parameters chosen at login.
+func (s *Session) SetTarget(target string) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.base.Target = target
+}
+
+// SetRunner records the identity of the runner serving the session.
+func (s *Session) SetRunner(runner string) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.base.Runner = runner
+}
+
+// Transferred adds to the bytes transferred during the session.
+func (s *Session) Transferred(in, out int64) {
+	if s == nil {
+		return
+	}
+
+	s.bytesIn.Add(in)
+	s.bytesOut.Add(out)
+}
+
+// Log writes the event with the shared session fields filled in.
+func (s *Session) Log(ctx context.Context, event Event) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	base := s.base
+	s.mu.Unlock()
+
+	event.Session = base.Session
+	event.User = base.User
+	event.Fingerprint = base.Fingerprint
+	event.RemoteIP = base.RemoteIP
+	event.Target = base.Target
+	event.RunID = base.RunID
+	event.Runner = base.Runner
+
+	s.logger.Log(ctx, event)
+}
+
+// End logs the end of the session with the total bytes transferred.
+func (s *Session) End(ctx context.Context, reason string) {
+	if s == nil {
+		return
+	}
+
+	end := time.Now().UTC()
+	s.Log(ctx, Event{
+		Event:    SessionEnd,
+		Start:    &s.start,
+		End:      &end,
+		BytesIn:  s.bytesIn.Load(),
+		BytesOut: s.bytesOut.Load(),
+		Reason:   reason,
+	})
+}
@@ -0,0 +1,119 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/trunners/runners/logger"
+)
+
+const (
+	httpQueue   = 1024
+	httpTimeout = 10 * time.Second
+)
+
+type stderrSink struct{}
+
+func (stderrSink) Write(_ context.Context, line []byte) error {
+	_, err := os.Stderr.Write(append(line, '\n'))
+	return err
+}
+
+func (stderrSink) Close() error {
+	return nil
+}
+
+type fileSink struct {
+	file *os.File
+}
+
+func newFileSink(path string) (*fileSink, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileSink{file: file}, nil
+}
+
+func (f *fileSink) Write(_ context.Context, line []byte) error {
+	_, err := f.file.Write(append(line, '\n'))
+	return err
+}
+
+func (f *fileSink) Close() error {
+	return f.file.Close()
+}
+
+// httpSink posts events to an HTTP endpoint in the background so that a slow
+// endpoint does not hold up sessions. Events are dropped when the queue is full.
+type httpSink struct {
+	url    string
+	client *http.Client
+	queue  chan []byte
+	done   chan struct{}
+}
+
+func newHTTPSink(ctx context.Context, url string) *httpSink {
+	h := &httpSink{
+		url:    url,
+		client: &http.Client{Timeout: httpTimeout},
+		queue:  make(chan []byte, httpQueue),
+		done:   make(chan struct{}),
+	}
+
+	go h.send(context.WithoutCancel(ctx))
+
+	return h
+}
+
+func (h *httpSink) Write(_ context.Context, line []byte) error {
+	select {
+	case h.queue <- line:
+		return nil
+	default:
+		return fmt.Errorf("audit queue full, dropping event: %s", line)
+	}
+}
+
+func (h *httpSink) Close() error {
+	close(h.queue)
+	<-h.done
+	return nil
+}
+
+func (h *httpSink) send(ctx context.Context) {
+	log := logger.FromContext(ctx)
+	defer close(h.done)
+
+	for line := range h.queue {
+		err := h.post(ctx, line)
+		if err != nil {
+			log.ErrorContext(ctx, "Could not send audit event", "error", err)
+		}
+	}
+}
+
+func (h *httpSink) post(ctx context.Context, line []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(line))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("audit endpoint returned %s", resp.Status)
+	}
+
+	return nil
+}
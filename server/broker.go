@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/trunners/runners/logger"
+	"github.com/trunners/runners/server/audit"
+	"github.com/trunners/runners/server/config"
+)
+
+// maxKeySize limits the public key read from the user.
+const maxKeySize = 16 * 1024
+
+// broker answers commands addressed to the broker rather than to a target,
+// as in "ssh broker cert", and lets users pick one of the choices in an
+// interactive session. Any other session is turned away with message. It
+// returns the reason the session ended, or the target picked.
+func broker(
+	ctx context.Context,
+	cfg *config.Config,
+	channels <-chan ssh.NewChannel,
+	s *session,
+	message string,
+	options []choice,
+) (string, *picked) {
+	log := logger.FromContext(ctx)
+
+	waitCtx, cancel := context.WithTimeout(ctx, rejectTimeout)
+	defer cancel()
+
+	serverChannel, serverReqs, ok := accept(waitCtx, channels, message)
+	if !ok {
+		return "unknown target", nil
+	}
+	stop := context.AfterFunc(waitCtx, func() {
+		_ = serverChannel.Close()
+	})
+	defer stop()
+
+	// The requests setting up the session are passed on to the runner of a picked
+	// target, restricted like those of any other session
+	var received []*ssh.Request
+	pty := false
+	for req := range serverReqs {
+		switch req.Type {
+		case "shell", "exec":
+			if req.WantReply {
+				err := req.Reply(true, nil)
+				if err != nil {
+					log.WarnContext(ctx, "Could not reply to request", "type", req.Type, "error", err)
+				}
+			}
+
+			if req.Type == "shell" && pty && len(options) > 0 && stop() {
+				return pickTarget(ctx, serverChannel, append(received, req), serverReqs, options)
+			}
+			go ssh.DiscardRequests(serverReqs)
+
+			var command commandRequest
+			_ = ssh.Unmarshal(req.Payload, &command)
+
+			if strings.TrimSpace(command.Command) != "cert" || cfg.CA == nil {
+				fail(ctx, serverChannel, message)
+				return "unknown target", nil
+			}
+
+			err := issue(ctx, cfg, serverChannel, s)
+			if err != nil {
+				log.WarnContext(ctx, "Could not issue certificate", "error", err)
+				fail(ctx, serverChannel, "Could not issue a certificate: "+err.Error()+".")
+				return "certificate refused", nil
+			}
+
+			exit(ctx, serverChannel, 0)
+			return "certificate issued", nil
+
+		case "pty-req", "env", "window-change":
+			// Without a pty there is no picker to offer either
+			permitted := req.Type != "pty-req" || config.Permitted(s.perms, config.ExtensionPTY)
+			if req.WantReply {
+				_ = req.Reply(permitted, nil)
+			}
+			if !permitted {
+				continue
+			}
+			pty = pty || req.Type == "pty-req"
+			received = append(received, req)
+
+		default:
+			if req.WantReply {
+				_ = req.Reply(false, nil)
+			}
+		}
+	}
+
+	return "connection closed", nil
+}
+
+// pickTarget holds the channel while the user picks one of the choices.
+func pickTarget(
+	ctx context.Context,
+	channel ssh.Channel,
+	received []*ssh.Request,
+	requests <-chan *ssh.Request,
+	options []choice,
+) (string, *picked) {
+	log := logger.FromContext(ctx)
+
+	ctx, leave := context.WithCancelCause(ctx)
+	defer leave(nil)
+
+	h := keep(channel, received, requests, func() { leave(errLeft) })
+	target, err := pick(ctx, h, options)
+	if err != nil {
+		h.abandon()
+
+		reason, message := err.Error(), "No target picked."
+		switch {
+		case errors.Is(err, errLeft):
+			message = "Left without picking a target."
+		case errors.Is(err, errPickTimeout):
+			message = "No target picked in time."
+		case errors.Is(err, io.EOF):
+			reason = "connection closed"
+		}
+		fail(ctx, channel, "\r\n"+message)
+		return reason, nil
+	}
+
+	log.InfoContext(ctx, "Target picked", "target", target)
+	return "target picked", &picked{target: target, held: h}
+}
+
+// issue reads a public key from the channel and writes a certificate for it
+// back. The certificate lets the user launch the same targets with the same
+// restrictions as the key they authenticated with, and expires with it.
+// Certificates are not issued on the basis of other certificates, which would
+// let them be renewed forever.
+func issue(ctx context.Context, cfg *config.Config, channel ssh.Channel, s *session) error {
+	if _, ok := s.perms.Extensions[config.ExtensionCertificate]; ok {
+		return errors.New("authenticated with a certificate, log in with a key to get one")
+	}
+
+	input, err := io.ReadAll(io.LimitReader(channel, maxKeySize))
+	if err != nil {
+		return err
+	}
+
+	key, _, _, _, err := ssh.ParseAuthorizedKey(input)
+	if err != nil {
+		return errors.New("expected a public key on standard input")
+	}
+	if _, ok := key.(*ssh.Certificate); ok {
+		return errors.New("expected a public key, not a certificate")
+	}
+
+	principals := config.Principals(s.perms)
+	if len(principals) == 0 {
+		return errors.New("no targets to issue a certificate for")
+	}
+
+	user := s.perms.Extensions[config.ExtensionUser]
+	criticalOptions, extensions := config.CertificateOptions(s.perms)
+	cert, err := cfg.CA.Issue(key, user, principals, criticalOptions, extensions, config.Expiry(s.perms))
+	if err != nil {
+		return err
+	}
+
+	_, err = channel.Write(ssh.MarshalAuthorizedKey(cert))
+	if err != nil {
+		return err
+	}
+
+	logger.FromContext(ctx).InfoContext(ctx, "Issued certificate", "user", user, "serial", cert.Serial, "principals", principals)
+	s.audit.Log(ctx, audit.Event{Event: audit.CertIssue, Command: "cert", Serial: cert.Serial})
+
+	return nil
+}
@@ -0,0 +1,114 @@
+package ca
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// skew backdates certificates to tolerate clocks running slightly behind.
+const skew = 5 * time.Minute
+
+// Authority issues short-lived user certificates.
+type Authority struct {
+	signer   ssh.Signer
+	validity time.Duration
+}
+
+// Load reads the CA private key at location, generating an ed25519 key if
+// the file does not exist yet.
+func Load(location string, validity time.Duration) (*Authority, error) {
+	file, err := os.ReadFile(location)
+	if errors.Is(err, os.ErrNotExist) {
+		file, err = generate(location)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := ssh.ParsePrivateKey(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Authority{
+		signer:   signer,
+		validity: validity,
+	}, nil
+}
+
+// PublicKey returns the key certificates are signed with.
+func (a *Authority) PublicKey() ssh.PublicKey {
+	return a.signer.PublicKey()
+}
+
+// Issue signs a user certificate for key. The key ID names the user and the
+// principals are the targets they may launch. The certificate expires after
+// the validity, or at expiry if that is earlier and not zero.
+func (a *Authority) Issue(
+	key ssh.PublicKey,
+	keyID string,
+	principals []string,
+	criticalOptions, extensions map[string]string,
+	expiry time.Time,
+) (*ssh.Certificate, error) {
+	var serial [8]byte
+	_, err := rand.Read(serial[:])
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	validBefore := now.Add(a.validity)
+	if !expiry.IsZero() && expiry.Before(validBefore) {
+		validBefore = expiry
+	}
+
+	cert := &ssh.Certificate{
+		Key:             key,
+		Serial:          binary.BigEndian.Uint64(serial[:]),
+		CertType:        ssh.UserCert,
+		KeyId:           keyID,
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(now.Add(-skew).Unix()), //nolint:gosec // time is after the epoch
+		ValidBefore:     uint64(validBefore.Unix()),    //nolint:gosec // time is after the epoch
+		Permissions: ssh.Permissions{
+			CriticalOptions: criticalOptions,
+			Extensions:      extensions,
+		},
+	}
+
+	err = cert.SignCert(rand.Reader, a.signer)
+	if err != nil {
+		return nil, err
+	}
+
+	return cert, nil
+}
+
+// generate creates a new CA key at location and returns it PEM encoded.
+func generate(location string) ([]byte, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := ssh.MarshalPrivateKey(key, "runners user CA")
+	if err != nil {
+		return nil, err
+	}
+
+	file := pem.EncodeToMemory(block)
+	err = os.WriteFile(location, file, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	return file, nil
+}
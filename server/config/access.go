@@ -0,0 +1,181 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Wildcard matches every target in a target list.
+const Wildcard = "*"
+
+// Access is the access policy read from the users file. Its limits apply to
+// every user without limits of their own.
+type Access struct {
+	Users  map[string]User  `json:"users"`
+	Groups map[string]Group `json:"groups"`
+	Limits Limits           `json:"limits"`
+}
+
+// User is a named user with their keys and group memberships.
+// Targets, if set, limits the targets the user may launch.
+// Users with a higher priority are served first when queueing for a target.
+type User struct {
+	Keys     []string `json:"keys"`
+	Groups   []string `json:"groups"`
+	Targets  []string `json:"targets"`
+	Limits   Limits   `json:"limits"`
+	Priority int      `json:"priority"`
+}
+
+// Group limits the targets its members may launch and how much they may use
+// the runners together. Its priority applies to all members.
+type Group struct {
+	Targets  []string `json:"targets"`
+	Limits   Limits   `json:"limits"`
+	Priority int      `json:"priority"`
+}
+
+// loadAccess reads the access policy and returns the keys of its users.
+func loadAccess(location string) (*Access, []AuthorizedKey, error) {
+	file, err := os.ReadFile(location)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var access Access
+	err = json.Unmarshal(file, &access)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var authorizedKeys []AuthorizedKey
+	for name, user := range access.Users {
+		for _, line := range user.Keys {
+			var key ssh.PublicKey
+			var options []string
+			key, _, options, _, err = ssh.ParseAuthorizedKey([]byte(line))
+			if err != nil {
+				return nil, nil, err
+			}
+
+			authorizedKey := AuthorizedKey{
+				Key:    key,
+				User:   name,
+				Groups: user.Groups,
+			}
+			authorizedKey.Options, err = parseOptions(options)
+			if err != nil {
+				return nil, nil, fmt.Errorf("user %s: %w", name, err)
+			}
+
+			authorizedKeys = append(authorizedKeys, authorizedKey)
+		}
+	}
+
+	return &access, authorizedKeys, nil
+}
+
+// Targets returns the sorted names of the workflows that a user in the given
+// groups may launch. A workflow is allowed if its allow list is empty or names
+// the user or one of their groups as "@group", and it is within the limits set
+// on the user and their groups. Without any limits every workflow is within them.
+func (c *Config) Targets(user string, groups []string) []string {
+	var limits []string
+	if c.Access != nil {
+		limits = append(limits, c.Access.Users[user].Targets...)
+		for _, group := range groups {
+			limits = append(limits, c.Access.Groups[group].Targets...)
+		}
+	}
+
+	var targets []string
+	for name, w := range c.Workflows {
+		if len(limits) > 0 && !slices.Contains(limits, name) && !slices.Contains(limits, Wildcard) {
+			continue
+		}
+
+		if len(w.Allow) > 0 && !allows(w.Allow, user, groups) {
+			continue
+		}
+
+		targets = append(targets, name)
+	}
+
+	slices.Sort(targets)
+	return targets
+}
+
+func allows(allow []string, user string, groups []string) bool {
+	for _, entry := range allow {
+		group, isGroup := strings.CutPrefix(entry, "@")
+		switch {
+		case entry == Wildcard:
+			return true
+		case isGroup && slices.Contains(groups, group):
+			return true
+		case !isGroup && entry == user:
+			return true
+		}
+	}
+
+	return false
+}
+
+// Allowed reports whether the authorization decision recorded in perms
+// allows the target to be launched.
+func Allowed(perms *ssh.Permissions, target string) bool {
+	if perms == nil {
+		return false
+	}
+
+	targets := strings.Split(perms.Extensions[ExtensionTargets], ",")
+	return slices.Contains(targets, target)
+}
+
+// Priority returns the highest priority of the user and their groups.
+func (c *Config) Priority(user string, groups []string) int {
+	if c.Access == nil {
+		return 0
+	}
+
+	priority := c.Access.Users[user].Priority
+	for _, group := range groups {
+		priority = max(priority, c.Access.Groups[group].Priority)
+	}
+
+	return priority
+}
+
+// Groups returns the groups recorded in perms.
+func Groups(perms *ssh.Permissions) []string {
+	var groups []string
+	for group := range strings.SplitSeq(perms.Extensions[ExtensionGroups], ",") {
+		if group != "" {
+			groups = append(groups, group)
+		}
+	}
+
+	return groups
+}
+
+// Principals returns the principals of a certificate carrying the
+// authorization recorded in perms: the targets of the user, and their groups
+// as "@group".
+func Principals(perms *ssh.Permissions) []string {
+	var principals []string
+	for target := range strings.SplitSeq(perms.Extensions[ExtensionTargets], ",") {
+		if target != "" {
+			principals = append(principals, target)
+		}
+	}
+	for _, group := range Groups(perms) {
+		principals = append(principals, "@"+group)
+	}
+
+	return principals
+}
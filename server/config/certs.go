@@ -0,0 +1,224 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const sourceAddressOption = "source-address"
+
+// Revocations lists revoked certificate serials and key IDs.
+type Revocations struct {
+	Serials [][2]uint64
+	KeyIDs  []string
+}
+
+// loadKeys reads public keys in authorized_keys format, such as the trusted user CA keys.
+func loadKeys(location string) ([]ssh.PublicKey, error) {
+	file, err := os.ReadFile(location)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []ssh.PublicKey
+	for len(bytes.TrimSpace(file)) > 0 {
+		var key ssh.PublicKey
+		key, _, _, file, err = ssh.ParseAuthorizedKey(file)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// loadRevocations reads a revocation list with one "serial: N", "serial: N-M"
+// or "id: KEY_ID" entry per line, like the input of ssh-keygen -k.
+func loadRevocations(location string) (*Revocations, error) {
+	file, err := os.Open(location)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var r Revocations
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		kind, value, ok := strings.Cut(line, ":")
+		value = strings.TrimSpace(value)
+		if !ok {
+			return nil, fmt.Errorf("invalid revocation: %q", line)
+		}
+
+		switch strings.TrimSpace(kind) {
+		case "serial":
+			from, to, isRange := strings.Cut(value, "-")
+			if !isRange {
+				to = from
+			}
+
+			var serials [2]uint64
+			serials[0], err = strconv.ParseUint(from, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			serials[1], err = strconv.ParseUint(to, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+
+			r.Serials = append(r.Serials, serials)
+
+		case "id":
+			r.KeyIDs = append(r.KeyIDs, value)
+
+		default:
+			return nil, fmt.Errorf("unsupported revocation: %q", line)
+		}
+	}
+
+	return &r, scanner.Err()
+}
+
+// Revoked reports whether the certificate's serial or key ID is revoked.
+func (r *Revocations) Revoked(cert *ssh.Certificate) bool {
+	if r == nil {
+		return false
+	}
+
+	for _, serials := range r.Serials {
+		if cert.Serial >= serials[0] && cert.Serial <= serials[1] {
+			return true
+		}
+	}
+
+	return slices.Contains(r.KeyIDs, cert.KeyId)
+}
+
+// PrincipalTargets returns the targets a certificate with the given key ID and
+// principals may launch. A principal naming a target allows it, and one naming
+// a group as "@group" allows that group's targets. The groups are also those
+// used in workflow allow lists.
+func (c *Config) PrincipalTargets(keyID string, principals []string) []string {
+	named, groups := splitPrincipals(principals)
+
+	var allowed []string
+	for _, name := range named {
+		if _, ok := c.Workflows[name]; ok {
+			allowed = append(allowed, name)
+		}
+	}
+	if c.Access != nil {
+		for _, group := range groups {
+			allowed = append(allowed, c.Access.Groups[group].Targets...)
+		}
+	}
+
+	var targets []string
+	for name, w := range c.Workflows {
+		if !slices.Contains(allowed, name) && !slices.Contains(allowed, Wildcard) {
+			continue
+		}
+
+		if len(w.Allow) > 0 && !allows(w.Allow, keyID, groups) {
+			continue
+		}
+
+		targets = append(targets, name)
+	}
+
+	slices.Sort(targets)
+	return targets
+}
+
+// splitPrincipals splits principals into the targets they name and the
+// groups named with an "@" prefix.
+func splitPrincipals(principals []string) ([]string, []string) {
+	var targets, groups []string
+	for _, principal := range principals {
+		if group, ok := strings.CutPrefix(principal, "@"); ok {
+			groups = append(groups, group)
+		} else {
+			targets = append(targets, principal)
+		}
+	}
+
+	return targets, groups
+}
+
+// certPermissions authenticates a user certificate signed by a trusted CA.
+// The certificate's options and extensions become the session's permissions.
+func (c *Config) certPermissions(cert *ssh.Certificate) (*ssh.Permissions, error) {
+	if cert.CertType != ssh.UserCert {
+		return nil, fmt.Errorf("certificate has type %d", cert.CertType)
+	}
+
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return slices.ContainsFunc(c.UserCAs, func(ca ssh.PublicKey) bool {
+				return keysEqual(ca, auth)
+			})
+		},
+		IsRevoked:                c.Revocations.Revoked,
+		SupportedCriticalOptions: []string{OptionForceCommand, sourceAddressOption},
+	}
+
+	if !checker.IsUserAuthority(cert.SignatureKey) {
+		return nil, errors.New("certificate signed by unrecognized authority")
+	}
+
+	// principals map to targets below instead of having to match the target
+	principal := ""
+	if len(cert.ValidPrincipals) > 0 {
+		principal = cert.ValidPrincipals[0]
+	}
+
+	err := checker.CheckCert(principal, cert)
+	if err != nil {
+		return nil, err
+	}
+
+	perms := &ssh.Permissions{
+		CriticalOptions: maps.Clone(cert.CriticalOptions),
+		Extensions:      maps.Clone(cert.Extensions),
+	}
+	if perms.CriticalOptions == nil {
+		perms.CriticalOptions = map[string]string{}
+	}
+	if perms.Extensions == nil {
+		perms.Extensions = map[string]string{}
+	}
+
+	perms.Extensions[ExtensionUser] = cert.KeyId
+	perms.Extensions[ExtensionFingerprint] = ssh.FingerprintSHA256(cert.Key)
+	perms.Extensions[ExtensionCertificate] = strconv.FormatUint(cert.Serial, 10)
+
+	// the source address is a critical option of certificates
+	delete(perms.Extensions, ExtensionSourceAddress)
+	delete(perms.Extensions, ExtensionExpiry)
+	if cert.ValidBefore != ssh.CertTimeInfinity {
+		perms.Extensions[ExtensionExpiry] = strconv.FormatUint(cert.ValidBefore, 10)
+	}
+	perms.Extensions[ExtensionTargets] = strings.Join(c.PrincipalTargets(cert.KeyId, cert.ValidPrincipals), ",")
+
+	_, groups := splitPrincipals(cert.ValidPrincipals)
+	perms.Extensions[ExtensionGroups] = strings.Join(groups, ",")
+
+	return perms, nil
+}
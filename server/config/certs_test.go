@@ -0,0 +1,149 @@
+package config
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"slices"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestPrincipalTargets(t *testing.T) {
+	cfg := &Config{
+		Access: &Access{Groups: map[string]Group{
+			"dev":   {Targets: []string{"ubuntu"}},
+			"admin": {Targets: []string{Wildcard}},
+		}},
+		Workflows: map[string]Workflow{
+			"ubuntu": {},
+			"arm":    {},
+			"darwin": {Allow: []string{"@staff", "carol"}},
+		},
+	}
+
+	tests := []struct {
+		name       string
+		keyID      string
+		principals []string
+		want       []string
+	}{
+		{name: "none", keyID: "alice"},
+		{name: "target", keyID: "alice", principals: []string{"arm"}, want: []string{"arm"}},
+		{name: "unknown target", keyID: "alice", principals: []string{"windows"}},
+		{name: "group", keyID: "alice", principals: []string{"@dev"}, want: []string{"ubuntu"}},
+		{name: "unknown group", keyID: "alice", principals: []string{"@ops"}},
+		{name: "both", keyID: "alice", principals: []string{"@dev", "arm"}, want: []string{"arm", "ubuntu"}},
+		{name: "wildcard group", keyID: "alice", principals: []string{"@admin"}, want: []string{"arm", "ubuntu"}},
+		{
+			name:       "allowed by group",
+			keyID:      "alice",
+			principals: []string{"@admin", "@staff"},
+			want:       []string{"arm", "darwin", "ubuntu"},
+		},
+		{name: "allowed by key ID", keyID: "carol", principals: []string{"darwin"}, want: []string{"darwin"}},
+		{name: "not allowed", keyID: "alice", principals: []string{"darwin"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := cfg.PrincipalTargets(test.keyID, test.principals)
+			if !slices.Equal(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func newSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signer
+}
+
+func TestCertPermissions(t *testing.T) {
+	ca, rogue := newSigner(t), newSigner(t)
+	cfg := &Config{
+		UserCAs:     []ssh.PublicKey{ca.PublicKey()},
+		Revocations: &Revocations{KeyIDs: []string{"mallory"}},
+		Access:      &Access{Groups: map[string]Group{"dev": {Targets: []string{"ubuntu"}}}},
+		Workflows:   map[string]Workflow{"ubuntu": {}, "arm": {}},
+	}
+
+	tests := []struct {
+		name       string
+		signer     ssh.Signer
+		certType   uint32
+		keyID      string
+		principals []string
+		targets    string
+		groups     string
+		err        bool
+	}{
+		{
+			name:       "principals",
+			signer:     ca,
+			certType:   ssh.UserCert,
+			keyID:      "alice",
+			principals: []string{"@dev", "arm"},
+			targets:    "arm,ubuntu",
+			groups:     "dev",
+		},
+		{name: "untrusted", signer: rogue, certType: ssh.UserCert, keyID: "alice", err: true},
+		{name: "host certificate", signer: ca, certType: ssh.HostCert, keyID: "alice", err: true},
+		{name: "revoked", signer: ca, certType: ssh.UserCert, keyID: "mallory", err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cert := &ssh.Certificate{
+				Key:             newKey(t),
+				CertType:        test.certType,
+				KeyId:           test.keyID,
+				ValidPrincipals: test.principals,
+				ValidBefore:     ssh.CertTimeInfinity,
+				Permissions: ssh.Permissions{
+					Extensions: map[string]string{ExtensionPTY: "", ExtensionTargets: "forged"},
+				},
+			}
+			err := cert.SignCert(rand.Reader, test.signer)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			perms, err := cfg.certPermissions(cert)
+			if test.err {
+				if err == nil {
+					t.Fatal("accepted the certificate")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := perms.Extensions[ExtensionUser]; got != test.keyID {
+				t.Errorf("got user %q, want %q", got, test.keyID)
+			}
+			if got := perms.Extensions[ExtensionTargets]; got != test.targets {
+				t.Errorf("got targets %q, want %q", got, test.targets)
+			}
+			if got := perms.Extensions[ExtensionGroups]; got != test.groups {
+				t.Errorf("got groups %q, want %q", got, test.groups)
+			}
+			if !Permitted(perms, ExtensionPTY) {
+				t.Error("dropped the extensions of the certificate")
+			}
+		})
+	}
+}
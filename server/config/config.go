@@ -2,108 +2,361 @@ package config
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/tls"
+	"errors"
+	"log/slog"
 	"net"
+	"net/netip"
 	"os"
-	"strconv"
+	"strings"
+	"time"
 
 	"golang.org/x/crypto/ssh"
+
+	"github.com/trunners/runners/logger"
+	"github.com/trunners/runners/server/ca"
+	"github.com/trunners/runners/server/github"
 )
 
 type Workflow struct {
-	ID         string `json:"id"`
-	Owner      string `json:"owner"`
-	Repository string `json:"repo"`
-	Ref        string `json:"ref"`
-	RunsOn     string `json:"runs-on"`
+	ID           string   `json:"id"`
+	Owner        string   `json:"owner"`
+	Repository   string   `json:"repo"`
+	Ref          string   `json:"ref"`
+	RunsOn       string   `json:"runs-on"`
+	Record       Record   `json:"record"`
+	Allow        []string `json:"allow"`
+	Runners      int      `json:"runners"`
+	RunnerWeight float64  `json:"weight"`
+	Timeouts     Timeouts `json:"timeouts"`
+
+	// Tags describe the runners for users asking for capabilities, like
+	// {"os": "linux", "arch": "arm64", "memory": "16GB"}.
+	Tags map[string]string `json:"tags"`
+	// Cost ranks the targets matching such a request, cheapest first.
+	Cost float64 `json:"cost"`
+
+	// Params let users choose values at login, see Target.
+	Params  map[string]Param             `json:"params"`
+	Aliases map[string]map[string]string `json:"aliases"`
+	// Inputs are the extra inputs the workflow declares besides runs-on,
+	// server and session. Params other than ref, runs-on and repo are
+	// passed as them.
+	Inputs []string `json:"inputs"`
+}
+
+// Record configures session recording for a workflow.
+type Record struct {
+	Enabled   bool     `json:"enabled"`
+	Retention Duration `json:"retention"`
+}
+
+// Timeouts end idle sessions and those running for too long, warning the
+// user the given durations before.
+type Timeouts struct {
+	Idle     Duration   `json:"idle"`
+	Max      Duration   `json:"max"`
+	Warnings []Duration `json:"warnings"`
+}
+
+// WarningDurations returns the configured warnings, five minutes and one
+// minute before by default.
+func (t Timeouts) WarningDurations() []time.Duration {
+	if len(t.Warnings) == 0 {
+		return []time.Duration{5 * time.Minute, time.Minute}
+	}
+
+	warnings := make([]time.Duration, 0, len(t.Warnings))
+	for _, warning := range t.Warnings {
+		warnings = append(warnings, time.Duration(warning))
+	}
+
+	return warnings
+}
+
+// AuthorizedKey is a key from the authorized keys or users file.
+type AuthorizedKey struct {
+	Key     ssh.PublicKey
+	User    string
+	Groups  []string
+	Options Options
 }
 
 type Config struct {
 	GithubToken    string
+	Github         github.Github
+	GithubUsers    *github.Users
+	Enrollment     *Enrollment
 	Host           string
 	Port           int
-	AuthorizedKeys []ssh.PublicKey
+	Proxies        []netip.Prefix
+	Network        Network
+	Throttle       Throttle
+	Limits         Limits
+	Selection      Selection
+	LogLevel       slog.Level
+	DrainTimeout   time.Duration
+	Watch          time.Duration
+	Files          []string
+	Recordings     string
+	AuditLog       string
+	MetricsAddress string
+	AdminAddress   string
+	AdminToken     string
+	MetricsToken   string
+	WebhookSecret  string
+	TLS            *tls.Config
+	State          string
+	AuthorizedKeys []AuthorizedKey
+	Access         *Access
+	HostKeys       []HostKey
+	UserCAs        []ssh.PublicKey
+	CA             *ca.Authority
+	Revocations    *Revocations
 	Server         *ssh.ServerConfig
 	Client         *ssh.ClientConfig
 	Workflows      map[string]Workflow
 }
 
+// Load reads the config file named by CONFIG, config.json by default, and
+// everything it refers to. All problems of the settings and of the files
+// they refer to are reported at once.
 func Load(ctx context.Context) (*Config, error) {
-	// Load config file
-	location := env("CONFIG", "config.json")
-	file, err := os.ReadFile(location)
+	log := logger.FromContext(ctx)
+
+	location := os.Getenv("CONFIG")
+	if location == "" {
+		location = "config.json"
+	}
+
+	var p problems
+	f, err := readFile(location, &p)
 	if err != nil {
 		return nil, err
 	}
+	f.validate(&p)
+
+	cfg := Config{
+		Workflows:      f.Targets,
+		Port:           f.Listen.Port,
+		Host:           f.Advertise,
+		MetricsAddress: f.Listen.Metrics,
+		AdminAddress:   f.Listen.Admin,
+		Limits:         f.Limits,
+		Selection:      f.Selection,
+		DrainTimeout:   time.Duration(f.Drain),
+		Watch:          time.Duration(f.Watch),
+		Recordings:     f.Storage.Recordings,
+		State:          f.Storage.State,
+		Throttle: Throttle{
+			Backoff:    time.Duration(f.Throttle.Backoff),
+			MaxBackoff: time.Duration(f.Throttle.MaxBackoff),
+			BanAfter:   f.Throttle.BanAfter,
+			Ban:        time.Duration(f.Throttle.Ban),
+		},
+	}
+	cfg.GithubToken = p.secret("github.token", f.Github.Token)
+	cfg.WebhookSecret = p.secret("github.webhook_secret", f.Github.WebhookSecret)
+	cfg.AdminToken = p.secret("listen.admin_token", f.Listen.AdminToken)
+	cfg.MetricsToken = p.secret("listen.metrics_token", f.Listen.MetricsToken)
+	cfg.AuditLog = p.secret("storage.audit_log", f.Storage.AuditLog)
+	_ = cfg.LogLevel.UnmarshalText([]byte(f.Logging.Level))
+
+	// Runners call back to the advertised address, the outbound one by default
+	if cfg.Host == "" {
+		ip, err := outboundIP(ctx)
+		if err != nil {
+			p.add("advertise", "required if the outbound address is unknown: %s", err)
+		} else {
+			cfg.Host = ip.String()
+		}
+	}
 
-	// Parse config file
-	var cfg Config
-	err = json.Unmarshal(file, &cfg.Workflows)
+	// GitHub users, enrollment and the Actions ranges need the API
+	cfg.Github, err = github.New(cfg.GithubToken, f.Github.APIURL)
 	if err != nil {
-		return nil, err
+		p.add("github.api_url", "%s", err)
+	} else {
+		// Optionally authorize GitHub users by their keys, listed by login or as "org/team"
+		auth := f.Auth.Github
+		if len(auth.Users) > 0 || auth.Team != "" {
+			org, team, _ := strings.Cut(auth.Team, "/")
+			cfg.GithubUsers = cfg.Github.Users(auth.Users, org, team, time.Duration(auth.CacheTTL))
+		}
+
+		// Optionally enroll unknown keys of organization members with a GitHub app's device flow
+		if auth.ClientID != "" {
+			org := auth.Org
+			if org == "" {
+				org, _, _ = strings.Cut(auth.Team, "/")
+			}
+
+			device := github.NewDevice(auth.ClientID, f.Github.URL)
+			cfg.Enrollment, err = loadEnrollment(auth.Enrolled, org, device, cfg.Github, time.Duration(auth.CacheTTL))
+			if err != nil {
+				p.add("auth.github.enrolled", "%s", err)
+			}
+		}
+
+		// Addresses SSH clients and runners may connect from
+		cfg.Network = loadNetwork(ctx, cfg.Github, f.Network, f.Github.Meta, &p)
 	}
 
-	// Require GitHub token
-	cfg.GithubToken = env("GITHUB_TOKEN", "")
+	// Load balancers trusted to tell the client address with the PROXY
+	// protocol, validate reported those that do not parse
+	cfg.Proxies, _ = parsePrefixes(f.Listen.ProxyProtocol)
 
-	// Parse host & port
-	cfg.Host = env("HOST", getOutboundIP(ctx).String())
-	cfg.Port, err = strconv.Atoi(env("PORT", "8080"))
+	// Optional certificate to serve HTTPS on the broker's port
+	if f.Listen.TLSCert != "" {
+		var cert tls.Certificate
+		cert, err = tls.LoadX509KeyPair(f.Listen.TLSCert, f.Listen.TLSKey)
+		if err != nil {
+			p.add("listen.tls_cert", "%s", err)
+		} else {
+			cfg.TLS = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+		}
+	}
+
+	// Load host keys, generating them on first start
+	cfg.HostKeys, err = loadHostKeys(f.Keys.Host, f.Keys.HostDir)
 	if err != nil {
-		return nil, err
+		p.add("keys.host", "%s", err)
+	}
+
+	// Load optional access policy
+	if f.Auth.Users != "" {
+		cfg.Access, cfg.AuthorizedKeys, err = loadAccess(f.Auth.Users)
+		if err != nil {
+			p.add("auth.users", "%s", err)
+		}
+	}
+
+	// Load optional certificate authorities and revocations
+	if f.Auth.TrustedUserCAKeys != "" {
+		cfg.UserCAs, err = loadKeys(f.Auth.TrustedUserCAKeys)
+		if err != nil {
+			p.add("auth.trusted_user_ca_keys", "%s", err)
+		}
+	}
+
+	// Optionally issue certificates, which are then trusted like those of any other CA
+	if f.Keys.CA != "" {
+		cfg.CA, err = ca.Load(f.Keys.CA, time.Duration(f.Keys.CertValidity))
+		if err != nil {
+			p.add("keys.ca", "%s", err)
+		} else {
+			cfg.UserCAs = append(cfg.UserCAs, cfg.CA.PublicKey())
+		}
 	}
 
-	// Load authorized keys
-	authorizedKeysFile := env("AUTHORIZED_KEYS", "/etc/ssh/authorized_keys")
-	authorizedKeysBytes, err := os.ReadFile(authorizedKeysFile)
+	if f.Auth.RevokedCertificates != "" {
+		cfg.Revocations, err = loadRevocations(f.Auth.RevokedCertificates)
+		if err != nil {
+			p.add("auth.revoked_certificates", "%s", err)
+		}
+	}
+
+	// Load authorized keys, which are optional with other sources of keys
+	authorizedKeysBytes, err := os.ReadFile(f.Auth.AuthorizedKeys)
+	if errors.Is(err, os.ErrNotExist) && hasKeySource(&cfg) {
+		authorizedKeysBytes, err = nil, nil
+	}
 	if err != nil {
-		return nil, err
+		p.add("auth.authorized_keys", "%s", err)
 	}
 	for len(authorizedKeysBytes) > 0 {
 		var key ssh.PublicKey
+		var comment string
+		var options []string
 		var rest []byte
-		key, _, _, rest, err = ssh.ParseAuthorizedKey(authorizedKeysBytes)
+		key, comment, options, rest, err = ssh.ParseAuthorizedKey(authorizedKeysBytes)
 		if err != nil {
-			return nil, err
+			p.add("auth.authorized_keys", "%s", err)
+			break
 		}
-
-		cfg.AuthorizedKeys = append(cfg.AuthorizedKeys, key)
 		authorizedKeysBytes = rest
-	}
 
-	cfg.Server = serverConfig(cfg.AuthorizedKeys)
-	cfg.Client = clientConfig()
+		authorizedKey := AuthorizedKey{Key: key, User: comment}
+		authorizedKey.Options, err = parseOptions(options)
+		if err != nil {
+			p.add("auth.authorized_keys", "key %s: %s", ssh.FingerprintSHA256(key), err)
+			continue
+		}
 
-	return &cfg, nil
-}
+		cfg.AuthorizedKeys = append(cfg.AuthorizedKeys, authorizedKey)
+	}
+
+	err = p.err()
+	if err != nil {
+		return nil, err
+	}
 
-func env(key string, deafult string) string {
-	value := os.Getenv(key)
-	if value == "" {
-		if deafult == "" {
-			panic("Environment variable " + key + " is required but not set")
+	for _, k := range cfg.AuthorizedKeys {
+		if len(k.Options.Unrecognized) > 0 {
+			log.WarnContext(
+				ctx,
+				"Ignoring unsupported key options",
+				"key",
+				ssh.FingerprintSHA256(k.Key),
+				"options",
+				k.Options.Unrecognized,
+			)
 		}
+	}
 
-		return deafult
+	// Files a reload is due on when they change
+	cfg.Files = []string{location, f.Auth.AuthorizedKeys}
+	for _, file := range []string{f.Auth.Users, f.Auth.TrustedUserCAKeys, f.Auth.RevokedCertificates, f.Listen.TLSCert} {
+		if file != "" {
+			cfg.Files = append(cfg.Files, file)
+		}
 	}
 
-	return value
+	cfg.Server = serverConfig(ctx, &cfg)
+	cfg.Client = clientConfig()
+
+	return &cfg, nil
 }
 
-// get preferred outbound ip of this machine.
-func getOutboundIP(ctx context.Context) net.IP {
+// hasKeySource reports whether keys are authorized by anything but the authorized keys file.
+func hasKeySource(cfg *Config) bool {
+	return cfg.Access != nil || len(cfg.UserCAs) > 0 || cfg.GithubUsers != nil || cfg.Enrollment != nil
+}
+
+// outboundIP returns the address of this machine that routes to the internet.
+func outboundIP(ctx context.Context) (net.IP, error) {
 	dialer := &net.Dialer{}
 	conn, err := dialer.DialContext(ctx, "udp", "8.8.8.8:80")
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	defer conn.Close()
 
-	localAddr := conn.LocalAddr()
-	udpAddr, ok := localAddr.(*net.UDPAddr)
+	udpAddr, ok := conn.LocalAddr().(*net.UDPAddr)
 	if !ok {
-		return net.IPv4zero
+		return nil, errors.New("no UDP address")
+	}
+
+	return udpAddr.IP, nil
+}
+
+// parsePrefixes parses a list of CIDR prefixes or single addresses.
+func parsePrefixes(list []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(list))
+	for _, item := range list {
+		item = strings.TrimSpace(item)
+
+		if addr, err := netip.ParseAddr(item); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(item)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
 	}
 
-	return udpAddr.IP
+	return prefixes, nil
 }
@@ -0,0 +1,173 @@
+package config
+
+import (
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Diff summarizes what changed from old to c, one line per change. Changes
+// of settings the broker only reads when it starts say that they require a
+// restart.
+func (c *Config) Diff(old *Config) []string {
+	var changes []string
+	changed := func(format string, args ...any) {
+		changes = append(changes, fmt.Sprintf(format, args...))
+	}
+
+	added, removed, modified := diffMaps(old.Workflows, c.Workflows)
+	for _, name := range added {
+		changed("target %s added", name)
+	}
+	for _, name := range removed {
+		changed("target %s removed", name)
+	}
+	for _, name := range modified {
+		changed("target %s changed", name)
+	}
+
+	added, removed, _ = diffMaps(authorizedKeys(old.AuthorizedKeys), authorizedKeys(c.AuthorizedKeys))
+	for _, key := range added {
+		changed("authorized key %s added", key)
+	}
+	for _, key := range removed {
+		changed("authorized key %s removed", key)
+	}
+
+	switch {
+	case old.Access == nil && c.Access != nil:
+		changed("access policy added")
+	case old.Access != nil && c.Access == nil:
+		changed("access policy removed")
+	case old.Access != nil:
+		added, removed, modified = diffMaps(old.Access.Users, c.Access.Users)
+		for _, name := range added {
+			changed("user %s added", name)
+		}
+		for _, name := range removed {
+			changed("user %s removed", name)
+		}
+		for _, name := range modified {
+			changed("user %s changed", name)
+		}
+
+		added, removed, modified = diffMaps(old.Access.Groups, c.Access.Groups)
+		for _, name := range added {
+			changed("group %s added", name)
+		}
+		for _, name := range removed {
+			changed("group %s removed", name)
+		}
+		for _, name := range modified {
+			changed("group %s changed", name)
+		}
+
+		if old.Access.Limits != c.Access.Limits {
+			changed("default limits of the access policy changed")
+		}
+	}
+
+	for _, setting := range []struct {
+		name     string
+		old, new any
+	}{
+		{"advertised address", old.Host, c.Host},
+		{"host keys", hostKeys(old.HostKeys), hostKeys(c.HostKeys)},
+		{"trusted user CA keys", fingerprints(old.UserCAs), fingerprints(c.UserCAs)},
+		{"revoked certificates", old.Revocations, c.Revocations},
+		{"GitHub users", old.GithubUsers != nil, c.GithubUsers != nil},
+		{"enrollment", old.Enrollment != nil, c.Enrollment != nil},
+		{"PROXY protocol addresses", old.Proxies, c.Proxies},
+		{"network", old.Network, c.Network},
+		{"throttle", old.Throttle, c.Throttle},
+		{"limits", old.Limits, c.Limits},
+		{"selection", old.Selection, c.Selection},
+		{"log level", old.LogLevel, c.LogLevel},
+		{"drain timeout", old.DrainTimeout, c.DrainTimeout},
+		{"recordings", old.Recordings, c.Recordings},
+		{"GitHub token", old.GithubToken, c.GithubToken},
+		{"webhook secret", old.WebhookSecret, c.WebhookSecret},
+		{"admin token", old.AdminToken, c.AdminToken},
+		{"metrics token", old.MetricsToken, c.MetricsToken},
+	} {
+		if !reflect.DeepEqual(setting.old, setting.new) {
+			changed("%s changed", setting.name)
+		}
+	}
+	if old.TLS != nil && c.TLS != nil && !reflect.DeepEqual(old.TLS.Certificates, c.TLS.Certificates) {
+		changed("TLS certificate changed")
+	}
+
+	for _, setting := range []struct {
+		name     string
+		old, new any
+	}{
+		{"port", old.Port, c.Port},
+		{"metrics address", old.MetricsAddress, c.MetricsAddress},
+		{"admin address", old.AdminAddress, c.AdminAddress},
+		{"TLS", old.TLS != nil, c.TLS != nil},
+		{"state", old.State, c.State},
+		{"audit log", old.AuditLog, c.AuditLog},
+		{"watch", old.Watch, c.Watch},
+	} {
+		if !reflect.DeepEqual(setting.old, setting.new) {
+			changed("%s changed, which requires a restart", setting.name)
+		}
+	}
+
+	return changes
+}
+
+// diffMaps returns the sorted keys added to, removed from and changed in b
+// compared to a.
+func diffMaps[V any](a, b map[string]V) ([]string, []string, []string) {
+	var added, removed, modified []string
+	for _, key := range slices.Sorted(maps.Keys(b)) {
+		old, ok := a[key]
+		switch {
+		case !ok:
+			added = append(added, key)
+		case !reflect.DeepEqual(old, b[key]):
+			modified = append(modified, key)
+		}
+	}
+
+	for _, key := range slices.Sorted(maps.Keys(a)) {
+		if _, ok := b[key]; !ok {
+			removed = append(removed, key)
+		}
+	}
+
+	return added, removed, modified
+}
+
+// authorizedKeys identifies the keys by their users and fingerprints.
+func authorizedKeys(keys []AuthorizedKey) map[string]AuthorizedKey {
+	m := make(map[string]AuthorizedKey, len(keys))
+	for _, key := range keys {
+		m[key.User+" "+ssh.FingerprintSHA256(key.Key)] = key
+	}
+
+	return m
+}
+
+func hostKeys(keys []HostKey) []string {
+	fingerprints := make([]string, 0, len(keys))
+	for _, key := range keys {
+		fingerprints = append(fingerprints, ssh.FingerprintSHA256(key.Signer.PublicKey()))
+	}
+
+	return fingerprints
+}
+
+func fingerprints(keys []ssh.PublicKey) []string {
+	fingerprints := make([]string, 0, len(keys))
+	for _, key := range keys {
+		fingerprints = append(fingerprints, ssh.FingerprintSHA256(key))
+	}
+
+	return fingerprints
+}
@@ -0,0 +1,164 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/trunners/runners/logger"
+	"github.com/trunners/runners/server/github"
+)
+
+// enrollTimeout bounds the whole enrollment, GitHub's device codes expire sooner.
+const enrollTimeout = 20 * time.Minute
+
+// Enrollment registers unknown keys of members of a GitHub organization.
+// Users prove who they are with the device flow and the keys they offered
+// are stored in an authorized keys file with their login as the comment.
+// Like other GitHub users they may launch the targets whose repository they
+// can write to.
+type Enrollment struct {
+	Org    string
+	device *github.Device
+	github github.Github
+	users  *github.Users
+
+	mu       sync.Mutex
+	location string
+	keys     map[string]string
+}
+
+// loadEnrollment reads the keys enrolled so far, the file is created on the first enrollment.
+func loadEnrollment(
+	location, org string,
+	device *github.Device,
+	gh github.Github,
+	ttl time.Duration,
+) (*Enrollment, error) {
+	e := &Enrollment{
+		Org:      org,
+		device:   device,
+		github:   gh,
+		users:    gh.Users(nil, "", "", ttl),
+		location: location,
+		keys:     map[string]string{},
+	}
+
+	file, err := os.ReadFile(location)
+	if errors.Is(err, os.ErrNotExist) {
+		return e, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for len(file) > 0 {
+		var key ssh.PublicKey
+		var login string
+		key, login, _, file, err = ssh.ParseAuthorizedKey(file)
+		if err != nil {
+			return nil, err
+		}
+
+		e.keys[string(key.Marshal())] = login
+	}
+
+	return e, nil
+}
+
+// Login returns the login the key was enrolled for.
+func (e *Enrollment) Login(key ssh.PublicKey) (string, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	login, ok := e.keys[string(key.Marshal())]
+	return login, ok
+}
+
+// Enroll walks the user through the device flow and registers the key
+// for their login if they are a member of the organization.
+func (e *Enrollment) Enroll(
+	ctx context.Context,
+	key ssh.PublicKey,
+	challenge ssh.KeyboardInteractiveChallenge,
+) (string, error) {
+	log := logger.FromContext(ctx)
+
+	ctx, cancel := context.WithTimeout(ctx, enrollTimeout)
+	defer cancel()
+
+	code, err := e.device.Code(ctx, "read:org")
+	if err != nil {
+		return "", err
+	}
+
+	instruction := fmt.Sprintf(
+		"The key %s is not registered.\r\nTo register it, open %s and enter the code %s\r\n",
+		ssh.FingerprintSHA256(key),
+		code.VerificationURI,
+		code.UserCode,
+	)
+	_, err = challenge("GitHub enrollment", instruction, []string{"Press Enter once authorized"}, []bool{false})
+	if err != nil {
+		return "", err
+	}
+
+	token, err := e.device.Token(ctx, code)
+	if err != nil {
+		return "", e.fail(challenge, err)
+	}
+
+	user := e.github.As(token)
+	login, err := user.User(ctx)
+	if err != nil {
+		return "", e.fail(challenge, err)
+	}
+
+	member, err := user.Member(ctx, e.Org)
+	if err != nil || !member {
+		return "", e.fail(challenge, fmt.Errorf("%s is not a member of %s", login, e.Org))
+	}
+
+	err = e.add(key, login)
+	if err != nil {
+		return "", e.fail(challenge, err)
+	}
+
+	log.InfoContext(ctx, "Enrolled key", "user", login, "key", ssh.FingerprintSHA256(key))
+	_, _ = challenge("", "Registered the key for "+login+".\r\n", nil, nil)
+
+	return login, nil
+}
+
+// add stores the key for login.
+func (e *Enrollment) add(key ssh.PublicKey, login string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	file, err := os.OpenFile(e.location, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	line := strings.TrimSuffix(string(ssh.MarshalAuthorizedKey(key)), "\n") + " " + login + "\n"
+	_, err = file.WriteString(line)
+	if err != nil {
+		return err
+	}
+
+	e.keys[string(key.Marshal())] = login
+	return nil
+}
+
+// fail tells the user why the enrollment failed and returns err.
+func (e *Enrollment) fail(challenge ssh.KeyboardInteractiveChallenge, err error) error {
+	_, _ = challenge("", "Enrollment failed: "+err.Error()+"\r\n", nil, nil)
+	return err
+}
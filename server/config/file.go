@@ -0,0 +1,517 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/trunners/runners/server/github"
+)
+
+// File is the config file. Each setting may be overridden by the environment
+// variable named in its comment; secrets also by the file named in the
+// variable with a _FILE suffix, like GITHUB_TOKEN_FILE. Files of earlier
+// versions that only map targets to their workflows are still read.
+type File struct {
+	Listen    Listen              `json:"listen"`
+	Advertise string              `json:"advertise"` // HOST, the outbound address by default
+	Github    GithubFile          `json:"github"`
+	Keys      Keys                `json:"keys"`
+	Auth      Auth                `json:"auth"`
+	Network   NetworkFile         `json:"network"`
+	Throttle  ThrottleFile        `json:"throttle"`
+	Limits    Limits              `json:"limits"`
+	Selection Selection           `json:"selection"`
+	Storage   Storage             `json:"storage"`
+	Logging   Logging             `json:"logging"`
+	Drain     Duration            `json:"drain_timeout"` // DRAIN_TIMEOUT
+	Watch     Duration            `json:"watch"`         // WATCH
+	Targets   map[string]Workflow `json:"targets"`
+}
+
+// Listen configures where the broker is served.
+type Listen struct {
+	Port          int      `json:"port"`           // PORT
+	ProxyProtocol []string `json:"proxy_protocol"` // PROXY_PROTOCOL
+	TLSCert       string   `json:"tls_cert"`       // TLS_CERT
+	TLSKey        string   `json:"tls_key"`        // TLS_KEY
+	Metrics       string   `json:"metrics"`        // METRICS_ADDRESS
+	MetricsToken  Secret   `json:"metrics_token"`  // METRICS_TOKEN
+	Admin         string   `json:"admin"`          // ADMIN_ADDRESS
+	AdminToken    Secret   `json:"admin_token"`    // ADMIN_TOKEN
+}
+
+// GithubFile configures the GitHub credentials and endpoints.
+type GithubFile struct {
+	Token         Secret `json:"token"`          // GITHUB_TOKEN
+	APIURL        string `json:"api_url"`        // GITHUB_API_URL
+	URL           string `json:"url"`            // GITHUB_URL
+	Meta          string `json:"meta"`           // GITHUB_META
+	WebhookSecret Secret `json:"webhook_secret"` // WEBHOOK_SECRET
+}
+
+// Keys configures the broker's host keys and certificate authority.
+type Keys struct {
+	Host         []string `json:"host"`          // HOST_KEYS
+	HostDir      string   `json:"host_dir"`      // HOST_KEYS_DIR
+	CA           string   `json:"ca"`            // CA_KEY
+	CertValidity Duration `json:"cert_validity"` // CERT_VALIDITY
+}
+
+// Auth configures the sources of the keys users authenticate with.
+type Auth struct {
+	AuthorizedKeys      string     `json:"authorized_keys"`      // AUTHORIZED_KEYS
+	Users               string     `json:"users"`                // USERS
+	TrustedUserCAKeys   string     `json:"trusted_user_ca_keys"` // TRUSTED_USER_CA_KEYS
+	RevokedCertificates string     `json:"revoked_certificates"` // REVOKED_CERTIFICATES
+	Github              GithubAuth `json:"github"`
+}
+
+// GithubAuth authorizes GitHub users by their keys and enrolls keys of
+// organization members with a GitHub app's device flow.
+type GithubAuth struct {
+	Users    []string `json:"users"`     // GITHUB_USERS
+	Team     string   `json:"team"`      // GITHUB_TEAM
+	CacheTTL Duration `json:"cache_ttl"` // GITHUB_CACHE_TTL
+	ClientID string   `json:"client_id"` // GITHUB_CLIENT_ID
+	Org      string   `json:"org"`       // GITHUB_ORG
+	Enrolled string   `json:"enrolled"`  // ENROLLED_KEYS
+}
+
+// NetworkFile lists the addresses SSH clients and runners may connect from.
+type NetworkFile struct {
+	SSHAllow    []string `json:"ssh_allow"`    // SSH_ALLOW
+	SSHDeny     []string `json:"ssh_deny"`     // SSH_DENY
+	RunnerAllow []string `json:"runner_allow"` // RUNNER_ALLOW
+	RunnerDeny  []string `json:"runner_deny"`  // RUNNER_DENY
+}
+
+// ThrottleFile configures the backoff of addresses failing to authenticate.
+type ThrottleFile struct {
+	Backoff    Duration `json:"backoff"`     // AUTH_BACKOFF
+	MaxBackoff Duration `json:"max_backoff"` // AUTH_BACKOFF_MAX
+	BanAfter   int      `json:"ban_after"`   // AUTH_BAN_AFTER
+	Ban        Duration `json:"ban"`         // AUTH_BAN
+}
+
+// Selection configures how targets are picked for users asking for
+// capabilities instead of naming a target.
+type Selection struct {
+	// Prefer is "cost" to pick the cheapest matching target first, or "wait"
+	// for the one with the shortest expected wait.
+	Prefer string `json:"prefer"` // SELECT_PREFER
+	// Failover is how long a runner may take to call back before the next
+	// matching target is tried, zero to wait for the first one.
+	Failover Duration `json:"failover"` // FAILOVER
+}
+
+// Storage configures the files the broker writes.
+type Storage struct {
+	Recordings string `json:"recordings"` // RECORDINGS
+	State      string `json:"state"`      // STATE
+	AuditLog   Secret `json:"audit_log"`  // AUDIT_LOG
+}
+
+// Logging configures the log.
+type Logging struct {
+	Level string `json:"level"` // LOG_LEVEL
+}
+
+// defaults returns the settings of a config file that leaves them out.
+func defaults() File {
+	return File{
+		Listen: Listen{Port: 8080}, //nolint:mnd // default port
+		Github: GithubFile{APIURL: github.DefaultURL, URL: github.DefaultLoginURL},
+		Keys: Keys{
+			HostDir:      "host_keys",
+			CertValidity: Duration(8 * time.Hour), //nolint:mnd // a working day
+		},
+		Auth: Auth{
+			AuthorizedKeys: "/etc/ssh/authorized_keys",
+			Github: GithubAuth{
+				CacheTTL: Duration(5 * time.Minute), //nolint:mnd // default cache TTL
+				Enrolled: "enrolled_keys",
+			},
+		},
+		Throttle: ThrottleFile{
+			Backoff:    Duration(time.Second),
+			MaxBackoff: Duration(5 * time.Minute), //nolint:mnd // default backoff
+			BanAfter:   10,                        //nolint:mnd // default failures
+			Ban:        Duration(time.Hour),
+		},
+		Storage: Storage{
+			Recordings: "recordings",
+			State:      "state.jsonl",
+		},
+		Selection: Selection{
+			Prefer:   PreferCost,
+			Failover: Duration(10 * time.Minute), //nolint:mnd // longer than runners usually take
+		},
+		Logging: Logging{Level: "info"},
+		Drain:   Duration(30 * time.Minute), //nolint:mnd // default drain timeout
+	}
+}
+
+// readFile reads the config file at location with the defaults of settings
+// it leaves out, overridden by the environment.
+func readFile(location string, p *problems) (File, error) {
+	f := defaults()
+
+	data, err := os.ReadFile(location)
+	if err != nil {
+		return File{}, err
+	}
+
+	var sections map[string]json.RawMessage
+	err = json.Unmarshal(data, &sections)
+	if err != nil {
+		return File{}, fmt.Errorf("%s: %w", location, err)
+	}
+
+	if _, ok := sections["targets"]; ok {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&f)
+	} else {
+		err = json.Unmarshal(data, &f.Targets)
+	}
+	if err != nil {
+		return File{}, fmt.Errorf("%s: %w", location, err)
+	}
+
+	f.override(p)
+	return f, nil
+}
+
+// override applies the settings given by environment variables.
+func (f *File) override(p *problems) {
+	o := overrides{p}
+
+	o.int("PORT", &f.Listen.Port)
+	o.list("PROXY_PROTOCOL", &f.Listen.ProxyProtocol)
+	o.string("TLS_CERT", &f.Listen.TLSCert)
+	o.string("TLS_KEY", &f.Listen.TLSKey)
+	o.string("METRICS_ADDRESS", &f.Listen.Metrics)
+	o.secret("METRICS_TOKEN", &f.Listen.MetricsToken)
+	o.string("ADMIN_ADDRESS", &f.Listen.Admin)
+	o.secret("ADMIN_TOKEN", &f.Listen.AdminToken)
+	o.string("HOST", &f.Advertise)
+
+	o.secret("GITHUB_TOKEN", &f.Github.Token)
+	o.string("GITHUB_API_URL", &f.Github.APIURL)
+	o.string("GITHUB_URL", &f.Github.URL)
+	o.string("GITHUB_META", &f.Github.Meta)
+	o.secret("WEBHOOK_SECRET", &f.Github.WebhookSecret)
+
+	o.list("HOST_KEYS", &f.Keys.Host)
+	o.string("HOST_KEYS_DIR", &f.Keys.HostDir)
+	o.string("CA_KEY", &f.Keys.CA)
+	o.duration("CERT_VALIDITY", &f.Keys.CertValidity)
+
+	o.string("AUTHORIZED_KEYS", &f.Auth.AuthorizedKeys)
+	o.string("USERS", &f.Auth.Users)
+	o.string("TRUSTED_USER_CA_KEYS", &f.Auth.TrustedUserCAKeys)
+	o.string("REVOKED_CERTIFICATES", &f.Auth.RevokedCertificates)
+	o.list("GITHUB_USERS", &f.Auth.Github.Users)
+	o.string("GITHUB_TEAM", &f.Auth.Github.Team)
+	o.duration("GITHUB_CACHE_TTL", &f.Auth.Github.CacheTTL)
+	o.string("GITHUB_CLIENT_ID", &f.Auth.Github.ClientID)
+	o.string("GITHUB_ORG", &f.Auth.Github.Org)
+	o.string("ENROLLED_KEYS", &f.Auth.Github.Enrolled)
+
+	o.list("SSH_ALLOW", &f.Network.SSHAllow)
+	o.list("SSH_DENY", &f.Network.SSHDeny)
+	o.list("RUNNER_ALLOW", &f.Network.RunnerAllow)
+	o.list("RUNNER_DENY", &f.Network.RunnerDeny)
+
+	o.duration("AUTH_BACKOFF", &f.Throttle.Backoff)
+	o.duration("AUTH_BACKOFF_MAX", &f.Throttle.MaxBackoff)
+	o.int("AUTH_BAN_AFTER", &f.Throttle.BanAfter)
+	o.duration("AUTH_BAN", &f.Throttle.Ban)
+
+	o.string("SELECT_PREFER", &f.Selection.Prefer)
+	o.duration("FAILOVER", &f.Selection.Failover)
+
+	o.string("RECORDINGS", &f.Storage.Recordings)
+	o.string("STATE", &f.Storage.State)
+	o.secret("AUDIT_LOG", &f.Storage.AuditLog)
+
+	o.string("LOG_LEVEL", &f.Logging.Level)
+	o.duration("DRAIN_TIMEOUT", &f.Drain)
+	o.duration("WATCH", &f.Watch)
+}
+
+// validate checks the settings, recording all problems found.
+func (f *File) validate(p *problems) {
+	if f.Listen.Port <= 0 || f.Listen.Port > 65535 {
+		p.add("listen.port", "%d is not a port", f.Listen.Port)
+	}
+	if (f.Listen.TLSCert == "") != (f.Listen.TLSKey == "") {
+		p.add("listen.tls_cert", "requires both a certificate and a key")
+	}
+	if f.Listen.Admin != "" && f.Listen.AdminToken.empty() {
+		p.add("listen.admin_token", "required to serve the admin API")
+	}
+	if f.Github.Token.empty() {
+		p.add("github.token", "required")
+	}
+	if f.Auth.Github.ClientID != "" && f.Auth.Github.Org == "" && f.Auth.Github.Team == "" {
+		p.add("auth.github.org", "required to enroll keys")
+	}
+
+	for _, list := range []struct {
+		path     string
+		prefixes []string
+	}{
+		{"listen.proxy_protocol", f.Listen.ProxyProtocol},
+		{"network.ssh_allow", f.Network.SSHAllow},
+		{"network.ssh_deny", f.Network.SSHDeny},
+		{"network.runner_allow", f.Network.RunnerAllow},
+		{"network.runner_deny", f.Network.RunnerDeny},
+	} {
+		for i, prefix := range list.prefixes {
+			_, err := parsePrefixes([]string{prefix})
+			if err != nil {
+				p.add(fmt.Sprintf("%s[%d]", list.path, i), "%s", err)
+			}
+		}
+	}
+
+	for _, d := range []struct {
+		path     string
+		duration Duration
+	}{
+		{"keys.cert_validity", f.Keys.CertValidity},
+		{"auth.github.cache_ttl", f.Auth.Github.CacheTTL},
+		{"throttle.backoff", f.Throttle.Backoff},
+		{"throttle.max_backoff", f.Throttle.MaxBackoff},
+		{"throttle.ban", f.Throttle.Ban},
+		{"limits.duration", f.Limits.Duration},
+		{"limits.daily", f.Limits.Daily},
+		{"limits.monthly", f.Limits.Monthly},
+		{"selection.failover", f.Selection.Failover},
+		{"drain_timeout", f.Drain},
+		{"watch", f.Watch},
+	} {
+		if d.duration < 0 {
+			p.add(d.path, "must not be negative")
+		}
+	}
+	if f.Throttle.BanAfter < 0 {
+		p.add("throttle.ban_after", "must not be negative")
+	}
+	if f.Limits.Sessions < 0 {
+		p.add("limits.sessions", "must not be negative")
+	}
+	if f.Selection.Prefer != PreferCost && f.Selection.Prefer != PreferWait {
+		p.add("selection.prefer", "%q is not one of %s or %s", f.Selection.Prefer, PreferCost, PreferWait)
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(f.Logging.Level)); err != nil {
+		p.add("logging.level", "%q is not one of debug, info, warn or error", f.Logging.Level)
+	}
+
+	if len(f.Targets) == 0 {
+		p.add("targets", "required")
+	}
+	for _, name := range slices.Sorted(maps.Keys(f.Targets)) {
+		f.Targets[name].validate(p, "targets."+name)
+	}
+	validateAliases(p, f.Targets)
+}
+
+// validate checks the workflow of the target at path.
+func (w Workflow) validate(p *problems, path string) {
+	for _, field := range []struct {
+		name  string
+		value string
+	}{
+		{"id", w.ID},
+		{"owner", w.Owner},
+		{"repo", w.Repository},
+		{"ref", w.Ref},
+		{"runs-on", w.RunsOn},
+	} {
+		if field.value == "" {
+			p.add(path+"."+field.name, "required")
+		}
+	}
+
+	if w.Runners < 0 {
+		p.add(path+".runners", "must not be negative")
+	}
+	if w.RunnerWeight < 0 {
+		p.add(path+".weight", "must not be negative")
+	}
+	if w.Record.Retention < 0 {
+		p.add(path+".record.retention", "must not be negative")
+	}
+	if w.Timeouts.Idle < 0 {
+		p.add(path+".timeouts.idle", "must not be negative")
+	}
+	if w.Timeouts.Max < 0 {
+		p.add(path+".timeouts.max", "must not be negative")
+	}
+	for i, warning := range w.Timeouts.Warnings {
+		if warning <= 0 {
+			p.add(fmt.Sprintf("%s.timeouts.warnings[%d]", path, i), "must be positive")
+		}
+	}
+	w.validateParams(p, path)
+	w.validateTags(p, path)
+}
+
+// Secret is a secret given in the config file itself, read from an
+// environment variable or read from a file:
+//
+//	"token"
+//	{"env": "GITHUB_TOKEN"}
+//	{"file": "/run/secrets/github_token"}
+type Secret struct {
+	Value string
+	Env   string
+	File  string
+}
+
+func (s *Secret) UnmarshalJSON(b []byte) error {
+	var value string
+	if json.Unmarshal(b, &value) == nil {
+		*s = Secret{Value: value}
+		return nil
+	}
+
+	var ref struct {
+		Env  string `json:"env"`
+		File string `json:"file"`
+	}
+	err := json.Unmarshal(b, &ref)
+	if err != nil {
+		return err
+	}
+	if (ref.Env == "") == (ref.File == "") {
+		return errors.New(`a secret is a string, {"env": "NAME"} or {"file": "path"}`)
+	}
+
+	*s = Secret{Env: ref.Env, File: ref.File}
+	return nil
+}
+
+// empty reports whether no secret is given.
+func (s Secret) empty() bool {
+	return s.Value == "" && s.Env == "" && s.File == ""
+}
+
+// resolve returns the secret, reading it from its environment variable or
+// file. Trailing newlines of files are ignored.
+func (s Secret) resolve() (string, error) {
+	switch {
+	case s.Env != "":
+		value := os.Getenv(s.Env)
+		if value == "" {
+			return "", fmt.Errorf("environment variable %s is not set", s.Env)
+		}
+
+		return value, nil
+	case s.File != "":
+		value, err := os.ReadFile(s.File)
+		if err != nil {
+			return "", err
+		}
+
+		return strings.TrimRight(string(value), "\r\n"), nil
+	default:
+		return s.Value, nil
+	}
+}
+
+// problems collects the problems of a config with the paths of the
+// settings at fault, to report them all at once.
+type problems []string
+
+func (p *problems) add(path string, format string, args ...any) {
+	*p = append(*p, path+": "+fmt.Sprintf(format, args...))
+}
+
+// secret resolves s, recording why at path if it cannot be.
+func (p *problems) secret(path string, s Secret) string {
+	value, err := s.resolve()
+	if err != nil {
+		p.add(path, "%s", err)
+	}
+
+	return value
+}
+
+func (p problems) err() error {
+	if len(p) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("invalid config:\n  %s", strings.Join(p, "\n  "))
+}
+
+// overrides reads settings from environment variables, recording those
+// that do not parse.
+type overrides struct {
+	p *problems
+}
+
+func (o overrides) string(name string, to *string) {
+	if value := os.Getenv(name); value != "" {
+		*to = value
+	}
+}
+
+func (o overrides) list(name string, to *[]string) {
+	if value := os.Getenv(name); value != "" {
+		*to = strings.Split(value, ",")
+	}
+}
+
+func (o overrides) int(name string, to *int) {
+	value := os.Getenv(name)
+	if value == "" {
+		return
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		o.p.add(name, "%q is not a number", value)
+		return
+	}
+	*to = n
+}
+
+func (o overrides) duration(name string, to *Duration) {
+	value := os.Getenv(name)
+	if value == "" {
+		return
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		o.p.add(name, "%q is not a duration", value)
+		return
+	}
+	*to = Duration(d)
+}
+
+// secret reads a secret from the variable name, or from the file named in
+// the variable with a _FILE suffix.
+func (o overrides) secret(name string, to *Secret) {
+	if value := os.Getenv(name); value != "" {
+		*to = Secret{Value: value}
+	}
+	if file := os.Getenv(name + "_FILE"); file != "" {
+		*to = Secret{File: file}
+	}
+}
@@ -0,0 +1,72 @@
+package config
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/trunners/runners/server/github"
+)
+
+const githubTimeout = 10 * time.Second
+
+// githubPermissions authorizes a key belonging to one of the configured GitHub
+// users. The user may launch the targets whose repository they can write to.
+func (c *Config) githubPermissions(ctx context.Context, key ssh.PublicKey) (*ssh.Permissions, error) {
+	ctx, cancel := context.WithTimeout(ctx, githubTimeout)
+	defer cancel()
+
+	login, err := c.GithubUsers.Login(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.writerPermissions(ctx, c.GithubUsers, key, login)
+}
+
+// enrolledPermissions authorizes a key enrolled for login like the keys of
+// the configured GitHub users.
+func (c *Config) enrolledPermissions(ctx context.Context, key ssh.PublicKey, login string) (*ssh.Permissions, error) {
+	ctx, cancel := context.WithTimeout(ctx, githubTimeout)
+	defer cancel()
+
+	return c.writerPermissions(ctx, c.Enrollment.users, key, login)
+}
+
+// writerPermissions authorizes the key of a GitHub user for the targets
+// whose repository they can write to.
+func (c *Config) writerPermissions(
+	ctx context.Context,
+	users *github.Users,
+	key ssh.PublicKey,
+	login string,
+) (*ssh.Permissions, error) {
+	groups := c.groups(login)
+
+	var targets []string
+	for _, name := range c.Targets(login, groups) {
+		w := c.Workflows[name]
+
+		ok, err := users.CanWrite(ctx, login, w.Owner, w.Repository)
+		if err != nil {
+			return nil, err
+		}
+
+		if ok {
+			targets = append(targets, name)
+		}
+	}
+
+	criticalOptions, extensions := Options{}.Permissions()
+	extensions[ExtensionUser] = login
+	extensions[ExtensionFingerprint] = ssh.FingerprintSHA256(key)
+	extensions[ExtensionTargets] = strings.Join(targets, ",")
+	extensions[ExtensionGroups] = strings.Join(groups, ",")
+
+	return &ssh.Permissions{
+		CriticalOptions: criticalOptions,
+		Extensions:      extensions,
+	}, nil
+}
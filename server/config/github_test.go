@@ -0,0 +1,131 @@
+package config
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/trunners/runners/server/github"
+)
+
+// fakeGithub serves the members of org/team, their keys and their
+// permissions on owner/writable and owner/readable.
+func fakeGithub(t *testing.T, keys map[string]ssh.PublicKey) github.Github {
+	t.Helper()
+
+	reply := func(w http.ResponseWriter, v any) {
+		err := json.NewEncoder(w).Encode(v)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /orgs/org/teams/team/members", func(w http.ResponseWriter, _ *http.Request) {
+		var members []map[string]string
+		for login := range keys {
+			members = append(members, map[string]string{"login": login})
+		}
+		reply(w, members)
+	})
+	mux.HandleFunc("GET /users/{login}/keys", func(w http.ResponseWriter, r *http.Request) {
+		key, ok := keys[r.PathValue("login")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		reply(w, []map[string]any{{"id": 1, "key": string(ssh.MarshalAuthorizedKey(key))}})
+	})
+	mux.HandleFunc("GET /repos/owner/{repo}/collaborators/{login}/permission", func(w http.ResponseWriter, r *http.Request) {
+		permission := "read"
+		if r.PathValue("repo") == "writable" {
+			permission = "write"
+		}
+		reply(w, map[string]string{"permission": permission})
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	g, err := github.New("token", server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return g
+}
+
+func newKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ssh.NewPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func TestGithubPermissions(t *testing.T) {
+	alice := newKey(t)
+	g := fakeGithub(t, map[string]ssh.PublicKey{"alice": alice})
+
+	cfg := &Config{
+		GithubUsers: g.Users(nil, "org", "team", time.Minute),
+		Workflows: map[string]Workflow{
+			"writable": {Owner: "owner", Repository: "writable"},
+			"readable": {Owner: "owner", Repository: "readable"},
+		},
+	}
+
+	perms, err := cfg.githubPermissions(context.Background(), alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if user := perms.Extensions[ExtensionUser]; user != "alice" {
+		t.Errorf("got user %q, want alice", user)
+	}
+	if targets := perms.Extensions[ExtensionTargets]; targets != "writable" {
+		t.Errorf("got targets %q, want writable", targets)
+	}
+
+	_, err = cfg.githubPermissions(context.Background(), newKey(t))
+	if err == nil {
+		t.Error("authorized a key of no member")
+	}
+}
+
+func TestEnrolledPermissions(t *testing.T) {
+	alice := newKey(t)
+	g := fakeGithub(t, map[string]ssh.PublicKey{"alice": alice})
+
+	cfg := &Config{
+		Enrollment: &Enrollment{users: g.Users(nil, "", "", time.Minute)},
+		Workflows: map[string]Workflow{
+			"writable": {Owner: "owner", Repository: "writable"},
+			"readable": {Owner: "owner", Repository: "readable"},
+		},
+	}
+
+	perms, err := cfg.enrolledPermissions(context.Background(), alice, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if targets := perms.Extensions[ExtensionTargets]; targets != "writable" {
+		t.Errorf("got targets %q, want writable", targets)
+	}
+}
@@ -0,0 +1,176 @@
+package config
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const rsaBits = 3072
+
+// hostKeyAlgorithms are the algorithms of the keys generated in a host keys directory.
+var hostKeyAlgorithms = []string{"ed25519", "ecdsa", "rsa"}
+
+// HostKey is a host key of the broker with its host certificate, if any.
+// Keys that are not served are only announced to clients so that they learn
+// them before the keys are rotated in.
+type HostKey struct {
+	Signer      ssh.Signer
+	Certificate *ssh.Certificate
+	Serve       bool
+}
+
+// loadHostKeys reads the listed host key files or, without any, the keys of
+// a host keys directory. Missing files are generated. The directory holds one
+// ssh_host_<algorithm>_key file for each of ed25519, ecdsa and rsa; other
+// ssh_host_*_key files in it are announced only. Of the listed files, the
+// first key of each algorithm is served and the others are announced only.
+func loadHostKeys(files []string, dir string) ([]HostKey, error) {
+	var announce []string
+	if len(files) == 0 {
+		var err error
+		files, announce, err = hostKeyDir(dir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var hostKeys []HostKey
+	for _, file := range slices.Concat(files, announce) {
+		hostKey, err := loadHostKey(file)
+		if err != nil {
+			return nil, fmt.Errorf("host key %s: %w", file, err)
+		}
+
+		hostKey.Serve = !slices.Contains(announce, file) && !slices.ContainsFunc(hostKeys, func(k HostKey) bool {
+			return k.Serve && k.Signer.PublicKey().Type() == hostKey.Signer.PublicKey().Type()
+		})
+		hostKeys = append(hostKeys, hostKey)
+	}
+
+	return hostKeys, nil
+}
+
+// hostKeyDir returns the keys of a host keys directory, creating it if needed.
+func hostKeyDir(dir string) ([]string, []string, error) {
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var served []string
+	for _, algorithm := range hostKeyAlgorithms {
+		served = append(served, filepath.Join(dir, "ssh_host_"+algorithm+"_key"))
+	}
+
+	matches, err := filepath.Glob(filepath.Join(dir, "ssh_host_*_key"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var other []string
+	for _, match := range matches {
+		if !slices.Contains(served, match) {
+			other = append(other, match)
+		}
+	}
+
+	return served, other, nil
+}
+
+// loadHostKey reads a private key and the certificate next to it, generating
+// the key if the file does not exist yet.
+func loadHostKey(location string) (HostKey, error) {
+	file, err := os.ReadFile(location)
+	if errors.Is(err, os.ErrNotExist) {
+		file, err = generateHostKey(location)
+	}
+	if err != nil {
+		return HostKey{}, err
+	}
+
+	signer, err := ssh.ParsePrivateKey(file)
+	if err != nil {
+		return HostKey{}, err
+	}
+	hostKey := HostKey{Signer: signer}
+
+	file, err = os.ReadFile(location + "-cert.pub")
+	if errors.Is(err, os.ErrNotExist) {
+		return hostKey, nil
+	}
+	if err != nil {
+		return HostKey{}, err
+	}
+
+	key, _, _, _, err := ssh.ParseAuthorizedKey(file)
+	if err != nil {
+		return HostKey{}, err
+	}
+
+	cert, ok := key.(*ssh.Certificate)
+	if !ok || cert.CertType != ssh.HostCert {
+		return HostKey{}, errors.New("not a host certificate")
+	}
+	if !keysEqual(cert.Key, signer.PublicKey()) {
+		return HostKey{}, errors.New("certificate is for another key")
+	}
+	hostKey.Certificate = cert
+
+	return hostKey, nil
+}
+
+// generateHostKey creates a key of the algorithm named in the file name,
+// ed25519 by default, and writes it with its public key.
+func generateHostKey(location string) ([]byte, error) {
+	var key crypto.Signer
+	var err error
+
+	name := filepath.Base(location)
+	switch {
+	case strings.Contains(name, "rsa"):
+		key, err = rsa.GenerateKey(rand.Reader, rsaBits)
+	case strings.Contains(name, "ecdsa"):
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	default:
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := ssh.MarshalPrivateKey(key, name)
+	if err != nil {
+		return nil, err
+	}
+
+	publicKey, err := ssh.NewPublicKey(key.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	file := pem.EncodeToMemory(block)
+	err = os.WriteFile(location, file, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.WriteFile(location+".pub", ssh.MarshalAuthorizedKey(publicKey), 0o644) //nolint:gosec // public key
+	if err != nil {
+		return nil, err
+	}
+
+	return file, nil
+}
@@ -0,0 +1,58 @@
+package config
+
+// Limits restrict the use of runners by a user, or by all members of a group
+// together. Budgets are runner time weighted by the targets' weights. Zero
+// values are unlimited.
+type Limits struct {
+	Sessions int      `json:"sessions"`
+	Duration Duration `json:"duration"`
+	Daily    Duration `json:"daily"`
+	Monthly  Duration `json:"monthly"`
+}
+
+// UserLimits returns the limits of a user, falling back to the default limits
+// of the access policy and then to those of the config file for those the
+// user has no own value for.
+func (c *Config) UserLimits(user string) Limits {
+	if c.Access == nil {
+		return c.Limits
+	}
+
+	return c.Access.Users[user].Limits.or(c.Access.Limits).or(c.Limits)
+}
+
+// or returns the limits with the defaults for the values that are not set.
+func (l Limits) or(defaults Limits) Limits {
+	if l.Sessions == 0 {
+		l.Sessions = defaults.Sessions
+	}
+	if l.Duration == 0 {
+		l.Duration = defaults.Duration
+	}
+	if l.Daily == 0 {
+		l.Daily = defaults.Daily
+	}
+	if l.Monthly == 0 {
+		l.Monthly = defaults.Monthly
+	}
+
+	return l
+}
+
+// GroupLimits returns the limits shared by the members of a group.
+func (c *Config) GroupLimits(group string) Limits {
+	if c.Access == nil {
+		return Limits{}
+	}
+
+	return c.Access.Groups[group].Limits
+}
+
+// Weight returns how much an hour on the target's runners counts against budgets.
+func (w Workflow) Weight() float64 {
+	if w.RunnerWeight <= 0 {
+		return 1
+	}
+
+	return w.RunnerWeight
+}
@@ -0,0 +1,86 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/netip"
+	"os"
+	"time"
+
+	"github.com/trunners/runners/logger"
+	"github.com/trunners/runners/server/github"
+)
+
+// Network lists the addresses SSH clients may connect from and runners may
+// call back from. Denied addresses are refused even if they are allowed.
+type Network struct {
+	SSHAllow    []netip.Prefix
+	SSHDeny     []netip.Prefix
+	RunnerAllow []netip.Prefix
+	RunnerDeny  []netip.Prefix
+}
+
+// loadNetwork parses the allow and deny lists, which were validated already.
+// Runners are also allowed from GitHub's Actions ranges if a copy of the
+// /meta response is kept at metaFile, which is fetched if it does not exist
+// yet.
+func loadNetwork(ctx context.Context, gh github.Github, lists NetworkFile, metaFile string, p *problems) Network {
+	network := Network{}
+	network.SSHAllow, _ = parsePrefixes(lists.SSHAllow)
+	network.SSHDeny, _ = parsePrefixes(lists.SSHDeny)
+	network.RunnerAllow, _ = parsePrefixes(lists.RunnerAllow)
+	network.RunnerDeny, _ = parsePrefixes(lists.RunnerDeny)
+
+	if metaFile != "" {
+		actions, err := loadActionsRanges(ctx, gh, metaFile)
+		if err != nil {
+			p.add("github.meta", "%s: %s", metaFile, err)
+		}
+		network.RunnerAllow = append(network.RunnerAllow, actions...)
+	}
+
+	return network
+}
+
+// loadActionsRanges returns the ranges of GitHub-hosted runners from a cached
+// /meta response, fetching it first if it is missing.
+func loadActionsRanges(ctx context.Context, gh github.Github, location string) ([]netip.Prefix, error) {
+	file, err := os.ReadFile(location)
+	if errors.Is(err, os.ErrNotExist) {
+		logger.FromContext(ctx).InfoContext(ctx, "Fetching GitHub meta", "file", location)
+
+		file, err = gh.Meta(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		err = os.WriteFile(location, file, 0o644) //nolint:gosec // public information
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var meta struct {
+		Actions []string `json:"actions"`
+	}
+	err = json.Unmarshal(file, &meta)
+	if err != nil {
+		return nil, err
+	}
+	if len(meta.Actions) == 0 {
+		return nil, errors.New("no actions ranges")
+	}
+
+	return parsePrefixes(meta.Actions)
+}
+
+// Throttle configures the backoff of addresses failing to authenticate or
+// complete handshakes, which is off if Backoff is zero. BanAfter failures
+// ban an address for Ban, never if it is zero.
+type Throttle struct {
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	BanAfter   int
+	Ban        time.Duration
+}
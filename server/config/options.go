@@ -0,0 +1,333 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Permissions understood by the server, named as in OpenSSH certificates so
+// that key options and certificates are enforced the same way.
+const (
+	OptionForceCommand    = "force-command"
+	ExtensionPTY          = "permit-pty"
+	ExtensionPortForward  = "permit-port-forwarding"
+	ExtensionAgentForward = "permit-agent-forwarding"
+	ExtensionX11Forward   = "permit-X11-forwarding"
+	ExtensionUserRC       = "permit-user-rc"
+	ExtensionPermitOpen   = "permitopen@runners"
+)
+
+// Extensions carrying restrictions of the key authenticated with that are not
+// permissions of the session, for certificates issued on its basis to keep.
+const (
+	ExtensionSourceAddress = "source-address@runners"
+	ExtensionExpiry        = "expiry@runners"
+)
+
+// Options are the options of an authorized key as described in the
+// AUTHORIZED_KEYS FILE FORMAT section of sshd(8).
+type Options struct {
+	From         []string
+	Command      string
+	Expiry       time.Time
+	PermitOpen   []string
+	NoPTY        bool
+	NoPortFwd    bool
+	NoAgentFwd   bool
+	NoX11Fwd     bool
+	NoUserRC     bool
+	Unrecognized []string
+}
+
+// parseOptions parses the options returned by ssh.ParseAuthorizedKey.
+func parseOptions(options []string) (Options, error) {
+	var o Options
+
+	for _, option := range options {
+		name, value, hasValue := strings.Cut(option, "=")
+		name = strings.ToLower(name)
+		value = unquote(value)
+
+		if !hasValue && slices.Contains([]string{"from", "command", "permitopen", "expiry-time"}, name) {
+			return o, fmt.Errorf("option %q requires a value", name)
+		}
+
+		switch name {
+		case "restrict":
+			o.NoPTY, o.NoPortFwd, o.NoAgentFwd, o.NoX11Fwd, o.NoUserRC = true, true, true, true, true
+		case "no-pty":
+			o.NoPTY = true
+		case "pty":
+			o.NoPTY = false
+		case "no-port-forwarding":
+			o.NoPortFwd = true
+		case "port-forwarding":
+			o.NoPortFwd = false
+		case "no-agent-forwarding":
+			o.NoAgentFwd = true
+		case "agent-forwarding":
+			o.NoAgentFwd = false
+		case "no-x11-forwarding":
+			o.NoX11Fwd = true
+		case "x11-forwarding":
+			o.NoX11Fwd = false
+		case "no-user-rc":
+			o.NoUserRC = true
+		case "user-rc":
+			o.NoUserRC = false
+		case "from":
+			o.From = append(o.From, strings.Split(value, ",")...)
+		case "command":
+			o.Command = value
+		case "permitopen":
+			o.PermitOpen = append(o.PermitOpen, strings.Split(value, ",")...)
+		case "expiry-time":
+			expiry, err := parseExpiry(value)
+			if err != nil {
+				return o, err
+			}
+			o.Expiry = expiry
+		default:
+			o.Unrecognized = append(o.Unrecognized, name)
+		}
+	}
+
+	return o, nil
+}
+
+// Check verifies the options that apply at authentication time.
+func (o Options) Check(remote net.Addr, now time.Time) error {
+	if !o.Expiry.IsZero() && now.After(o.Expiry) {
+		return fmt.Errorf("key expired at %s", o.Expiry)
+	}
+
+	if len(o.From) > 0 && !matchFrom(o.From, remote) {
+		return fmt.Errorf("connections from %s are not permitted", remote)
+	}
+
+	return nil
+}
+
+// Permissions returns the options as critical options and extensions,
+// the way an OpenSSH certificate would carry them.
+func (o Options) Permissions() (map[string]string, map[string]string) {
+	criticalOptions := map[string]string{}
+	if o.Command != "" {
+		criticalOptions[OptionForceCommand] = o.Command
+	}
+
+	extensions := map[string]string{}
+	permit := func(extension string, denied bool) {
+		if !denied {
+			extensions[extension] = ""
+		}
+	}
+	permit(ExtensionPTY, o.NoPTY)
+	permit(ExtensionPortForward, o.NoPortFwd)
+	permit(ExtensionAgentForward, o.NoAgentFwd)
+	permit(ExtensionX11Forward, o.NoX11Fwd)
+	permit(ExtensionUserRC, o.NoUserRC)
+	if len(o.PermitOpen) > 0 {
+		extensions[ExtensionPermitOpen] = strings.Join(o.PermitOpen, ",")
+	}
+	if !o.Expiry.IsZero() {
+		extensions[ExtensionExpiry] = strconv.FormatInt(o.Expiry.Unix(), 10)
+	}
+
+	return criticalOptions, extensions
+}
+
+// SourceAddress returns the from= patterns as the list of addresses and CIDR
+// blocks of a source-address certificate option, or "" without patterns.
+// Wildcards, negations and host names cannot be listed, so with any of them
+// it is just the remote address the key was used from.
+func (o Options) SourceAddress(remote net.Addr) (string, error) {
+	if len(o.From) == 0 {
+		return "", nil
+	}
+
+	list := make([]string, 0, len(o.From))
+	for _, pattern := range o.From {
+		if prefix, err := netip.ParsePrefix(pattern); err == nil {
+			list = append(list, prefix.Masked().String())
+			continue
+		}
+		if addr, err := netip.ParseAddr(pattern); err == nil {
+			list = append(list, addr.Unmap().String())
+			continue
+		}
+
+		addr, err := remoteAddr(remote)
+		if err != nil {
+			return "", err
+		}
+		return addr.String(), nil
+	}
+
+	return strings.Join(list, ","), nil
+}
+
+// Permitted reports whether perms carry the permit extension.
+func Permitted(perms *ssh.Permissions, extension string) bool {
+	if perms == nil {
+		return false
+	}
+
+	_, ok := perms.Extensions[extension]
+	return ok
+}
+
+// ForceCommand returns the command forced on every session, if any.
+func ForceCommand(perms *ssh.Permissions) string {
+	if perms == nil {
+		return ""
+	}
+
+	return perms.CriticalOptions[OptionForceCommand]
+}
+
+// PermitOpen reports whether perms allow forwarding to host and port.
+func PermitOpen(perms *ssh.Permissions, host string, port uint32) bool {
+	if !Permitted(perms, ExtensionPortForward) {
+		return false
+	}
+
+	list, ok := perms.Extensions[ExtensionPermitOpen]
+	if !ok {
+		return true
+	}
+
+	for entry := range strings.SplitSeq(list, ",") {
+		h, p, err := net.SplitHostPort(entry)
+		if err != nil {
+			continue
+		}
+
+		if (h == Wildcard || strings.EqualFold(h, host)) && (p == Wildcard || p == strconv.FormatUint(uint64(port), 10)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CertificateOptions returns the critical options and extensions of perms that
+// a certificate issued on their basis must carry to keep the same restrictions.
+func CertificateOptions(perms *ssh.Permissions) (map[string]string, map[string]string) {
+	criticalOptions := map[string]string{}
+	if command := ForceCommand(perms); command != "" {
+		criticalOptions[OptionForceCommand] = command
+	}
+	if source := perms.CriticalOptions[sourceAddressOption]; source != "" {
+		criticalOptions[sourceAddressOption] = source
+	} else if source := perms.Extensions[ExtensionSourceAddress]; source != "" {
+		criticalOptions[sourceAddressOption] = source
+	}
+
+	extensions := map[string]string{}
+	for _, extension := range []string{
+		ExtensionPTY,
+		ExtensionPortForward,
+		ExtensionAgentForward,
+		ExtensionX11Forward,
+		ExtensionUserRC,
+		ExtensionPermitOpen,
+	} {
+		if value, ok := perms.Extensions[extension]; ok {
+			extensions[extension] = value
+		}
+	}
+
+	return criticalOptions, extensions
+}
+
+// Expiry returns when the key or certificate perms were granted for expires,
+// or the zero time if it does not.
+func Expiry(perms *ssh.Permissions) time.Time {
+	expiry, err := strconv.ParseInt(perms.Extensions[ExtensionExpiry], 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return time.Unix(expiry, 0)
+}
+
+// matchFrom matches the remote address against a from= pattern list. Negated
+// patterns take precedence. Host names are not resolved, so patterns only
+// match addresses, either with wildcards or in CIDR notation.
+func matchFrom(patterns []string, remote net.Addr) bool {
+	addr, err := remoteAddr(remote)
+	if err != nil {
+		return false
+	}
+
+	matched := false
+	for _, pattern := range patterns {
+		pattern, negated := strings.CutPrefix(pattern, "!")
+
+		var ok bool
+		if prefix, err := netip.ParsePrefix(pattern); err == nil {
+			ok = prefix.Contains(addr)
+		} else {
+			ok, _ = path.Match(pattern, addr.String())
+		}
+
+		switch {
+		case ok && negated:
+			return false
+		case ok:
+			matched = true
+		}
+	}
+
+	return matched
+}
+
+// parseExpiry parses YYYYMMDD[HHMM[SS]] in local time, or UTC with a Z suffix.
+func parseExpiry(value string) (time.Time, error) {
+	location := time.Local
+	if v, ok := strings.CutSuffix(value, "Z"); ok {
+		value = v
+		location = time.UTC
+	}
+
+	for _, layout := range []string{"20060102", "200601021504", "20060102150405"} {
+		if len(value) == len(layout) {
+			return time.ParseInLocation(layout, value, location)
+		}
+	}
+
+	return time.Time{}, errors.New("invalid expiry-time: " + value)
+}
+
+func unquote(value string) string {
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		value = value[1 : len(value)-1]
+	}
+
+	return strings.ReplaceAll(value, `\"`, `"`)
+}
+
+// remoteAddr returns the IP address of remote, IPv4 addresses unmapped.
+func remoteAddr(remote net.Addr) (netip.Addr, error) {
+	host, _, err := net.SplitHostPort(remote.String())
+	if err != nil {
+		host = remote.String()
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	return addr.Unmap(), nil
+}
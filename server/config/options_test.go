@@ -0,0 +1,175 @@
+package config
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestParseOptions(t *testing.T) {
+	key := string(ssh.MarshalAuthorizedKey(newKey(t)))
+
+	tests := []struct {
+		name    string
+		options string
+		want    Options
+		err     string
+	}{
+		{name: "none"},
+		{
+			name:    "restrict",
+			options: "restrict",
+			want:    Options{NoPTY: true, NoPortFwd: true, NoAgentFwd: true, NoX11Fwd: true, NoUserRC: true},
+		},
+		{
+			name:    "restrict with exceptions",
+			options: "restrict,pty,port-forwarding",
+			want:    Options{NoAgentFwd: true, NoX11Fwd: true, NoUserRC: true},
+		},
+		{
+			name:    "case insensitive",
+			options: "No-PTY,NO-X11-FORWARDING",
+			want:    Options{NoPTY: true, NoX11Fwd: true},
+		},
+		{
+			name:    "quoted command",
+			options: `command="echo \"hi, there\""`,
+			want:    Options{Command: `echo "hi, there"`},
+		},
+		{
+			name:    "lists",
+			options: `from="192.0.2.0/24,!192.0.2.1",permitopen="localhost:8080",permitopen="*:22"`,
+			want: Options{
+				From:       []string{"192.0.2.0/24", "!192.0.2.1"},
+				PermitOpen: []string{"localhost:8080", "*:22"},
+			},
+		},
+		{
+			name:    "expiry in UTC",
+			options: `expiry-time="202601021504Z"`,
+			want:    Options{Expiry: time.Date(2026, 1, 2, 15, 4, 0, 0, time.UTC)},
+		},
+		{
+			name:    "unrecognized",
+			options: `no-touch-required,environment="A=B"`,
+			want:    Options{Unrecognized: []string{"no-touch-required", "environment"}},
+		},
+		{name: "missing value", options: "command", err: `option "command" requires a value`},
+		{name: "invalid expiry", options: `expiry-time="2026"`, err: "invalid expiry-time: 2026"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			line := key
+			if test.options != "" {
+				line = test.options + " " + key
+			}
+
+			_, _, options, _, err := ssh.ParseAuthorizedKey([]byte(line))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := parseOptions(options)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("got error %v, want %s", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCheckOptions(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	remote := &net.TCPAddr{IP: net.ParseIP("192.0.2.7"), Port: 56324}
+
+	tests := []struct {
+		name    string
+		options Options
+		err     string
+	}{
+		{name: "none"},
+		{name: "not expired", options: Options{Expiry: now.Add(time.Hour)}},
+		{name: "expired", options: Options{Expiry: now.Add(-time.Hour)}, err: "key expired"},
+		{name: "from block", options: Options{From: []string{"192.0.2.0/24"}}},
+		{name: "from wildcard", options: Options{From: []string{"192.0.2.*"}}},
+		{name: "from elsewhere", options: Options{From: []string{"198.51.100.0/24"}}, err: "not permitted"},
+		{name: "negated", options: Options{From: []string{"192.0.2.0/24", "!192.0.2.7"}}, err: "not permitted"},
+		{name: "negated first", options: Options{From: []string{"!192.0.2.?", "*"}}, err: "not permitted"},
+		{name: "host name", options: Options{From: []string{"*.example.com"}}, err: "not permitted"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.options.Check(remote, now)
+			switch {
+			case test.err == "" && err != nil:
+				t.Errorf("got error %v, want none", err)
+			case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+				t.Errorf("got error %v, want one containing %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestPermitOpen(t *testing.T) {
+	tests := []struct {
+		name       string
+		extensions map[string]string
+		host       string
+		port       uint32
+		want       bool
+	}{
+		{name: "no forwarding", extensions: map[string]string{}, host: "localhost", port: 22},
+		{name: "any", extensions: map[string]string{ExtensionPortForward: ""}, host: "localhost", port: 22, want: true},
+		{
+			name:       "listed",
+			extensions: map[string]string{ExtensionPortForward: "", ExtensionPermitOpen: "LocalHost:8080,db:*"},
+			host:       "localhost",
+			port:       8080,
+			want:       true,
+		},
+		{
+			name:       "other port",
+			extensions: map[string]string{ExtensionPortForward: "", ExtensionPermitOpen: "localhost:8080"},
+			host:       "localhost",
+			port:       22,
+		},
+		{
+			name:       "any port",
+			extensions: map[string]string{ExtensionPortForward: "", ExtensionPermitOpen: "localhost:8080,db:*"},
+			host:       "db",
+			port:       5432,
+			want:       true,
+		},
+		{
+			name:       "any host",
+			extensions: map[string]string{ExtensionPortForward: "", ExtensionPermitOpen: "*:443"},
+			host:       "example.com",
+			port:       443,
+			want:       true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			perms := &ssh.Permissions{Extensions: test.extensions}
+			if got := PermitOpen(perms, test.host, test.port); got != test.want {
+				t.Errorf("got %t, want %t", got, test.want)
+			}
+		})
+	}
+}
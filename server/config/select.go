@@ -0,0 +1,192 @@
+package config
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"math"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Preferences of Selection.
+const (
+	PreferCost = "cost"
+	PreferWait = "wait"
+)
+
+// Operators of requirements. OpenSSH does not allow "<" and ">" in usernames,
+// which is why "min-memory=14GB" may be written for "memory>=14GB".
+const (
+	OpEqual = "="
+	OpMin   = ">="
+	OpMax   = "<="
+)
+
+var quantity = regexp.MustCompile(`^(?i)([0-9]+(?:\.[0-9]+)?)([kmgtp]?)(i?b)?$`)
+
+// Requirement is a capability a user asks for instead of naming a target.
+// Without a tag the value may be that of any tag, as in "linux/arm64".
+type Requirement struct {
+	Tag   string
+	Op    string
+	Value string
+}
+
+func (r Requirement) String() string {
+	if r.Tag == "" {
+		return r.Value
+	}
+
+	return r.Tag + r.Op + r.Value
+}
+
+// ParseRequirements parses the capabilities asked for in an SSH username,
+// separated by "+": a value of any tag, values separated by "/", or a tag
+// compared to a value with "=", ">=" or "<=". Quantities like "14GB" compare
+// by size.
+func ParseRequirements(login string) ([]Requirement, error) {
+	var reqs []Requirement
+	for term := range strings.SplitSeq(login, "+") {
+		tag, value, op := "", term, ""
+		for _, o := range []string{OpMin, OpMax, OpEqual} {
+			if before, after, ok := strings.Cut(term, o); ok {
+				tag, value, op = before, after, o
+				break
+			}
+		}
+
+		switch {
+		case op == "":
+			for value := range strings.SplitSeq(term, "/") {
+				if !paramValue.MatchString(value) {
+					return nil, fmt.Errorf("invalid capability %q", term)
+				}
+				reqs = append(reqs, Requirement{Op: OpEqual, Value: value})
+			}
+			continue
+		case op == OpEqual && strings.HasPrefix(tag, "min-"):
+			tag, op = strings.TrimPrefix(tag, "min-"), OpMin
+		case op == OpEqual && strings.HasPrefix(tag, "max-"):
+			tag, op = strings.TrimPrefix(tag, "max-"), OpMax
+		}
+
+		if !paramName.MatchString(tag) || !paramValue.MatchString(value) {
+			return nil, fmt.Errorf("invalid capability %q", term)
+		}
+		if op != OpEqual && !quantity.MatchString(value) {
+			return nil, fmt.Errorf("capability %q compares with %q, which is not a quantity", term, value)
+		}
+		reqs = append(reqs, Requirement{Tag: tag, Op: op, Value: value})
+	}
+
+	return reqs, nil
+}
+
+// Match returns the names of the targets whose tags satisfy all
+// requirements, the cheapest first.
+func (c *Config) Match(reqs []Requirement) []string {
+	var names []string
+	for _, name := range slices.Sorted(maps.Keys(c.Workflows)) {
+		w := c.Workflows[name]
+		if len(w.Tags) > 0 && !slices.ContainsFunc(reqs, func(r Requirement) bool { return !r.matches(w.Tags) }) {
+			names = append(names, name)
+		}
+	}
+
+	slices.SortStableFunc(names, func(a, b string) int {
+		return cmp.Compare(c.Workflows[a].Cost, c.Workflows[b].Cost)
+	})
+	return names
+}
+
+// matches reports whether the tags satisfy the requirement.
+func (r Requirement) matches(tags map[string]string) bool {
+	if r.Tag == "" {
+		for _, value := range tags {
+			if strings.EqualFold(value, r.Value) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	value, ok := tags[r.Tag]
+	if !ok {
+		return false
+	}
+
+	c, ok := compare(value, r.Value)
+	switch r.Op {
+	case OpMin:
+		return ok && c >= 0
+	case OpMax:
+		return ok && c <= 0
+	default:
+		return ok && c == 0 || strings.EqualFold(value, r.Value)
+	}
+}
+
+// compare compares two quantities. Their units count only if both have one,
+// so that "16GB" is at least "14".
+func compare(a, b string) (int, bool) {
+	x, xUnit, ok := parseQuantity(a)
+	if !ok {
+		return 0, false
+	}
+	y, yUnit, ok := parseQuantity(b)
+	if !ok {
+		return 0, false
+	}
+
+	if xUnit > 0 && yUnit > 0 {
+		x *= xUnit
+		y *= yUnit
+	}
+
+	return cmp.Compare(x, y), true
+}
+
+// parseQuantity parses a number with an optional unit like "GB", returning
+// the size of the unit in bytes or zero without one.
+func parseQuantity(s string) (float64, float64, bool) {
+	m := quantity.FindStringSubmatch(s)
+	if m == nil {
+		return 0, 0, false
+	}
+
+	n, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	if m[2] == "" && m[3] == "" {
+		return n, 0, true
+	}
+
+	exponent := 0
+	if m[2] != "" {
+		exponent = strings.Index("kmgtp", strings.ToLower(m[2])) + 1
+	}
+
+	return n, math.Pow(1024, float64(exponent)), true //nolint:mnd // binary units
+}
+
+// validateTags records problems with the tags and cost of the target at path.
+func (w Workflow) validateTags(p *problems, path string) {
+	for _, tag := range slices.Sorted(maps.Keys(w.Tags)) {
+		if !paramName.MatchString(tag) {
+			p.add(path+".tags."+tag, "name must be lowercase letters, digits, '-' and '_'")
+		}
+		if !paramValue.MatchString(w.Tags[tag]) {
+			p.add(path+".tags."+tag, "invalid value %q", w.Tags[tag])
+		}
+	}
+
+	if w.Cost < 0 {
+		p.add(path+".cost", "must not be negative")
+	}
+}
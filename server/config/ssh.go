@@ -1,31 +1,142 @@
 package config
 
 import (
+	"context"
 	"crypto/subtle"
+	"errors"
 	"fmt"
+	"strings"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 
 	"github.com/trunners/runners/keys"
+	"github.com/trunners/runners/logger"
+	"github.com/trunners/runners/server/github"
 )
 
-func serverConfig(authorizedKeys []ssh.PublicKey) *ssh.ServerConfig {
+// Permission extensions recording who authenticated and what they may launch.
+const (
+	ExtensionUser        = "user@runners"
+	ExtensionFingerprint = "fingerprint@runners"
+	ExtensionTargets     = "targets@runners"
+	ExtensionGroups      = "groups@runners"
+	// ExtensionCertificate holds the serial of the certificate authenticated with.
+	ExtensionCertificate = "certificate@runners"
+)
+
+func serverConfig(ctx context.Context, cfg *Config) *ssh.ServerConfig {
 	config := &ssh.ServerConfig{
 		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
-			for _, k := range authorizedKeys {
-				if keysEqual(k, key) {
-					return &ssh.Permissions{}, nil
+			if cert, ok := key.(*ssh.Certificate); ok {
+				return cfg.certPermissions(cert)
+			}
+
+			for _, k := range cfg.AuthorizedKeys {
+				if keysEqual(k.Key, key) {
+					err := k.Options.Check(c.RemoteAddr(), time.Now())
+					if err != nil {
+						return nil, err
+					}
+
+					user := k.User
+					if user == "" {
+						user = ssh.FingerprintSHA256(key)
+					}
+
+					source, err := k.Options.SourceAddress(c.RemoteAddr())
+					if err != nil {
+						return nil, err
+					}
+
+					perms := cfg.permissions(key, user, k.Groups, k.Options)
+					if source != "" {
+						perms.Extensions[ExtensionSourceAddress] = source
+					}
+					return perms, nil
+				}
+			}
+
+			if cfg.Enrollment != nil {
+				if login, ok := cfg.Enrollment.Login(key); ok {
+					return cfg.enrolledPermissions(ctx, key, login)
+				}
+			}
+
+			if cfg.GithubUsers != nil {
+				perms, err := cfg.githubPermissions(ctx, key)
+				if cfg.Enrollment == nil || !errors.Is(err, github.ErrUnknownKey) {
+					return perms, err
+				}
+			}
+
+			// Unknown keys may be enrolled once the signature proved the client holds them
+			if cfg.Enrollment != nil {
+				return nil, &ssh.PartialSuccessError{
+					Next: ssh.ServerAuthCallbacks{
+						KeyboardInteractiveCallback: func(
+							_ ssh.ConnMetadata,
+							challenge ssh.KeyboardInteractiveChallenge,
+						) (*ssh.Permissions, error) {
+							login, err := cfg.Enrollment.Enroll(ctx, key, challenge)
+							if err != nil {
+								logger.FromContext(ctx).WarnContext(ctx, "Could not enroll key", "error", err)
+								return nil, err
+							}
+
+							return cfg.enrolledPermissions(ctx, key, login)
+						},
+					},
 				}
 			}
 
 			return nil, fmt.Errorf("unknown public key for %q", c.User())
 		},
 	}
-	config.AddHostKey(keys.ServerPrivateKey())
+	for _, hostKey := range cfg.HostKeys {
+		if !hostKey.Serve {
+			continue
+		}
+
+		if hostKey.Certificate == nil {
+			config.AddHostKey(hostKey.Signer)
+			continue
+		}
+
+		signer, err := ssh.NewCertSigner(hostKey.Certificate, hostKey.Signer)
+		if err != nil {
+			logger.FromContext(ctx).ErrorContext(ctx, "Could not use host certificate", "error", err)
+			signer = hostKey.Signer
+		}
+		config.AddHostKey(signer)
+	}
 
 	return config
 }
 
+// permissions authorizes the key of user with the given options.
+func (c *Config) permissions(key ssh.PublicKey, user string, groups []string, options Options) *ssh.Permissions {
+	criticalOptions, extensions := options.Permissions()
+	extensions[ExtensionUser] = user
+	extensions[ExtensionFingerprint] = ssh.FingerprintSHA256(key)
+	extensions[ExtensionTargets] = strings.Join(c.Targets(user, groups), ",")
+	extensions[ExtensionGroups] = strings.Join(groups, ",")
+
+	return &ssh.Permissions{
+		CriticalOptions: criticalOptions,
+		Extensions:      extensions,
+	}
+}
+
+// groups returns the groups of a user in the access policy.
+func (c *Config) groups(user string) []string {
+	if c.Access == nil {
+		return nil
+	}
+
+	return c.Access.Users[user].Groups
+}
+
 func clientConfig() *ssh.ClientConfig {
 	config := &ssh.ClientConfig{
 		User: "trev",
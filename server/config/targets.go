@@ -0,0 +1,274 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Parameters that override the fields of a workflow instead of becoming
+// extra workflow inputs.
+const (
+	ParamRef        = "ref"
+	ParamRunsOn     = "runs-on"
+	ParamRepository = "repo"
+)
+
+// Reserved is the username to pick a target interactively with, which no
+// target or alias may be named.
+const Reserved = "runners"
+
+// EnvPrefix starts the names of the environment variables, sent with SendEnv,
+// that choose parameters: RUNNERS_RUNS_ON sets runs-on.
+const EnvPrefix = "RUNNERS_"
+
+const maxParamLength = 100
+
+var (
+	paramName  = regexp.MustCompile(`^[a-z][a-z0-9_-]*$`)
+	paramValue = regexp.MustCompile(`^[A-Za-z0-9._/-]+$`)
+)
+
+// Param is a parameter of a target that users may choose at login. Its value
+// must match one of the allowed values, which may be patterns as in
+// path.Match, if any are given. Without a default it must be chosen.
+type Param struct {
+	Default string   `json:"default"`
+	Allowed []string `json:"allowed"`
+}
+
+// Target is a workflow with the parameters chosen at login applied.
+type Target struct {
+	Name     string
+	Workflow Workflow
+	// Inputs are the parameters other than ref, runs-on and repo, passed to
+	// the workflow as extra inputs.
+	Inputs map[string]string
+	// Params are all parameters, including the defaults.
+	Params map[string]string
+}
+
+// Resolve splits the SSH username into the target or alias it names and the
+// parameters chosen with it, as in "ubuntu+ref=feature-x+runs-on=arm". An
+// alias resolves to its target, with its parameters preset.
+func (c *Config) Resolve(login string) (string, map[string]string, error) {
+	name, rest, _ := strings.Cut(login, "+")
+
+	params := map[string]string{}
+	if _, ok := c.Workflows[name]; !ok {
+		for target, w := range c.Workflows {
+			if preset, ok := w.Aliases[name]; ok {
+				name = target
+				maps.Copy(params, preset)
+				break
+			}
+		}
+	}
+
+	if rest == "" {
+		return name, params, nil
+	}
+
+	for param := range strings.SplitSeq(rest, "+") {
+		key, value, ok := strings.Cut(param, "=")
+		if !ok || key == "" {
+			return name, nil, fmt.Errorf("parameter %q is not of the form name=value", param)
+		}
+		params[key] = value
+	}
+
+	return name, params, nil
+}
+
+// FromEnv returns the parameters of w set by environment variables, given
+// as the names of the params. Those chosen with the username take
+// precedence over them.
+func (w Workflow) FromEnv(env map[string]string) map[string]string {
+	params := map[string]string{}
+	for name := range w.Params {
+		variable := EnvPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+		if value, ok := env[variable]; ok {
+			params[name] = value
+		}
+	}
+
+	return params
+}
+
+// Target applies the chosen parameters to the workflow of name, filling in
+// the defaults of the others. It fails if a parameter is unknown or its
+// value is not allowed.
+func (w Workflow) Target(name string, chosen map[string]string) (Target, error) {
+	t := Target{
+		Name:     name,
+		Workflow: w,
+		Inputs:   map[string]string{},
+		Params:   map[string]string{},
+	}
+
+	var errs []error
+	for _, param := range slices.Sorted(maps.Keys(chosen)) {
+		if _, ok := w.Params[param]; !ok {
+			errs = append(errs, fmt.Errorf("unknown parameter %q", param))
+		}
+	}
+
+	for _, param := range slices.Sorted(maps.Keys(w.Params)) {
+		value, ok := chosen[param]
+		if !ok {
+			value = w.Params[param].Default
+		}
+		if value == "" {
+			errs = append(errs, fmt.Errorf("parameter %s is required", param))
+			continue
+		}
+
+		err := w.Params[param].check(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("parameter %s: %w", param, err))
+			continue
+		}
+		t.Params[param] = value
+
+		switch param {
+		case ParamRef:
+			t.Workflow.Ref = value
+		case ParamRunsOn:
+			t.Workflow.RunsOn = value
+		case ParamRepository:
+			t.Workflow.Repository = value
+		default:
+			t.Inputs[param] = value
+		}
+	}
+
+	return t, errors.Join(errs...)
+}
+
+// String returns the target name with its parameters, as it would be chosen
+// in the username.
+func (t Target) String() string {
+	var b strings.Builder
+	b.WriteString(t.Name)
+	for _, param := range slices.Sorted(maps.Keys(t.Params)) {
+		fmt.Fprintf(&b, "+%s=%s", param, t.Params[param])
+	}
+
+	return b.String()
+}
+
+// check reports whether value may be chosen for the parameter.
+func (p Param) check(value string) error {
+	if len(value) > maxParamLength || !paramValue.MatchString(value) {
+		return fmt.Errorf("invalid value %q", value)
+	}
+
+	if len(p.Allowed) == 0 {
+		return nil
+	}
+
+	for _, pattern := range p.Allowed {
+		if ok, _ := path.Match(pattern, value); ok {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%q is not one of %s", value, strings.Join(p.Allowed, ", "))
+}
+
+// validateParams records problems with the parameters and aliases of the
+// target at path. The repository and runner labels are what authorization
+// and the choice of machine rest on, so they must be limited to allowed
+// values.
+func (w Workflow) validateParams(p *problems, path string) {
+	for _, name := range slices.Sorted(maps.Keys(w.Params)) {
+		param := w.Params[name]
+		at := path + ".params." + name
+
+		if !paramName.MatchString(name) {
+			p.add(at, "name must be lowercase letters, digits, '-' and '_'")
+		}
+		switch name {
+		case "server", "session":
+			p.add(at, "%s is an input set by the broker", name)
+		case ParamRef, ParamRunsOn, ParamRepository:
+		default:
+			if !slices.Contains(w.Inputs, name) {
+				p.add(at, "not an input the workflow declares, add it to inputs")
+			}
+		}
+		if (name == ParamRepository || name == ParamRunsOn) && len(param.Allowed) == 0 {
+			p.add(at+".allowed", "required for %s", name)
+		}
+		for i, pattern := range param.Allowed {
+			if err := validPattern(pattern); err != nil {
+				p.add(fmt.Sprintf("%s.allowed[%d]", at, i), "%s", err)
+			}
+		}
+		if param.Default != "" {
+			if err := param.check(param.Default); err != nil {
+				p.add(at+".default", "%s", err)
+			}
+		}
+	}
+
+	for _, alias := range slices.Sorted(maps.Keys(w.Aliases)) {
+		at := path + ".aliases." + alias
+		if strings.Contains(alias, "+") {
+			p.add(at, "must not contain '+'")
+		}
+
+		preset := w.Aliases[alias]
+		for _, name := range slices.Sorted(maps.Keys(preset)) {
+			param, ok := w.Params[name]
+			if !ok {
+				p.add(at+"."+name, "unknown parameter")
+				continue
+			}
+			if err := param.check(preset[name]); err != nil {
+				p.add(at+"."+name, "%s", err)
+			}
+		}
+	}
+}
+
+// validateAliases records targets and aliases with reserved names, and
+// aliases that name a target or another alias.
+func validateAliases(p *problems, targets map[string]Workflow) {
+	seen := map[string]string{}
+	for _, name := range slices.Sorted(maps.Keys(targets)) {
+		if strings.Contains(name, "+") {
+			p.add("targets."+name, "name must not contain '+'")
+		}
+		if name == Reserved {
+			p.add("targets."+name, "name is reserved to pick a target")
+		}
+		if strings.HasPrefix(name, "@") {
+			p.add("targets."+name, "name must not start with '@', which names groups in certificates")
+		}
+
+		for _, alias := range slices.Sorted(maps.Keys(targets[name].Aliases)) {
+			at := "targets." + name + ".aliases." + alias
+			if _, ok := targets[alias]; ok {
+				p.add(at, "is also a target")
+			}
+			if alias == Reserved {
+				p.add(at, "name is reserved to pick a target")
+			}
+			if other, ok := seen[alias]; ok {
+				p.add(at, "is also an alias of %s", other)
+			}
+			seen[alias] = name
+		}
+	}
+}
+
+// validPattern checks the syntax of an allowed pattern.
+func validPattern(pattern string) error {
+	_, err := path.Match(pattern, "")
+	return err
+}
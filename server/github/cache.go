@@ -0,0 +1,49 @@
+package github
+
+import (
+	"sync"
+	"time"
+)
+
+type entry[V any] struct {
+	value   V
+	fetched time.Time
+}
+
+// cache keeps API results for a limited time.
+type cache[V any] struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]entry[V]
+}
+
+func newCache[V any](ttl time.Duration) *cache[V] {
+	return &cache[V]{
+		ttl:     ttl,
+		entries: map[string]entry[V]{},
+	}
+}
+
+// get returns the cached value for key, calling fetch if there is none or it has expired.
+// Errors are not cached.
+func (c *cache[V]) get(key string, fetch func() (V, error)) (V, error) {
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	c.mu.Unlock()
+
+	if ok && time.Since(e.fetched) < c.ttl {
+		return e.value, nil
+	}
+
+	value, err := fetch()
+	if err != nil {
+		return value, err
+	}
+
+	c.mu.Lock()
+	c.entries[key] = entry[V]{value: value, fetched: time.Now()}
+	c.mu.Unlock()
+
+	return value, nil
+}
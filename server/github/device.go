@@ -0,0 +1,151 @@
+package github
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DefaultLoginURL is the URL of the GitHub OAuth endpoints.
+const DefaultLoginURL = "https://github.com"
+
+// slowDown is added to the polling interval when GitHub asks to slow down.
+const slowDown = 5 * time.Second
+
+// Device authorizes users with the OAuth device flow of a GitHub app.
+type Device struct {
+	ClientID string
+	URL      string
+	client   *http.Client
+}
+
+// DeviceCode is the code a user enters to authorize a device.
+type DeviceCode struct {
+	DeviceCode      string `json:"device_code"`
+	UserCode        string `json:"user_code"`
+	VerificationURI string `json:"verification_uri"`
+	ExpiresIn       int    `json:"expires_in"`
+	Interval        int    `json:"interval"`
+}
+
+type deviceToken struct {
+	AccessToken string `json:"access_token"`
+	Error       string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+type user struct {
+	Login string `json:"login"`
+}
+
+type membership struct {
+	State string `json:"state"`
+}
+
+func NewDevice(clientID, url string) *Device {
+	if url == "" {
+		url = DefaultLoginURL
+	}
+
+	return &Device{
+		ClientID: clientID,
+		URL:      strings.TrimSuffix(url, "/"),
+		client:   &http.Client{},
+	}
+}
+
+// Code requests a new device and user code for the given scopes.
+func (d *Device) Code(ctx context.Context, scopes ...string) (DeviceCode, error) {
+	var code DeviceCode
+	err := d.post(ctx, "/login/device/code", url.Values{
+		"client_id": {d.ClientID},
+		"scope":     {strings.Join(scopes, " ")},
+	}, &code)
+	return code, err
+}
+
+// Token polls until the user authorized the device code and returns the access token.
+func (d *Device) Token(ctx context.Context, code DeviceCode) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(code.ExpiresIn)*time.Second)
+	defer cancel()
+
+	interval := time.Duration(code.Interval) * time.Second
+	for {
+		select {
+		case <-ctx.Done():
+			return "", errors.New("device code expired")
+		case <-time.After(interval):
+		}
+
+		var token deviceToken
+		err := d.post(ctx, "/login/oauth/access_token", url.Values{
+			"client_id":   {d.ClientID},
+			"device_code": {code.DeviceCode},
+			"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+		}, &token)
+		if err != nil {
+			return "", err
+		}
+
+		switch token.Error {
+		case "":
+			return token.AccessToken, nil
+		case "authorization_pending":
+		case "slow_down":
+			interval += slowDown
+		default:
+			return "", fmt.Errorf("device authorization failed: %s", token.Description)
+		}
+	}
+}
+
+func (d *Device) post(ctx context.Context, path string, values url.Values, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.URL+path, strings.NewReader(values.Encode()))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("POST %s: %s", path, resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// As returns a client for the same API authenticated with another token.
+func (g Github) As(token string) Github {
+	g.Token = token
+	return g
+}
+
+// User returns the login of the user the token belongs to.
+func (g Github) User(ctx context.Context) (string, error) {
+	var u user
+	err := g.get(ctx, "/user", &u)
+	return u.Login, err
+}
+
+// Member reports whether the user the token belongs to is an active member of org.
+func (g Github) Member(ctx context.Context, org string) (bool, error) {
+	var m membership
+	err := g.get(ctx, fmt.Sprintf("/user/memberships/orgs/%s", org), &m)
+	if err != nil {
+		return false, err
+	}
+
+	return m.State == "active", nil
+}
@@ -0,0 +1,90 @@
+package github
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// DefaultURL is the URL of the public GitHub API.
+const DefaultURL = "https://api.github.com"
+
+type Github struct {
+	Token  string
+	URL    string
+	client *http.Client
+}
+
+func New(token, url string) (Github, error) {
+	if token == "" {
+		return Github{}, errors.New("missing GitHub token")
+	}
+
+	if url == "" {
+		url = DefaultURL
+	}
+
+	return Github{
+		Token:  token,
+		URL:    strings.TrimSuffix(url, "/"),
+		client: &http.Client{},
+	}, nil
+}
+
+// request sends an API request, encoding body as JSON if it is not nil.
+func (g Github) request(ctx context.Context, method, path string, body any) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, g.URL+path, reader)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", g.Token))
+	req.Header.Set("X-Github-Api-Version", "2022-11-28")
+
+	return g.client.Do(req)
+}
+
+// get decodes the response of a GET request into v.
+func (g Github) get(ctx context.Context, path string, v any) error {
+	resp, err := g.request(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", path, resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Meta returns GitHub's published IP ranges as the raw /meta response.
+func (g Github) Meta(ctx context.Context) ([]byte, error) {
+	resp, err := g.request(ctx, http.MethodGet, "/meta", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET /meta: %s", resp.Status)
+	}
+
+	return io.ReadAll(resp.Body)
+}
@@ -0,0 +1,158 @@
+package github
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/trunners/runners/logger"
+)
+
+const perPage = 100
+
+// ErrUnknownKey is returned when a key belongs to none of the configured users.
+var ErrUnknownKey = errors.New("key does not belong to a known GitHub user")
+
+type userKey struct {
+	ID  int64  `json:"id"`
+	Key string `json:"key"`
+}
+
+type member struct {
+	Login string `json:"login"`
+}
+
+type permission struct {
+	Permission string `json:"permission"`
+}
+
+// Keys returns the public SSH keys of a GitHub user.
+func (g Github) Keys(ctx context.Context, login string) ([]ssh.PublicKey, error) {
+	var userKeys []userKey
+	err := g.get(ctx, "/users/"+url.PathEscape(login)+"/keys", &userKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]ssh.PublicKey, 0, len(userKeys))
+	for _, k := range userKeys {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(k.Key))
+		if err != nil {
+			continue
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// TeamMembers returns the logins of the members of an organization's team.
+func (g Github) TeamMembers(ctx context.Context, org, team string) ([]string, error) {
+	var logins []string
+	for page := 1; ; page++ {
+		var members []member
+		path := fmt.Sprintf("/orgs/%s/teams/%s/members", url.PathEscape(org), url.PathEscape(team))
+		err := g.get(ctx, fmt.Sprintf("%s?per_page=%d&page=%d", path, perPage, page), &members)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, m := range members {
+			logins = append(logins, m.Login)
+		}
+
+		if len(members) < perPage {
+			return logins, nil
+		}
+	}
+}
+
+// Permission returns the permission of a user on a repository: admin, write, read or none.
+func (g Github) Permission(ctx context.Context, owner, repository, login string) (string, error) {
+	var p permission
+	path := fmt.Sprintf("/repos/%s/%s/collaborators/%s/permission",
+		url.PathEscape(owner), url.PathEscape(repository), url.PathEscape(login))
+	err := g.get(ctx, path, &p)
+	return p.Permission, err
+}
+
+// Users authorizes SSH keys by the GitHub users they belong to. Users are
+// either listed by login or members of a team, and results are cached.
+type Users struct {
+	github Github
+	logins []string
+	org    string
+	team   string
+
+	keys        *cache[[]ssh.PublicKey]
+	members     *cache[[]string]
+	permissions *cache[string]
+}
+
+// Users returns an authorizer for the given logins and the members of team in org.
+func (g Github) Users(logins []string, org, team string, ttl time.Duration) *Users {
+	return &Users{
+		github:      g,
+		logins:      logins,
+		org:         org,
+		team:        team,
+		keys:        newCache[[]ssh.PublicKey](ttl),
+		members:     newCache[[]string](ttl),
+		permissions: newCache[string](ttl),
+	}
+}
+
+// Login returns the login of the user the key belongs to. Users whose keys
+// cannot be fetched are skipped, so that one of them does not lock out all.
+func (u *Users) Login(ctx context.Context, key ssh.PublicKey) (string, error) {
+	log := logger.FromContext(ctx)
+
+	logins := slices.Clone(u.logins)
+	if u.team != "" {
+		members, err := u.members.get(u.org+"/"+u.team, func() ([]string, error) {
+			return u.github.TeamMembers(ctx, u.org, u.team)
+		})
+		if err != nil {
+			return "", err
+		}
+
+		logins = append(logins, members...)
+	}
+
+	marshaled := key.Marshal()
+	for _, login := range logins {
+		keys, err := u.keys.get(login, func() ([]ssh.PublicKey, error) {
+			return u.github.Keys(ctx, login)
+		})
+		if err != nil {
+			log.WarnContext(ctx, "Could not fetch the keys of a GitHub user", "login", login, "error", err)
+			continue
+		}
+
+		for _, k := range keys {
+			if slices.Equal(k.Marshal(), marshaled) {
+				return login, nil
+			}
+		}
+	}
+
+	return "", ErrUnknownKey
+}
+
+// CanWrite reports whether the user has write permission on the repository.
+func (u *Users) CanWrite(ctx context.Context, login, owner, repository string) (bool, error) {
+	p, err := u.permissions.get(owner+"/"+repository+"/"+login, func() (string, error) {
+		return u.github.Permission(ctx, owner, repository, login)
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return p == "admin" || p == "write", nil
+}
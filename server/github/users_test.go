@@ -0,0 +1,348 @@
+package github
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// fakeGithub serves the parts of the GitHub API used to authorize users.
+type fakeGithub struct {
+	t *testing.T
+
+	members     []string
+	keys        map[string][]ssh.PublicKey
+	failing     map[string]bool
+	permissions map[string]string
+
+	mu       sync.Mutex
+	requests map[string]int
+}
+
+func newFakeGithub(t *testing.T) (*fakeGithub, Github) {
+	t.Helper()
+
+	f := &fakeGithub{
+		t:           t,
+		keys:        map[string][]ssh.PublicKey{},
+		failing:     map[string]bool{},
+		permissions: map[string]string{},
+		requests:    map[string]int{},
+	}
+
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+
+	g, err := New("token", server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return f, g
+}
+
+func (f *fakeGithub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer token" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path := r.URL.EscapedPath()
+	f.requests[path]++
+
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	switch {
+	case len(parts) == 5 && parts[0] == "orgs" && parts[2] == "teams" && parts[4] == "members":
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		perPage, _ := strconv.Atoi(r.URL.Query().Get("per_page"))
+		start := min((page-1)*perPage, len(f.members))
+		end := min(start+perPage, len(f.members))
+
+		members := make([]member, 0, end-start)
+		for _, login := range f.members[start:end] {
+			members = append(members, member{Login: login})
+		}
+		f.reply(w, members)
+
+	case len(parts) == 3 && parts[0] == "users" && parts[2] == "keys":
+		if f.failing[parts[1]] {
+			http.Error(w, "failing", http.StatusInternalServerError)
+			return
+		}
+
+		var keys []userKey
+		for i, key := range f.keys[parts[1]] {
+			keys = append(keys, userKey{ID: int64(i), Key: string(ssh.MarshalAuthorizedKey(key))})
+		}
+		f.reply(w, keys)
+
+	case len(parts) == 6 && parts[0] == "repos" && parts[3] == "collaborators" && parts[5] == "permission":
+		p, ok := f.permissions[parts[1]+"/"+parts[2]+"/"+parts[4]]
+		if !ok {
+			p = "none"
+		}
+		f.reply(w, permission{Permission: p})
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeGithub) reply(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		f.t.Error(err)
+	}
+}
+
+// update changes what the API serves while requests may be served.
+func (f *fakeGithub) update(change func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	change()
+}
+
+// count returns how often path was requested.
+func (f *fakeGithub) count(path string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.requests[path]
+}
+
+func newKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ssh.NewPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+// expire makes all entries of the cache expire.
+func expire[V any](c *cache[V]) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, e := range c.entries {
+		e.fetched = e.fetched.Add(-c.ttl)
+		c.entries[key] = e
+	}
+}
+
+func TestTeamMembers(t *testing.T) {
+	f, g := newFakeGithub(t)
+	for i := range perPage + 20 {
+		f.members = append(f.members, fmt.Sprintf("user%d", i))
+	}
+
+	members, err := g.TeamMembers(context.Background(), "org", "team")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(members) != len(f.members) {
+		t.Fatalf("got %d members, want %d", len(members), len(f.members))
+	}
+	if members[perPage] != f.members[perPage] {
+		t.Errorf("got %s as member %d, want %s", members[perPage], perPage, f.members[perPage])
+	}
+	if n := f.count("/orgs/org/teams/team/members"); n != 2 {
+		t.Errorf("got %d pages requested, want 2", n)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	f, g := newFakeGithub(t)
+	key := newKey(t)
+	f.keys["alice"] = []ssh.PublicKey{key, newKey(t)}
+
+	keys, err := g.Keys(context.Background(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(keys) != 2 || !keysEqual(keys[0], key) {
+		t.Errorf("got %d keys, want the 2 of alice", len(keys))
+	}
+}
+
+func TestKeysEscapesLogin(t *testing.T) {
+	f, g := newFakeGithub(t)
+
+	keys, err := g.Keys(context.Background(), "../orgs/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Errorf("got %d keys of an unknown login, want none", len(keys))
+	}
+
+	if n := f.count("/users/..%2Forgs%2Fx/keys"); n != 1 {
+		t.Errorf("got %d requests for the escaped login, want 1", n)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	f, g := newFakeGithub(t)
+	alice, bob := newKey(t), newKey(t)
+	f.members = []string{"bob"}
+	f.keys["alice"] = []ssh.PublicKey{alice}
+	f.keys["bob"] = []ssh.PublicKey{bob}
+
+	u := g.Users([]string{"alice"}, "org", "team", time.Minute)
+
+	for want, key := range map[string]ssh.PublicKey{"alice": alice, "bob": bob} {
+		login, err := u.Login(context.Background(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if login != want {
+			t.Errorf("got %s, want %s", login, want)
+		}
+	}
+
+	_, err := u.Login(context.Background(), newKey(t))
+	if !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("got %v for an unknown key, want %v", err, ErrUnknownKey)
+	}
+}
+
+func TestLoginSkipsFailingUser(t *testing.T) {
+	f, g := newFakeGithub(t)
+	bob := newKey(t)
+	f.members = []string{"alice", "bob"}
+	f.failing["alice"] = true
+	f.keys["bob"] = []ssh.PublicKey{bob}
+
+	u := g.Users(nil, "org", "team", time.Minute)
+
+	login, err := u.Login(context.Background(), bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if login != "bob" {
+		t.Errorf("got %s, want bob", login)
+	}
+}
+
+func TestLoginCache(t *testing.T) {
+	f, g := newFakeGithub(t)
+	alice, bob := newKey(t), newKey(t)
+	f.members = []string{"alice"}
+	f.keys["alice"] = []ssh.PublicKey{alice}
+
+	u := g.Users(nil, "org", "team", time.Minute)
+	ctx := context.Background()
+
+	for range 2 {
+		_, err := u.Login(ctx, alice)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := f.count("/orgs/org/teams/team/members"); n != 1 {
+		t.Errorf("got %d team requests, want 1 while cached", n)
+	}
+	if n := f.count("/users/alice/keys"); n != 1 {
+		t.Errorf("got %d key requests, want 1 while cached", n)
+	}
+
+	// Changes show once the cache expires
+	f.update(func() {
+		f.members = []string{"alice", "bob"}
+		f.keys["bob"] = []ssh.PublicKey{bob}
+	})
+
+	_, err := u.Login(ctx, bob)
+	if !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("got %v for a new member while cached, want %v", err, ErrUnknownKey)
+	}
+
+	expire(u.members)
+	expire(u.keys)
+
+	login, err := u.Login(ctx, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if login != "bob" {
+		t.Errorf("got %s, want bob", login)
+	}
+	if n := f.count("/users/alice/keys"); n != 2 {
+		t.Errorf("got %d key requests, want 2 after expiry", n)
+	}
+}
+
+func TestLoginDoesNotCacheErrors(t *testing.T) {
+	f, g := newFakeGithub(t)
+	alice := newKey(t)
+	f.members = []string{"alice"}
+	f.failing["alice"] = true
+	f.keys["alice"] = []ssh.PublicKey{alice}
+
+	u := g.Users(nil, "org", "team", time.Minute)
+	ctx := context.Background()
+
+	_, err := u.Login(ctx, alice)
+	if !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("got %v while the keys fail, want %v", err, ErrUnknownKey)
+	}
+
+	f.update(func() { f.failing["alice"] = false })
+
+	login, err := u.Login(ctx, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if login != "alice" {
+		t.Errorf("got %s, want alice", login)
+	}
+}
+
+func TestCanWrite(t *testing.T) {
+	f, g := newFakeGithub(t)
+	f.permissions["owner/repo/alice"] = "write"
+	f.permissions["owner/repo/bob"] = "read"
+	f.permissions["owner/repo/carol"] = "admin"
+
+	u := g.Users(nil, "", "", time.Minute)
+
+	for login, want := range map[string]bool{"alice": true, "bob": false, "carol": true, "dave": false} {
+		ok, err := u.CanWrite(context.Background(), login, "owner", "repo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != want {
+			t.Errorf("got %t for %s, want %t", ok, login, want)
+		}
+	}
+}
+
+func keysEqual(a, b ssh.PublicKey) bool {
+	return string(a.Marshal()) == string(b.Marshal())
+}
@@ -0,0 +1,116 @@
+package github
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// maxWebhookSize limits the webhook payloads read.
+const maxWebhookSize = 5 << 20
+
+// ErrSignature is returned for webhook deliveries without a valid signature.
+var ErrSignature = errors.New("invalid webhook signature")
+
+// Webhook event types.
+const (
+	WorkflowRunEvent = "workflow_run"
+	WorkflowJobEvent = "workflow_job"
+)
+
+// WebhookEvent is a workflow_run or workflow_job event. Status is queued,
+// in_progress or completed, and the conclusion tells how a completed run or
+// job ended, such as success, failure or cancelled.
+type WebhookEvent struct {
+	Type       string
+	Action     string
+	RunID      int64
+	Status     string
+	Conclusion string
+	RunnerName string
+	HTMLURL    string
+}
+
+type workflowRunPayload struct {
+	Action      string `json:"action"`
+	WorkflowRun struct {
+		ID         int64  `json:"id"`
+		Status     string `json:"status"`
+		Conclusion string `json:"conclusion"`
+		HTMLURL    string `json:"html_url"`
+	} `json:"workflow_run"`
+}
+
+type workflowJobPayload struct {
+	Action      string `json:"action"`
+	WorkflowJob struct {
+		RunID      int64  `json:"run_id"`
+		Status     string `json:"status"`
+		Conclusion string `json:"conclusion"`
+		RunnerName string `json:"runner_name"`
+		HTMLURL    string `json:"html_url"`
+	} `json:"workflow_job"`
+}
+
+// ReadWebhook verifies the X-Hub-Signature-256 of a webhook delivery with
+// secret and reads its event. Events of other types than workflow_run and
+// workflow_job are returned with their type only.
+func ReadWebhook(r *http.Request, secret string) (WebhookEvent, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookSize))
+	if err != nil {
+		return WebhookEvent{}, err
+	}
+
+	signature, ok := strings.CutPrefix(r.Header.Get("X-Hub-Signature-256"), "sha256=")
+	if !ok {
+		return WebhookEvent{}, ErrSignature
+	}
+	given, err := hex.DecodeString(signature)
+	if err != nil {
+		return WebhookEvent{}, ErrSignature
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	if !hmac.Equal(given, mac.Sum(nil)) {
+		return WebhookEvent{}, ErrSignature
+	}
+
+	event := WebhookEvent{Type: r.Header.Get("X-GitHub-Event")}
+	switch event.Type {
+	case WorkflowRunEvent:
+		var payload workflowRunPayload
+		err = json.Unmarshal(body, &payload)
+		if err != nil {
+			return WebhookEvent{}, fmt.Errorf("%s: %w", event.Type, err)
+		}
+
+		event.Action = payload.Action
+		event.RunID = payload.WorkflowRun.ID
+		event.Status = payload.WorkflowRun.Status
+		event.Conclusion = payload.WorkflowRun.Conclusion
+		event.HTMLURL = payload.WorkflowRun.HTMLURL
+
+	case WorkflowJobEvent:
+		var payload workflowJobPayload
+		err = json.Unmarshal(body, &payload)
+		if err != nil {
+			return WebhookEvent{}, fmt.Errorf("%s: %w", event.Type, err)
+		}
+
+		event.Action = payload.Action
+		event.RunID = payload.WorkflowJob.RunID
+		event.Status = payload.WorkflowJob.Status
+		event.Conclusion = payload.WorkflowJob.Conclusion
+		event.RunnerName = payload.WorkflowJob.RunnerName
+		event.HTMLURL = payload.WorkflowJob.HTMLURL
+	}
+
+	return event, nil
+}
@@ -0,0 +1,119 @@
+package github
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func sign(secret, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestReadWebhook(t *testing.T) {
+	const (
+		run = `{"action":"completed","workflow_run":{"id":7,"status":"completed","conclusion":"failure",` +
+			`"html_url":"https://github.com/o/r/actions/runs/7"}}`
+		job = `{"action":"in_progress","workflow_job":{"run_id":7,"status":"in_progress","runner_name":"runner-1"}}`
+	)
+
+	tests := []struct {
+		name      string
+		event     string
+		body      string
+		signature string
+		want      WebhookEvent
+		err       error
+		// malformed is set if the payload does not parse
+		malformed bool
+	}{
+		{
+			name:      "workflow run",
+			event:     WorkflowRunEvent,
+			body:      run,
+			signature: sign("secret", run),
+			want: WebhookEvent{
+				Type:       WorkflowRunEvent,
+				Action:     "completed",
+				RunID:      7,
+				Status:     "completed",
+				Conclusion: "failure",
+				HTMLURL:    "https://github.com/o/r/actions/runs/7",
+			},
+		},
+		{
+			name:      "workflow job",
+			event:     WorkflowJobEvent,
+			body:      job,
+			signature: sign("secret", job),
+			want: WebhookEvent{
+				Type:       WorkflowJobEvent,
+				Action:     "in_progress",
+				RunID:      7,
+				Status:     "in_progress",
+				RunnerName: "runner-1",
+			},
+		},
+		{
+			name:      "other event",
+			event:     "ping",
+			body:      `{"zen":"Keep it logically awesome."}`,
+			signature: sign("secret", `{"zen":"Keep it logically awesome."}`),
+			want:      WebhookEvent{Type: "ping"},
+		},
+		{name: "unsigned", event: WorkflowRunEvent, body: run, err: ErrSignature},
+		{name: "other secret", event: WorkflowRunEvent, body: run, signature: sign("other", run), err: ErrSignature},
+		{
+			name:      "other body",
+			event:     WorkflowRunEvent,
+			body:      strings.Replace(run, `"id":7`, `"id":8`, 1),
+			signature: sign("secret", run),
+			err:       ErrSignature,
+		},
+		{
+			name:      "sha1 signature",
+			event:     WorkflowRunEvent,
+			body:      run,
+			signature: strings.Replace(sign("secret", run), "sha256=", "sha1=", 1),
+			err:       ErrSignature,
+		},
+		{name: "not hex", event: WorkflowRunEvent, body: run, signature: "sha256=zz", err: ErrSignature},
+		{
+			name:      "malformed",
+			event:     WorkflowRunEvent,
+			body:      `{"action":`,
+			signature: sign("secret", `{"action":`),
+			malformed: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(test.body))
+			r.Header.Set("X-GitHub-Event", test.event)
+			if test.signature != "" {
+				r.Header.Set("X-Hub-Signature-256", test.signature)
+			}
+
+			event, err := ReadWebhook(r, "secret")
+			switch {
+			case test.malformed:
+				if err == nil || errors.Is(err, ErrSignature) {
+					t.Errorf("got error %v, want one parsing the payload", err)
+				}
+			case !errors.Is(err, test.err):
+				t.Errorf("got error %v, want %v", err, test.err)
+			case event != test.want:
+				t.Errorf("got %+v, want %+v", event, test.want)
+			}
+		})
+	}
+}
@@ -1,74 +1,101 @@
 package github
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
+	"maps"
 	"net/http"
 )
 
-type Github struct {
-	Token  string
-	client *http.Client
+type Inputs struct {
+	RunsOn  string `json:"runs-on"`
+	Server  string `json:"server"`
+	Session string `json:"session,omitempty"`
+
+	// Extra are further inputs the workflow declares, which cannot replace
+	// the ones above.
+	Extra map[string]string `json:"-"`
 }
 
-func New(token string) (Github, error) {
-	if token == "" {
-		return Github{}, errors.New("missing GitHub token")
+// MarshalJSON encodes the inputs as one object, the extra ones included.
+func (i Inputs) MarshalJSON() ([]byte, error) {
+	inputs := make(map[string]string, len(i.Extra)+3) //nolint:mnd // the fixed inputs
+	maps.Copy(inputs, i.Extra)
+	inputs["runs-on"] = i.RunsOn
+	inputs["server"] = i.Server
+	if i.Session != "" {
+		inputs["session"] = i.Session
 	}
 
-	return Github{
-		Token:  token,
-		client: &http.Client{},
-	}, nil
+	return json.Marshal(inputs)
 }
 
-type Inputs struct {
-	RunsOn string `json:"runs-on"`
-	Server string `json:"server"`
+type Dispatch struct {
+	Ref              string `json:"ref"`
+	Inputs           Inputs `json:"inputs"`
+	ReturnRunDetails bool   `json:"return_run_details"`
 }
 
-type Dispatch struct {
-	Ref    string `json:"ref"`
-	Inputs Inputs `json:"inputs"`
+// Run is the workflow run created by a dispatch.
+type Run struct {
+	ID      int64  `json:"workflow_run_id"`
+	URL     string `json:"run_url"`
+	HTMLURL string `json:"html_url"`
 }
 
-func (g Github) Workflow(ctx context.Context, id, owner, repository, ref, runsOn, server string) error {
+// Workflow dispatches the workflow and returns the created run. The run is
+// empty if the API does not return run details. The runner calls back to
+// server with the session token. The extra inputs are passed along.
+func (g Github) Workflow(
+	ctx context.Context,
+	id, owner, repository, ref, runsOn, server, session string,
+	extra map[string]string,
+) (Run, error) {
 	inputs := Inputs{
-		RunsOn: runsOn,
-		Server: server,
+		RunsOn:  runsOn,
+		Server:  server,
+		Session: session,
+		Extra:   extra,
 	}
 
 	dispatch := Dispatch{
-		Ref:    ref,
-		Inputs: inputs,
+		Ref:              ref,
+		Inputs:           inputs,
+		ReturnRunDetails: true,
 	}
 
-	body, err := json.Marshal(dispatch)
+	var run Run
+	path := fmt.Sprintf("/repos/%s/%s/actions/workflows/%s/dispatches", owner, repository, id)
+	resp, err := g.request(ctx, http.MethodPost, path, dispatch)
 	if err != nil {
-		return err
+		return run, err
 	}
+	defer resp.Body.Close()
 
-	url := fmt.Sprintf("https://api.github.com/repos/%s/%s/actions/workflows/%s/dispatches", owner, repository, id)
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(body))
-	if err != nil {
-		return err
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+		return run, nil
+	case http.StatusOK:
+		err = json.NewDecoder(resp.Body).Decode(&run)
+		return run, err
+	default:
+		return run, fmt.Errorf("failed to trigger workflow: %s", resp.Status)
 	}
+}
 
-	req.Header.Set("Accpet", "application/vnd.github+json")
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", g.Token))
-	req.Header.Set("X-Github-Api-Version", "2022-11-28")
-
-	resp, err := g.client.Do(req)
+// Cancel cancels a workflow run unless it completed already.
+func (g Github) Cancel(ctx context.Context, owner, repository string, runID int64) error {
+	path := fmt.Sprintf("/repos/%s/%s/actions/runs/%d/cancel", owner, repository, runID)
+	resp, err := g.request(ctx, http.MethodPost, path, nil)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusNoContent {
-		return fmt.Errorf("failed to trigger workflow: %s", resp.Status)
+	// a run that completed already conflicts with being cancelled
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusConflict {
+		return fmt.Errorf("failed to cancel workflow run: %s", resp.Status)
 	}
 
 	return nil
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/trunners/runners/logger"
+	"github.com/trunners/runners/server/config"
+)
+
+// Host key rotation requests of the OpenSSH protocol, see PROTOCOL in the OpenSSH sources.
+const (
+	hostKeysRequest = "hostkeys-00@openssh.com"
+	hostKeysProve   = "hostkeys-prove-00@openssh.com"
+)
+
+// hostKeys announces all host keys to the client so that it can learn keys
+// before they are rotated in, and proves ownership of the keys the client
+// asks about. Other global requests are refused.
+func hostKeys(ctx context.Context, conn ssh.Conn, requests <-chan *ssh.Request, keys []config.HostKey) {
+	log := logger.FromContext(ctx)
+
+	var announcement []byte
+	for _, key := range keys {
+		announcement = appendString(announcement, key.Signer.PublicKey().Marshal())
+	}
+
+	_, _, err := conn.SendRequest(hostKeysRequest, false, announcement)
+	if err != nil {
+		log.WarnContext(ctx, "Could not announce host keys", "error", err)
+	}
+
+	for req := range requests {
+		if req.Type != hostKeysProve {
+			if req.WantReply {
+				_ = req.Reply(false, nil)
+			}
+			continue
+		}
+
+		proof, err := prove(conn.SessionID(), req.Payload, keys, rsaAlgorithm(conn))
+		if err != nil {
+			log.WarnContext(ctx, "Could not prove host keys", "error", err)
+		}
+
+		err = req.Reply(err == nil, proof)
+		if err != nil {
+			log.WarnContext(ctx, "Could not reply to request", "type", req.Type, "error", err)
+		}
+	}
+}
+
+// prove signs each of the requested host keys together with the session ID,
+// RSA keys with the given algorithm.
+func prove(sessionID []byte, payload []byte, keys []config.HostKey, algorithm string) ([]byte, error) {
+	var proof []byte
+	for len(payload) > 0 {
+		var blob []byte
+		var ok bool
+		blob, payload, ok = readString(payload)
+		if !ok {
+			return nil, errors.New("malformed host key")
+		}
+
+		var signer ssh.Signer
+		for _, key := range keys {
+			if string(key.Signer.PublicKey().Marshal()) == string(blob) {
+				signer = key.Signer
+			}
+		}
+		if signer == nil {
+			return nil, errors.New("unknown host key")
+		}
+
+		data := appendString(nil, []byte(hostKeysProve))
+		data = appendString(data, sessionID)
+		data = appendString(data, blob)
+
+		signature, err := sign(signer, data, algorithm)
+		if err != nil {
+			return nil, err
+		}
+
+		proof = appendString(proof, ssh.Marshal(signature))
+	}
+
+	return proof, nil
+}
+
+// rsaAlgorithm returns the algorithm to sign with RSA host keys. OpenSSH
+// clients verify the proofs with the negotiated host key algorithm if it is
+// an RSA one, and accept rsa-sha2-512 otherwise.
+func rsaAlgorithm(conn ssh.Conn) string {
+	if server, ok := conn.(*ssh.ServerConn); ok {
+		conn = server.Conn
+	}
+
+	if c, ok := conn.(ssh.AlgorithmsConnMetadata); ok {
+		algorithm := strings.TrimSuffix(c.Algorithms().HostKey, "-cert-v01@openssh.com")
+		switch algorithm {
+		case ssh.KeyAlgoRSA, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSASHA512:
+			return algorithm
+		}
+	}
+
+	return ssh.KeyAlgoRSASHA512
+}
+
+// sign signs data, with the given algorithm for RSA keys.
+func sign(signer ssh.Signer, data []byte, algorithm string) (*ssh.Signature, error) {
+	if algorithmSigner, ok := signer.(ssh.AlgorithmSigner); ok && signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+		return algorithmSigner.SignWithAlgorithm(rand.Reader, data, algorithm)
+	}
+
+	return signer.Sign(rand.Reader, data)
+}
+
+func appendString(b []byte, s []byte) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(s))) //nolint:gosec // keys and signatures are small
+	return append(b, s...)
+}
+
+func readString(b []byte) ([]byte, []byte, bool) {
+	if len(b) < 4 { //nolint:mnd // uint32 length
+		return nil, nil, false
+	}
+
+	length := binary.BigEndian.Uint32(b)
+	b = b[4:]
+	if uint32(len(b)) < length { //nolint:gosec // length of a packet
+		return nil, nil, false
+	}
+
+	return b[:length], b[length:], true
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/trunners/runners/logger"
+	"github.com/trunners/runners/server/metrics"
+	"github.com/trunners/runners/server/pool"
+)
+
+const readHeaderTimeout = 10 * time.Second
+
+// web serves HTTP, and HTTPS with a certificate, on the broker's port until
+// ctx is done. The pool hands over the connections it sniffed. The admin API,
+// metrics and webhook are only served while their tokens are configured.
+func web(ctx context.Context, current *settings, p *pool.Pool, a *admin) error {
+	mux := http.NewServeMux()
+	mux.Handle("/admin/", http.StripPrefix("/admin", a.handler()))
+	mux.Handle("GET /metrics", bearer(func() string { return current.Load().MetricsToken }, metrics.Handler()))
+	mux.Handle("POST /webhook", webhook(func() string { return current.Load().WebhookSecret }, a.sessions))
+
+	listeners := []net.Listener{p.HTTP()}
+	if current.Load().TLS != nil {
+		listeners = append(listeners, tls.NewListener(p.TLS(), &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+				return current.Load().TLS, nil
+			},
+		}))
+	}
+
+	return serveHTTP(ctx, mux, listeners...)
+}
+
+// serveMetrics serves the metrics on their own listener until ctx is done.
+// The metrics token is required while one is configured, without one the
+// metrics are open to whoever reaches the listener.
+func serveMetrics(ctx context.Context, listener net.Listener, current *settings) error {
+	token := func() string { return current.Load().MetricsToken }
+	protected := bearer(token, metrics.Handler())
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token() == "" {
+			metrics.Handler().ServeHTTP(w, r)
+			return
+		}
+		protected.ServeHTTP(w, r)
+	}))
+
+	logger.FromContext(ctx).InfoContext(ctx, "Serving metrics", "address", listener.Addr())
+	return serveHTTP(ctx, mux, listener)
+}
+
+// serveHTTP serves handler on the listeners until ctx is done.
+func serveHTTP(ctx context.Context, handler http.Handler, listeners ...net.Listener) error {
+	log := logger.FromContext(ctx)
+
+	server := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: readHeaderTimeout,
+		BaseContext:       func(net.Listener) context.Context { return ctx },
+	}
+
+	go func() {
+		<-ctx.Done()
+		err := server.Close()
+		if err != nil {
+			log.ErrorContext(ctx, "Could not close HTTP server", "error", err)
+		}
+	}()
+
+	errs := make([]error, len(listeners))
+	var wg sync.WaitGroup
+	for i, listener := range listeners {
+		wg.Go(func() {
+			err := server.Serve(listener)
+			if !errors.Is(err, http.ErrServerClosed) {
+				errs[i] = err
+			}
+		})
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// bearer requires the current token as bearer token, serving nothing
+// without a token.
+func bearer(token func() string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		want := token()
+		if want == "" {
+			http.NotFound(w, r)
+			return
+		}
+
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(want)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, "invalid token")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/trunners/runners/logger"
+	"github.com/trunners/runners/server/audit"
+	"github.com/trunners/runners/server/config"
+	"github.com/trunners/runners/server/github"
+	"github.com/trunners/runners/server/metrics"
+	"github.com/trunners/runners/server/pool"
+	"github.com/trunners/runners/server/quota"
+	"github.com/trunners/runners/server/state"
+)
+
+var (
+	errFailover = errors.New("runner took too long to call back")
+	errDispatch = errors.New("dispatch failed")
+)
+
+// candidates returns the names of the targets a login may be served by: the
+// target it names, or else those providing the capabilities it asks for.
+// The latter are ordered by cost and named reports false for them. The
+// reserved name never names a target.
+func candidates(cfg *config.Config, login, target string) ([]string, bool) {
+	if target == config.Reserved {
+		return nil, false
+	}
+
+	if _, ok := cfg.Workflows[target]; ok {
+		return []string{target}, true
+	}
+
+	reqs, err := config.ParseRequirements(login)
+	if err != nil {
+		return nil, false
+	}
+
+	return cfg.Match(reqs), false
+}
+
+// launchRequest returns the quota request of a session on target.
+func launchRequest(cfg *config.Config, user string, perms *ssh.Permissions, target config.Target) quota.Request {
+	return quota.Request{
+		Subjects: subjects(cfg, user, perms),
+		Target:   target.Name,
+		Runners:  target.Workflow.Runners,
+		Weight:   target.Workflow.Weight(),
+	}
+}
+
+// preferWait orders the targets by how long sessions of their requests are
+// expected to wait for a runner, keeping the order of those with equal waits.
+func preferWait(q *quota.Quota, targets []config.Target, request func(config.Target) quota.Request) {
+	expected := make(map[string]time.Duration, len(targets))
+	for _, target := range targets {
+		expected[target.Name] = q.Expected(request(target))
+	}
+
+	slices.SortStableFunc(targets, func(a, b config.Target) int {
+		return cmp.Compare(expected[a.Name], expected[b.Name])
+	})
+}
+
+// acquire leases a runner of the first of the requested targets that is
+// not at capacity, starting at from, and returns its index. If all are at
+// capacity the error is the *quota.BusyError of the first.
+func acquire(q *quota.Quota, requests []quota.Request, from int) (int, *quota.Lease, error) {
+	var busy error
+	for i := from; i < len(requests); i++ {
+		lease, err := q.Acquire(requests[i])
+
+		var busyErr *quota.BusyError
+		if !errors.As(err, &busyErr) {
+			return i, lease, err
+		}
+		if busy == nil {
+			busy = err
+		}
+	}
+
+	return from, nil, busy
+}
+
+// failover returns the context to wait for the runner of the i-th of n
+// targets in, which ends with errFailover after the failover timeout unless
+// it is the last one.
+func failover(ctx context.Context, cfg *config.Config, i, n int) (context.Context, context.CancelFunc) {
+	if i == n-1 || cfg.Selection.Failover <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeoutCause(ctx, time.Duration(cfg.Selection.Failover), errFailover)
+}
+
+// launcher launches the workflow of a session, falling back to the next of
+// its targets while runners take too long to call back.
+type launcher struct {
+	cfg      *config.Config
+	gh       github.Github
+	pool     *pool.Pool
+	quota    *quota.Quota
+	store    *state.Store
+	session  *session
+	targets  []config.Target
+	requests []quota.Request
+
+	// switched is called with the target fallen back to and its lease.
+	switched func(config.Target, *quota.Lease)
+}
+
+// launched is the target a session was launched on last, with its lease,
+// its run and the runner that called back.
+type launched struct {
+	target     config.Target
+	lease      *quota.Lease
+	run        github.Run
+	recorded   bool
+	dispatched time.Time
+	runner     pool.Connection
+}
+
+// launch dispatches the workflow of the i-th target, leased by lease, and
+// waits for its runner. If it takes longer than the failover timeout, the run
+// is cancelled and the next target with a runner to spare is launched instead.
+// The target, lease and run launched last are returned even on error, which
+// wraps errDispatch if the workflow could not be dispatched.
+func (ln *launcher) launch(ctx context.Context, i int, lease *quota.Lease) (launched, error) {
+	log := logger.FromContext(ctx)
+	s := ln.session
+	l := launched{target: ln.targets[i], lease: lease}
+
+	for {
+		w := l.target.Workflow
+		log.InfoContext(ctx, "Starting workflow", "target", l.target.String())
+		token := rand.Text()
+		l.dispatched = time.Now()
+		run, err := ln.gh.Workflow(
+			ctx, w.ID, w.Owner, w.Repository, w.Ref, w.RunsOn, fmt.Sprintf("%s:%d", ln.cfg.Host, ln.cfg.Port), token, l.target.Inputs,
+		)
+		if err != nil {
+			log.ErrorContext(ctx, "Failed to start workflow", "error", err)
+			metrics.DispatchFailures.Inc(s.target)
+			return l, fmt.Errorf("%w: %w", errDispatch, err)
+		}
+		l.run = run
+		metrics.Dispatches.Observe(time.Since(l.dispatched).Seconds(), s.target)
+		s.mu.Lock()
+		s.runID = run.ID
+		s.runURL = run.HTMLURL
+		s.mu.Unlock()
+		s.audit.SetRun(run.ID)
+		s.audit.Log(ctx, audit.Event{Event: audit.Dispatch})
+
+		if run.ID != 0 {
+			err = ln.store.Start(state.Session{
+				ID:         s.id,
+				User:       s.user,
+				Target:     s.target,
+				Owner:      w.Owner,
+				Repository: w.Repository,
+				RunID:      run.ID,
+				Token:      token,
+				Started:    s.started,
+				Broker:     os.Getpid(),
+			})
+			if err != nil {
+				log.ErrorContext(ctx, "Failed to record session", "error", err)
+			}
+			l.recorded = err == nil
+		}
+
+		log.InfoContext(ctx, "Waiting for TCP connection", "run", run.HTMLURL)
+		waitCtx, cancelWait := failover(ctx, ln.cfg, i, len(ln.targets))
+		l.runner, err = ln.pool.Runner(waitCtx, token)
+		timedOut := errors.Is(context.Cause(waitCtx), errFailover)
+		cancelWait()
+		if err == nil || !timedOut || ctx.Err() != nil {
+			return l, err
+		}
+
+		// Fall back to the next target that has a runner to spare
+		next, nextLease, err := acquire(ln.quota, ln.requests, i+1)
+		if err != nil {
+			log.InfoContext(ctx, "No target to fall back to, waiting", "target", l.target.Name, "error", err)
+			l.runner, err = ln.pool.Runner(ctx, token)
+			return l, err
+		}
+		log.InfoContext(ctx, "Runner took too long, falling back", "target", l.target.Name, "next", ln.targets[next].Name)
+		s.lobby.notify(fmt.Sprintf("No runner of %q connected within %s, trying %q.",
+			l.target.Name, time.Duration(ln.cfg.Selection.Failover), ln.targets[next].Name))
+
+		// Forget and cancel the run first, so that its end does not end the session
+		s.mu.Lock()
+		s.runID = 0
+		s.runURL = ""
+		s.mu.Unlock()
+		if l.recorded {
+			err = ln.store.End(s.id)
+			if err != nil {
+				log.ErrorContext(ctx, "Failed to forget session", "error", err)
+			}
+			l.recorded = false
+		}
+		if run.ID != 0 {
+			err = ln.gh.Cancel(context.WithoutCancel(ctx), w.Owner, w.Repository, run.ID)
+			if err != nil {
+				log.WarnContext(ctx, "Failed to cancel workflow run", "error", err)
+			}
+		}
+		l.run = github.Run{}
+		err = l.lease.Release()
+		if err != nil {
+			log.ErrorContext(ctx, "Failed to record usage", "error", err)
+		}
+
+		i, l.lease, l.target = next, nextLease, ln.targets[next]
+		metrics.Sessions.Dec(s.target)
+		s.mu.Lock()
+		s.target = l.target.Name
+		s.mu.Unlock()
+		metrics.Sessions.Inc(s.target)
+		s.audit.SetTarget(l.target.String())
+		ln.switched(l.target, l.lease)
+	}
+}
@@ -5,122 +5,319 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"net"
 	"os"
 	"os/signal"
 	"sync"
 	"syscall"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 
 	"github.com/trunners/runners/logger"
+	"github.com/trunners/runners/server/audit"
 	"github.com/trunners/runners/server/config"
-	"github.com/trunners/runners/server/github"
+	"github.com/trunners/runners/server/metrics"
 	"github.com/trunners/runners/server/pool"
+	"github.com/trunners/runners/server/quota"
+	"github.com/trunners/runners/server/recording"
+	"github.com/trunners/runners/server/state"
 )
 
+// checkpointInterval is how often the runner time of active sessions is
+// recorded while they run.
+const checkpointInterval = time.Minute
+
 func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	log := logger.New()
 	ctx = logger.WithLogger(ctx, log)
 
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		err := replay(ctx, os.Args[2:])
+		if err != nil {
+			log.ErrorContext(ctx, "Failed to replay recording", "error", err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
 	config, err := config.Load(ctx)
 	if err != nil {
 		log.ErrorContext(ctx, "Failed to load config", "error", err)
 		os.Exit(1)
 	}
+	logger.Level.Set(config.LogLevel)
+
+	auditLog, err := audit.Open(ctx, config.AuditLog)
+	if err != nil {
+		log.ErrorContext(ctx, "Failed to open audit log", "error", err)
+		os.Exit(1)
+	}
+	defer auditLog.Close()
+
+	store, err := state.Open(config.State)
+	if err != nil {
+		log.ErrorContext(ctx, "Failed to open state", "error", err)
+		os.Exit(1)
+	}
+	defer store.Close()
+
+	q, err := quota.Load(store)
+	if err != nil {
+		log.ErrorContext(ctx, "Failed to load usage", "error", err)
+		os.Exit(1)
+	}
+	go checkpoint(ctx, q)
 
-	gh, err := github.New(config.GithubToken)
+	// Cancel the runs of sessions a crashed broker left behind
+	recorded, err := store.Sessions()
 	if err != nil {
-		log.ErrorContext(ctx, "Failed to create GitHub client", "error", err)
+		log.ErrorContext(ctx, "Failed to read sessions", "error", err)
 		os.Exit(1)
 	}
+	go reconcile(ctx, config.Github, store, recorded)
 
-	p, err := pool.Start(ctx, config.Port)
+	// Listen on the sockets passed on by the broker being upgraded, if any
+	sockets, err := inheritSockets()
 	if err != nil {
-		log.ErrorContext(ctx, "Failed to create connection pool", "error", err)
+		log.ErrorContext(ctx, "Failed to inherit sockets", "error", err)
 		os.Exit(1)
 	}
 
+	listener, err := sockets.listen(ctx, "broker", fmt.Sprintf(":%d", config.Port))
+	if err != nil {
+		log.ErrorContext(ctx, "Failed to listen", "error", err)
+		os.Exit(1)
+	}
+
+	p := pool.Start(ctx, listener, poolOptions(config, newThrottle(config)))
+	current := newSettings(config, p)
+
+	// Stop serving HTTP once the sockets were passed on to a new broker
+	serving, handedOver := context.WithCancel(ctx)
+	defer handedOver()
+
+	if config.MetricsAddress != "" {
+		listener, err := sockets.listen(ctx, "metrics", config.MetricsAddress)
+		if err != nil {
+			log.ErrorContext(ctx, "Failed to listen for metrics", "error", err)
+			os.Exit(1)
+		}
+
+		go func() {
+			err := serveMetrics(serving, listener, current)
+			if err != nil {
+				log.ErrorContext(ctx, "Failed to serve metrics", "error", err)
+			}
+		}()
+	}
+
+	active := newSessions()
+	a := &admin{settings: current, pool: p, sessions: active}
+	if config.AdminAddress != "" {
+		listener, err := sockets.listen(ctx, "admin", config.AdminAddress)
+		if err != nil {
+			log.ErrorContext(ctx, "Failed to listen for admin API", "error", err)
+			os.Exit(1)
+		}
+
+		go func() {
+			err := serveAdmin(serving, listener, a)
+			if err != nil {
+				log.ErrorContext(ctx, "Failed to serve admin API", "error", err)
+			}
+		}()
+	}
+	sockets.close()
+
+	go func() {
+		err := web(serving, current, p, a)
+		if err != nil {
+			log.ErrorContext(ctx, "Failed to serve HTTP", "error", err)
+		}
+	}()
+
+	if config.Watch > 0 {
+		go current.watch(ctx, config.Watch)
+	}
+
+	// Reload the config on SIGHUP. Drain on SIGINT or SIGTERM, and upgrade on
+	// SIGUSR2 by starting the broker's executable again with the sockets
+	// before draining. Signalled again while draining, the broker ends the
+	// remaining sessions at once.
+	accepting, drain := context.WithCancel(ctx)
 	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR2)
 	go func() {
-		<-sigs
-		cancel()
+		for sig := range sigs {
+			switch {
+			case sig == syscall.SIGHUP:
+				err := current.reload(ctx)
+				if err != nil {
+					log.ErrorContext(ctx, "Failed to reload config, keeping the current one", "error", err)
+				}
+			case sig == syscall.SIGUSR2 && accepting.Err() == nil:
+				err := sockets.upgrade(ctx)
+				if err != nil {
+					log.ErrorContext(ctx, "Failed to upgrade", "error", err)
+					continue
+				}
+
+				handedOver()
+				drain()
+			case sig == syscall.SIGUSR2:
+				log.WarnContext(ctx, "Not upgrading while draining")
+			case accepting.Err() == nil:
+				drain()
+			default:
+				log.InfoContext(ctx, "Ending sessions now", "signal", sig)
+				cancel()
+			}
+		}
 	}()
 
+	var wg sync.WaitGroup
+	for {
+		log.InfoContext(ctx, "Waiting for SSH connection", "port", config.Port)
+		serverTCP, err := p.Next(accepting)
+		if err != nil {
+			break
+		}
+
+		// New logins are served with the config current when they connect
+		cfg := current.Load()
+		wg.Go(func() {
+			serve(ctx, &services{
+				cfg:      cfg,
+				gh:       cfg.Github,
+				pool:     p,
+				quota:    q,
+				store:    store,
+				audit:    auditLog,
+				sessions: active,
+			}, serverTCP)
+		})
+	}
+
+	config = current.Load()
+	log.InfoContext(ctx, "Draining sessions", "timeout", config.DrainTimeout)
+	err = p.Close()
+	if err != nil {
+		log.ErrorContext(ctx, "Could not close listener", "error", err)
+	}
+
+	active.shutdown(ctx, config.DrainTimeout)
+	wg.Wait()
+	log.InfoContext(ctx, "Shut down")
+}
+
+// checkpoint records the runner time of the active sessions every
+// checkpointInterval until ctx is done.
+func checkpoint(ctx context.Context, q *quota.Quota) {
+	log := logger.FromContext(ctx)
+
+	ticker := time.NewTicker(checkpointInterval)
+	defer ticker.Stop()
+
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		default:
-			serve(ctx, config, gh, p)
+		case <-ticker.C:
+			err := q.Checkpoint()
+			if err != nil {
+				log.WarnContext(ctx, "Failed to record usage", "error", err)
+			}
 		}
 	}
 }
 
-func serve(ctx context.Context, cfg *config.Config, gh github.Github, p *pool.Pool) {
-	log := logger.FromContext(ctx)
+// session is the state shared by all channels of one SSH connection.
+type session struct {
+	id       string
+	user     string
+	target   string
+	started  time.Time
+	perms    *ssh.Permissions
+	recorder *recording.Recorder
+	audit    *audit.Session
+	activity activity
+	in, out  count
+	cancel   context.CancelCauseFunc
+	lobby    *lobby
+
+	mu         sync.Mutex
+	client     *ssh.Client
+	runnerName string
+	runID      int64
+	runURL     string
+	channels   map[ssh.Channel]struct{}
+}
 
-	log.InfoContext(ctx, "Waiting for SSH connection", "port", cfg.Port)
-	serverTCP, err := p.Next(ctx, pool.TypeSSH)
-	if err != nil {
-		return
+// sessionTimeouts returns the timeouts of a session on the workflow's runners
+// that is limited by lease.
+func sessionTimeouts(w config.Workflow, lease *quota.Lease) timeouts {
+	t := timeouts{
+		idle:     time.Duration(w.Timeouts.Idle),
+		deadline: lease.Deadline,
+		warnings: w.Timeouts.WarningDurations(),
 	}
-	defer serverTCP.Close()
 
-	log.InfoContext(ctx, "Creating SSH server")
-	serverSSH, serverChans, serverReqs, err := ssh.NewServerConn(serverTCP, cfg.Server)
-	if err != nil {
-		log.ErrorContext(ctx, "Failed to create SSH server", "error", err)
-		return
+	if w.Timeouts.Max > 0 {
+		deadline := time.Now().Add(time.Duration(w.Timeouts.Max))
+		if t.deadline.IsZero() || deadline.Before(t.deadline) {
+			t.deadline = deadline
+		}
 	}
-	go ssh.DiscardRequests(serverReqs)
 
-	log.InfoContext(ctx, "SSH connection established", "user", serverSSH.User())
+	return t
+}
 
-	w, ok := cfg.Workflows[serverSSH.User()]
-	if !ok {
-		log.ErrorContext(ctx, "No workflow found for user", "user", serverSSH.User())
-		return
+// ended returns why the session ended, if it did not just end with the
+// connection.
+func ended(ctx context.Context) error {
+	cause := context.Cause(ctx)
+	if errors.Is(cause, context.Canceled) {
+		return nil
 	}
 
-	log.InfoContext(ctx, "Starting workflow")
-	err = gh.Workflow(ctx, w.ID, w.Owner, w.Repository, w.Ref, w.RunsOn, fmt.Sprintf("%s:%d", cfg.Host, cfg.Port))
-	if err != nil {
-		log.ErrorContext(ctx, "Failed to start workflow", "error", err)
-		return
-	}
+	return cause
+}
 
-	log.InfoContext(ctx, "Waiting for TCP connection")
-	var clientTCP net.Conn
-	clientTCP, err = p.Next(ctx, pool.TypeTCP)
-	if err != nil {
-		return
-	}
-	defer clientTCP.Close()
+// waited reports whether the session ended while the user waited for a
+// runner, which the user is told about on a held channel.
+func waited(cause error) bool {
+	var runErr *runError
+	return errors.Is(cause, errLeft) || errors.Is(cause, errDisconnected) || errors.Is(cause, errRestart) ||
+		errors.As(cause, &runErr)
+}
 
-	log.InfoContext(ctx, "Creating SSH client")
-	clientSSH, clientChans, clientReqs, err := ssh.NewClientConn(clientTCP, "localhost:22", cfg.Client)
-	if err != nil {
-		log.ErrorContext(ctx, "Failed to create SSH client", "error", err)
-		return
-	}
-	client := ssh.NewClient(clientSSH, clientChans, clientReqs)
+// cancelRun reports whether the workflow run of a session that ended with
+// cause is to be cancelled, which is when it ended early but not with the run.
+func cancelRun(cause error) bool {
+	var runErr *runError
+	return cause != nil && !errors.Is(cause, context.Canceled) &&
+		!errors.As(cause, &runErr) && !errors.Is(cause, errRunCancelled)
+}
 
-	log.InfoContext(ctx, "Connecting server to client")
-	channel(ctx, serverChans, client)
+// subjects returns the user and groups whose limits apply to a session.
+func subjects(cfg *config.Config, user string, perms *ssh.Permissions) []quota.Subject {
+	subjects := []quota.Subject{{Name: user, Limits: cfg.UserLimits(user)}}
+	for _, group := range config.Groups(perms) {
+		subjects = append(subjects, quota.Subject{Name: "@" + group, Limits: cfg.GroupLimits(group)})
+	}
 
-	log.InfoContext(ctx, "Connection terminated")
+	return subjects
 }
 
-func channel(ctx context.Context, channels <-chan ssh.NewChannel, client *ssh.Client) {
+func channel(ctx context.Context, channels <-chan ssh.NewChannel, s *session) {
 	log := logger.FromContext(ctx)
 
 	for channel := range channels {
 		go func() {
-			err := pipe(ctx, channel, client)
+			err := pipe(ctx, channel, s)
 			if err != nil {
 				log.ErrorContext(ctx, "Failed to pipe channel", "error", err)
 			}
@@ -129,33 +326,98 @@ func channel(ctx context.Context, channels <-chan ssh.NewChannel, client *ssh.Cl
 }
 
 // pipe SSH channel from server to client.
-func pipe(ctx context.Context, channel ssh.NewChannel, client *ssh.Client) error {
+func pipe(ctx context.Context, channel ssh.NewChannel, s *session) error {
 	log := logger.FromContext(ctx)
 
-	if t := channel.ChannelType(); t != "session" {
-		err := channel.Reject(ssh.UnknownChannelType, fmt.Sprintf("unknown channel type: %s", t))
-		if err != nil {
-			log.WarnContext(ctx, "Could not reject channel", "error", err)
+	forward, reason, err := permitChannel(s.perms, channel)
+	if err != nil {
+		s.audit.Log(ctx, audit.Event{
+			Event:   audit.ChannelReject,
+			Channel: channel.ChannelType(),
+			Forward: forward,
+			Reason:  err.Error(),
+		})
+
+		rejectErr := channel.Reject(reason, err.Error())
+		if rejectErr != nil {
+			log.WarnContext(ctx, "Could not reject channel", "error", rejectErr)
 		}
 
-		return errors.New("unknown channel type")
+		return err
 	}
 
-	serverChannel, serverReqs, err := channel.Accept()
+	clientChannel, clientReqs, err := s.client.OpenChannel(channel.ChannelType(), channel.ExtraData())
 	if err != nil {
-		log.ErrorContext(ctx, "Could not accept channel", "error", err)
+		log.ErrorContext(ctx, "Could not open channel on runner", "type", channel.ChannelType(), "error", err)
+
+		reason = ssh.ConnectionFailed
+		var openErr *ssh.OpenChannelError
+		if errors.As(err, &openErr) {
+			reason = openErr.Reason
+		}
+
+		rejectErr := channel.Reject(reason, err.Error())
+		if rejectErr != nil {
+			log.WarnContext(ctx, "Could not reject channel", "error", rejectErr)
+		}
+
 		return err
 	}
 
-	clientChannel, clientReqs, err := client.OpenChannel("session", nil)
+	serverChannel, serverReqs, err := channel.Accept()
 	if err != nil {
-		log.ErrorContext(ctx, "Could not create ssh session", "error", err)
+		log.ErrorContext(ctx, "Could not accept channel", "error", err)
+		_ = clientChannel.Close()
 		return err
 	}
 
+	relay(ctx, s, link{
+		channelType: channel.ChannelType(),
+		forward:     forward,
+		server:      serverChannel,
+		serverReqs:  serverReqs,
+		input:       serverChannel,
+		client:      clientChannel,
+		clientReqs:  clientReqs,
+	})
+
+	return nil
+}
+
+// link is an accepted channel of the user joined with its channel on the runner.
+// The user's input is read from input rather than the channel itself.
+type link struct {
+	channelType string
+	forward     string
+	server      ssh.Channel
+	serverReqs  <-chan *ssh.Request
+	input       io.Reader
+	client      ssh.Channel
+	clientReqs  <-chan *ssh.Request
+}
+
+// relay pipes the channels of a link until either side closes its channel.
+func relay(ctx context.Context, s *session, l link) {
+	log := logger.FromContext(ctx)
+	serverChannel, serverReqs := l.server, l.serverReqs
+	clientChannel, clientReqs := l.client, l.clientReqs
+	forward := l.forward
+
+	s.audit.Log(ctx, audit.Event{Event: audit.ChannelOpen, Channel: l.channelType, Forward: forward})
+	metrics.Channels.Inc(l.channelType)
+	defer metrics.Channels.Dec(l.channelType)
+	var cast *recording.Cast
+	if l.channelType == "session" {
+		cast = s.recorder.Cast()
+		untrack := s.track(serverChannel)
+		defer untrack()
+	}
+	var in, out int64
+	var exitStatus *uint32
+
 	// Cleanup function
 	cleanup := func() {
-		err = clientChannel.Close()
+		err := clientChannel.Close()
 		if err != nil && !errors.Is(err, io.EOF) {
 			log.WarnContext(ctx, "Could not close client", "error", err)
 		}
@@ -164,49 +426,131 @@ func pipe(ctx context.Context, channel ssh.NewChannel, client *ssh.Client) error
 		if err != nil && !errors.Is(err, io.EOF) {
 			log.WarnContext(ctx, "Could not close server", "error", err)
 		}
+
+		err = cast.Close()
+		if err != nil {
+			log.WarnContext(ctx, "Could not close recording", "error", err)
+		}
 	}
 
-	// Pipe channels
+	// Pipe channels, passing on EOF in each direction and closing
+	// both once either side closes its channel
 	wg := sync.WaitGroup{}
 	once := sync.Once{}
+	output := sync.WaitGroup{}
 
-	wg.Go(func() {
-		_, err = io.Copy(serverChannel, clientChannel)
+	output.Go(func() {
+		var err error
+		out, err = io.Copy(io.MultiWriter(serverChannel, cast, &s.activity, &s.out), clientChannel)
 		if err != nil {
 			log.WarnContext(ctx, "Error copying from server to client", "error", err)
 		}
+	})
 
-		once.Do(cleanup)
+	output.Go(func() {
+		_, err := io.Copy(serverChannel.Stderr(), clientChannel.Stderr())
+		if err != nil {
+			log.WarnContext(ctx, "Error copying stderr from server to client", "error", err)
+		}
 	})
 
 	wg.Go(func() {
-		_, err = io.Copy(clientChannel, serverChannel)
+		output.Wait()
+
+		err := serverChannel.CloseWrite()
+		if err != nil && !errors.Is(err, io.EOF) {
+			log.DebugContext(ctx, "Could not send EOF to server", "error", err)
+		}
+	})
+
+	wg.Go(func() {
+		var err error
+		in, err = io.Copy(io.MultiWriter(clientChannel, &s.activity, &s.in), l.input)
 		if err != nil {
 			log.WarnContext(ctx, "Error copying from client to server", "error", err)
 		}
 
-		once.Do(cleanup)
+		err = clientChannel.CloseWrite()
+		if err != nil && !errors.Is(err, io.EOF) {
+			log.DebugContext(ctx, "Could not send EOF to client", "error", err)
+		}
 	})
 
 	wg.Go(func() {
-		request(ctx, clientChannel, serverReqs)
+		request(ctx, clientChannel, serverReqs, func(req *ssh.Request) bool {
+			event, ok := requestEvent(l.channelType, req)
+			allowed := restrict(ctx, s.perms, clientChannel, req)
+			if allowed {
+				record(ctx, cast, req)
+			} else {
+				event.Reason = "not permitted"
+			}
+
+			if ok {
+				s.audit.Log(ctx, event)
+			}
+
+			return allowed
+		})
+
+		once.Do(cleanup)
 	})
 
 	wg.Go(func() {
-		request(ctx, serverChannel, clientReqs)
+		request(ctx, serverChannel, clientReqs, func(req *ssh.Request) bool {
+			if status, ok := parseExitStatus(req); ok {
+				exitStatus = &status
+			}
+
+			return true
+		})
+
+		// deliver the remaining output before closing
+		output.Wait()
+		once.Do(cleanup)
 	})
 
 	wg.Wait()
-	return nil
+
+	s.audit.Transferred(in, out)
+	metrics.Bytes.Add(float64(in), s.target, "in")
+	metrics.Bytes.Add(float64(out), s.target, "out")
+	s.audit.Log(ctx, audit.Event{
+		Event:      audit.ChannelClose,
+		Channel:    l.channelType,
+		Forward:    forward,
+		BytesIn:    in,
+		BytesOut:   out,
+		ExitStatus: exitStatus,
+	})
 }
 
-// request forwards SSH requests between server and client channels.
-func request(ctx context.Context, channel ssh.Channel, requests <-chan *ssh.Request) {
+// request forwards SSH requests between server and client channels,
+// passing each request to hook first if it is set. Requests the hook
+// returns false for are refused instead of forwarded.
+func request(
+	ctx context.Context,
+	channel ssh.Channel,
+	requests <-chan *ssh.Request,
+	hook func(*ssh.Request) bool,
+) {
 	log := logger.FromContext(ctx)
 
 	for req := range requests {
 		log.DebugContext(ctx, "Sending request", "type", req.Type)
 
+		if hook != nil && !hook(req) {
+			log.InfoContext(ctx, "Refusing request", "type", req.Type)
+			if req.WantReply {
+				err := req.Reply(false, nil)
+				if err != nil {
+					log.ErrorContext(ctx, "Error replying to server request", "error", err)
+				}
+			}
+
+			continue
+		}
+
 		var reply bool
 		reply, err := channel.SendRequest(req.Type, req.WantReply, req.Payload)
 		if err != nil {
@@ -0,0 +1,109 @@
+// Package metrics exposes the broker's behavior to Prometheus. Labels only
+// take values from a bounded set, targets are those of the config and
+// reasons are fixed strings, so that the number of series stays small.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/trunners/runners/logger"
+)
+
+// seconds are the buckets of durations in seconds, from a second to a day.
+var seconds = []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600, 7200, 14400, 28800, 86400}
+
+var (
+	// Connections counts SSH connections by result, accepted or rejected, and
+	// the reason they were rejected for.
+	Connections = NewCounter(
+		"runners_ssh_connections_total",
+		"SSH connections by result and reason.",
+		"result", "reason",
+	)
+
+	// Dispatches observes how long dispatching a workflow took per target.
+	Dispatches = NewHistogram(
+		"runners_dispatch_duration_seconds",
+		"Time taken to dispatch a workflow.",
+		[]float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+		"target",
+	)
+
+	// DispatchFailures counts workflows that could not be dispatched per target.
+	DispatchFailures = NewCounter(
+		"runners_dispatch_failures_total",
+		"Workflows that could not be dispatched.",
+		"target",
+	)
+
+	// Callbacks observes the time from dispatch until the runner called back.
+	Callbacks = NewHistogram(
+		"runners_runner_callback_seconds",
+		"Time from dispatching a workflow until its runner called back.",
+		seconds,
+		"target",
+	)
+
+	// PoolDepth is the number of connections waiting in the pool per protocol.
+	PoolDepth = NewGauge(
+		"runners_pool_connections",
+		"Connections waiting in the pool.",
+		"protocol",
+	)
+
+	// PoolDrops counts connections closed because the pool was full.
+	PoolDrops = NewCounter(
+		"runners_pool_dropped_total",
+		"Connections closed because the pool was full.",
+		"protocol",
+	)
+
+	// Refused counts connections closed by the pool per protocol and reason:
+	// throttled, denied, malformed or tokenless.
+	Refused = NewCounter(
+		"runners_connections_refused_total",
+		"Connections refused by the pool.",
+		"protocol", "reason",
+	)
+
+	// Sessions is the number of active sessions per target.
+	Sessions = NewGauge(
+		"runners_sessions_active",
+		"Active sessions.",
+		"target",
+	)
+
+	// Channels is the number of open channels per channel type.
+	Channels = NewGauge(
+		"runners_channels_active",
+		"Open channels.",
+		"type",
+	)
+
+	// Bytes counts bytes relayed per target, in from users and out to them.
+	Bytes = NewCounter(
+		"runners_relayed_bytes_total",
+		"Bytes relayed between users and runners.",
+		"target", "direction",
+	)
+
+	// SessionDurations observes how long sessions lasted per target.
+	SessionDurations = NewHistogram(
+		"runners_session_duration_seconds",
+		"Duration of sessions.",
+		seconds,
+		"target",
+	)
+)
+
+// Handler writes all metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+		err := Write(w)
+		if err != nil {
+			logger.FromContext(r.Context()).WarnContext(r.Context(), "Could not write metrics", "error", err)
+		}
+	})
+}
@@ -0,0 +1,253 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// escape escapes label values.
+var escape = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// registry holds all metrics in the order they were created.
+var registry struct {
+	mu       sync.Mutex
+	families []*family
+}
+
+// family is a metric with one series per combination of label values.
+type family struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	// buckets are the upper bounds of a histogram's buckets
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+// series is a metric with its label values, computed by f if it is set.
+type series struct {
+	values []string
+	value  float64
+	f      func() float64
+
+	// histograms only
+	counts []uint64
+	sum    float64
+}
+
+func newFamily(name, help, kind string, labels []string) *family {
+	f := &family{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		series: map[string]*series{},
+	}
+
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	registry.families = append(registry.families, f)
+
+	return f
+}
+
+// get returns the series for the label values, creating it if needed.
+// Callers must hold f.mu.
+func (f *family) get(values []string) *series {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s: expected %d label values, got %d", f.name, len(f.labels), len(values)))
+	}
+
+	key := strings.Join(values, "\x00")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{values: slices.Clone(values)}
+		f.series[key] = s
+	}
+
+	return s
+}
+
+// Counter is a value that only goes up.
+type Counter struct {
+	family *family
+}
+
+// NewCounter creates a counter with the given label names.
+func NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{family: newFamily(name, help, "counter", labels)}
+}
+
+// Inc adds one to the series with the label values.
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds v to the series with the label values.
+func (c *Counter) Add(v float64, values ...string) {
+	c.family.mu.Lock()
+	defer c.family.mu.Unlock()
+
+	c.family.get(values).value += v
+}
+
+// Gauge is a value that goes up and down.
+type Gauge struct {
+	family *family
+}
+
+// NewGauge creates a gauge with the given label names.
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{family: newFamily(name, help, "gauge", labels)}
+}
+
+// Inc adds one to the series with the label values.
+func (g *Gauge) Inc(values ...string) {
+	g.Add(1, values...)
+}
+
+// Dec subtracts one from the series with the label values.
+func (g *Gauge) Dec(values ...string) {
+	g.Add(-1, values...)
+}
+
+// Add adds v to the series with the label values.
+func (g *Gauge) Add(v float64, values ...string) {
+	g.family.mu.Lock()
+	defer g.family.mu.Unlock()
+
+	g.family.get(values).value += v
+}
+
+// Func computes the series with the label values when metrics are collected.
+func (g *Gauge) Func(f func() float64, values ...string) {
+	g.family.mu.Lock()
+	defer g.family.mu.Unlock()
+
+	g.family.get(values).f = f
+}
+
+// Histogram counts observations in buckets.
+type Histogram struct {
+	family *family
+}
+
+// NewHistogram creates a histogram with the given upper bounds of its
+// buckets, in ascending order, and label names.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	f := newFamily(name, help, "histogram", labels)
+	f.buckets = buckets
+
+	return &Histogram{family: f}
+}
+
+// Observe adds v to the series with the label values.
+func (h *Histogram) Observe(v float64, values ...string) {
+	h.family.mu.Lock()
+	defer h.family.mu.Unlock()
+
+	s := h.family.get(values)
+	if s.counts == nil {
+		s.counts = make([]uint64, len(h.family.buckets)+1)
+	}
+
+	i, _ := slices.BinarySearch(h.family.buckets, v)
+	s.counts[i]++
+	s.sum += v
+}
+
+// Write writes all metrics in the Prometheus text format.
+func Write(w io.Writer) error {
+	registry.mu.Lock()
+	families := slices.Clone(registry.families)
+	registry.mu.Unlock()
+
+	var b strings.Builder
+	for _, f := range families {
+		f.write(&b)
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (f *family) write(b *strings.Builder) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fmt.Fprintf(b, "# HELP %s %s\n", f.name, f.help)
+	fmt.Fprintf(b, "# TYPE %s %s\n", f.name, f.kind)
+
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		s := f.series[key]
+		if f.kind != "histogram" {
+			value := s.value
+			if s.f != nil {
+				value = s.f()
+			}
+			fmt.Fprintf(b, "%s%s %s\n", f.name, labels(f.labels, s.values, "", ""), number(value))
+			continue
+		}
+
+		if s.counts == nil {
+			continue
+		}
+
+		var count uint64
+		for i, n := range s.counts {
+			count += n
+			le := math.Inf(1)
+			if i < len(f.buckets) {
+				le = f.buckets[i]
+			}
+			fmt.Fprintf(b, "%s_bucket%s %d\n", f.name, labels(f.labels, s.values, "le", number(le)), count)
+		}
+		fmt.Fprintf(b, "%s_sum%s %s\n", f.name, labels(f.labels, s.values, "", ""), number(s.sum))
+		fmt.Fprintf(b, "%s_count%s %d\n", f.name, labels(f.labels, s.values, "", ""), count)
+	}
+}
+
+// labels formats label names and values, with an extra label if name is set.
+func labels(names, values []string, name, value string) string {
+	if name != "" {
+		names = append(slices.Clone(names), name)
+		values = append(slices.Clone(values), value)
+	}
+	if len(names) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, 0, len(names))
+	for i, name := range names {
+		pairs = append(pairs, name+`="`+escape.Replace(values[i])+`"`)
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// number formats a value like Prometheus does.
+func number(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
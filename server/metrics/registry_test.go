@@ -0,0 +1,130 @@
+package metrics
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	tests := []struct {
+		name    string
+		observe func() *family
+		want    string
+	}{
+		{
+			name: "counter without labels",
+			observe: func() *family {
+				c := NewCounter("test_total", "Counts.")
+				c.Inc()
+				c.Add(1.5)
+				return c.family
+			},
+			want: `# HELP test_total Counts.
+# TYPE test_total counter
+test_total 2.5
+`,
+		},
+		{
+			name: "series sorted by label values",
+			observe: func() *family {
+				c := NewCounter("test_labeled_total", "Counts by result.", "result", "reason")
+				c.Inc("rejected", "limit reached")
+				c.Inc("accepted", "")
+				c.Inc("rejected", "limit reached")
+				return c.family
+			},
+			want: `# HELP test_labeled_total Counts by result.
+# TYPE test_labeled_total counter
+test_labeled_total{result="accepted",reason=""} 1
+test_labeled_total{result="rejected",reason="limit reached"} 2
+`,
+		},
+		{
+			name: "escaped label values",
+			observe: func() *family {
+				c := NewCounter("test_escaped_total", "Counts.", "target")
+				c.Inc("a\"b\\c\nd")
+				return c.family
+			},
+			want: `# HELP test_escaped_total Counts.
+# TYPE test_escaped_total counter
+test_escaped_total{target="a\"b\\c\nd"} 1
+`,
+		},
+		{
+			name: "gauge",
+			observe: func() *family {
+				g := NewGauge("test_sessions", "Sessions.", "target")
+				g.Inc("ubuntu")
+				g.Inc("ubuntu")
+				g.Dec("ubuntu")
+				g.Func(func() float64 { return math.Inf(1) }, "darwin")
+				return g.family
+			},
+			want: `# HELP test_sessions Sessions.
+# TYPE test_sessions gauge
+test_sessions{target="darwin"} +Inf
+test_sessions{target="ubuntu"} 1
+`,
+		},
+		{
+			name: "histogram",
+			observe: func() *family {
+				h := NewHistogram("test_seconds", "Durations.", []float64{1, 10}, "target")
+				h.Observe(0.5, "ubuntu")
+				h.Observe(1, "ubuntu")
+				h.Observe(5, "ubuntu")
+				h.Observe(60, "ubuntu")
+				return h.family
+			},
+			want: `# HELP test_seconds Durations.
+# TYPE test_seconds histogram
+test_seconds_bucket{target="ubuntu",le="1"} 2
+test_seconds_bucket{target="ubuntu",le="10"} 3
+test_seconds_bucket{target="ubuntu",le="+Inf"} 4
+test_seconds_sum{target="ubuntu"} 66.5
+test_seconds_count{target="ubuntu"} 4
+`,
+		},
+		{
+			name: "histogram without observations",
+			observe: func() *family {
+				return NewHistogram("test_empty_seconds", "Durations.", []float64{1}).family
+			},
+			want: `# HELP test_empty_seconds Durations.
+# TYPE test_empty_seconds histogram
+`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var b strings.Builder
+			test.observe().write(&b)
+
+			if got := b.String(); got != test.want {
+				t.Errorf("got\n%s\nwant\n%s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestWriteAll(t *testing.T) {
+	NewCounter("test_registered_total", "Counts.").Inc()
+
+	var b strings.Builder
+	err := Write(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the metrics of the broker come first, in the order they were created
+	got := b.String()
+	if !strings.Contains(got, "\ntest_registered_total 1\n") {
+		t.Errorf("missing a registered counter in\n%s", got)
+	}
+	if strings.Index(got, "# TYPE "+Connections.family.name) > strings.Index(got, "test_registered_total") {
+		t.Error("wrote the metrics out of order")
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/trunners/runners/server/config"
+	"github.com/trunners/runners/server/quota"
+)
+
+// pickTimeout limits how long a user may take to pick a target.
+const pickTimeout = 5 * time.Minute
+
+const (
+	escape = 0x1b
+	ctrlD  = 0x04
+)
+
+var errPickTimeout = errors.New("no target picked in time")
+
+// choice is a target offered by the picker.
+type choice struct {
+	name     string
+	platform string
+	wait     time.Duration
+	left     time.Duration
+	limited  bool
+}
+
+// picked is the target a user picked and the channel they picked it on,
+// held until the runner is ready.
+type picked struct {
+	target string
+	held   *held
+}
+
+// choices returns the targets the user may launch and is not drained of,
+// with their platforms, expected waits and the runner time left on them.
+// Targets that require parameters cannot be picked and are left out.
+func choices(cfg *config.Config, q *quota.Quota, active *sessions, user string, perms *ssh.Permissions) []choice {
+	left, limited := q.Remaining(subjects(cfg, user, perms))
+
+	var list []choice
+	for _, name := range strings.Split(perms.Extensions[config.ExtensionTargets], ",") {
+		w, ok := cfg.Workflows[name]
+		if !ok || active.draining(name) {
+			continue
+		}
+
+		target, err := w.Target(name, nil)
+		if err != nil {
+			continue
+		}
+
+		platform := w.RunsOn
+		if os, arch := w.Tags["os"], w.Tags["arch"]; os != "" && arch != "" {
+			platform = os + "/" + arch
+		}
+
+		list = append(list, choice{
+			name:     name,
+			platform: platform,
+			wait:     q.Expected(launchRequest(cfg, user, perms, target)),
+			left:     time.Duration(float64(left) / w.Weight()),
+			limited:  limited,
+		})
+	}
+
+	return list
+}
+
+// pick shows the choices on the held channel and lets the user move through
+// them with the arrow keys and launch one with Enter. It fails if the user
+// quits with q, Ctrl-C or Ctrl-D, leaves, disconnects or takes longer than
+// pickTimeout.
+func pick(ctx context.Context, h *held, list []choice) (string, error) {
+	ctx, cancel := context.WithTimeoutCause(ctx, pickTimeout, errPickTimeout)
+	defer cancel()
+
+	// Stop reading input once the pick is over, the input is left to the runner otherwise
+	stop := context.AfterFunc(ctx, func() {
+		h.input.CloseWithError(context.Cause(ctx))
+	})
+	defer stop()
+
+	selected := 0
+	render(h, list, selected, false)
+
+	buf := make([]byte, 64) //nolint:mnd // a few keys at a time
+	for {
+		n, err := h.input.Read(buf)
+		if err != nil {
+			if cause := context.Cause(ctx); cause != nil {
+				err = cause
+			}
+			return "", err
+		}
+
+		for keys := buf[:n]; len(keys) > 0; {
+			var key string
+			key, keys = nextKey(keys)
+
+			switch key {
+			case "up", "k":
+				selected = (selected + len(list) - 1) % len(list)
+			case "down", "j":
+				selected = (selected + 1) % len(list)
+			case "enter":
+				if !stop() {
+					return "", context.Cause(ctx)
+				}
+				_, _ = h.channel.Write([]byte("\r\n"))
+				return list[selected].name, nil
+			case "q", string(rune(ctrlC)), string(rune(ctrlD)):
+				return "", errLeft
+			}
+		}
+
+		render(h, list, selected, true)
+	}
+}
+
+// nextKey splits the first key off the input: an arrow key, Enter, or a
+// single other byte.
+func nextKey(input []byte) (string, []byte) {
+	if len(input) >= 3 && input[0] == escape && (input[1] == '[' || input[1] == 'O') {
+		switch input[2] {
+		case 'A':
+			return "up", input[3:]
+		case 'B':
+			return "down", input[3:]
+		}
+		return "", input[3:]
+	}
+
+	if input[0] == '\r' || input[0] == '\n' {
+		return "enter", input[1:]
+	}
+
+	return string(input[:1]), input[1:]
+}
+
+// render draws the choices with the selected one highlighted, over those
+// drawn before if redraw is set.
+func render(h *held, list []choice, selected int, redraw bool) {
+	rows := make([][]string, 0, len(list))
+	for _, c := range list {
+		wait := "unknown wait"
+		if c.wait > 0 {
+			wait = "about " + max(c.wait.Round(time.Second), time.Second).String()
+		}
+
+		left := "no limit"
+		if c.limited {
+			left = c.left.Round(time.Minute).String() + " left"
+		}
+
+		rows = append(rows, []string{c.name, c.platform, wait, left})
+	}
+
+	widths := make([]int, 4) //nolint:mnd // the columns above
+	for _, row := range rows {
+		for i, cell := range row {
+			widths[i] = max(widths[i], len(cell))
+		}
+	}
+
+	var b strings.Builder
+	if redraw {
+		fmt.Fprintf(&b, "\033[%dA", len(rows))
+	} else {
+		b.WriteString("Pick a target with the arrow keys and press Enter to launch it, or q to quit.\r\n\r\n")
+	}
+
+	for i, cells := range rows {
+		for j := range cells {
+			cells[j] = fmt.Sprintf("%-*s", widths[j], cells[j])
+		}
+
+		line := "  " + strings.Join(cells, "   ")
+		if i == selected {
+			line = "\033[7m> " + strings.Join(cells, "   ") + "\033[m"
+		}
+		b.WriteString("\r\033[K" + line + "\r\n")
+	}
+
+	_, _ = h.channel.Write([]byte(b.String()))
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestNextKey(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []string
+	}{
+		{name: "arrows", input: "\x1b[A\x1b[B", want: []string{"up", "down"}},
+		{name: "application mode arrows", input: "\x1bOA\x1bOB", want: []string{"up", "down"}},
+		{name: "other escape sequence", input: "\x1b[Cq", want: []string{"", "q"}},
+		{name: "enter", input: "\r\n", want: []string{"enter", "enter"}},
+		{name: "letters", input: "jq", want: []string{"j", "q"}},
+		{name: "control characters", input: "\x03\x04", want: []string{"\x03", "\x04"}},
+		{name: "lone escape", input: "\x1b", want: []string{"\x1b"}},
+		{name: "escape cut off", input: "\x1b[", want: []string{"\x1b", "["}},
+		{name: "mixed", input: "\x1b[Bx\r", want: []string{"down", "x", "enter"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got []string
+			for input := []byte(test.input); len(input) > 0; {
+				var key string
+				key, input = nextKey(input)
+				got = append(got, key)
+			}
+
+			if !slices.Equal(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
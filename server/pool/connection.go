@@ -4,6 +4,8 @@ import (
 	"bufio"
 	"io"
 	"net"
+
+	"github.com/trunners/runners/callback"
 )
 
 type ConnectionProtocol int
@@ -11,21 +13,39 @@ type ConnectionProtocol int
 const (
 	TypeTCP ConnectionProtocol = iota
 	TypeSSH
+	TypeHTTP
+	TypeTLS
 )
 
 type Connection struct {
 	net.Conn
 
 	Protocol ConnectionProtocol
+	Runner   callback.Runner
 	r        *bufio.Reader
+
+	// Client is the address a trusted proxy accepted the connection from.
+	Client net.Addr
 }
 
 func newConnection(c net.Conn) Connection {
 	return Connection{
 		c,
 		TypeTCP,
+		callback.Runner{},
 		bufio.NewReader(c),
+		nil,
+	}
+}
+
+// RemoteAddr returns the address of the client, rather than that of the
+// proxy in front of the broker.
+func (b Connection) RemoteAddr() net.Addr {
+	if b.Client != nil {
+		return b.Client
 	}
+
+	return b.Conn.RemoteAddr()
 }
 
 func (b Connection) Peek(n int) ([]byte, error) {
@@ -50,6 +70,10 @@ func (b Connection) Type() string {
 	switch b.Protocol {
 	case TypeSSH:
 		return "SSH"
+	case TypeHTTP:
+		return "HTTP"
+	case TypeTLS:
+		return "TLS"
 	case TypeTCP:
 		fallthrough
 	default:
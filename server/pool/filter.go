@@ -0,0 +1,50 @@
+package pool
+
+import (
+	"net"
+	"net/netip"
+	"slices"
+
+	"github.com/trunners/runners/server/throttle"
+)
+
+// Options configure which connections the pool accepts.
+type Options struct {
+	// Proxies may start connections with a PROXY protocol header.
+	Proxies []netip.Prefix
+	// SSH filters the clients of SSH connections.
+	SSH Filter
+	// Runners filters the addresses runners call back from.
+	Runners Filter
+	// Throttle refuses addresses that keep failing handshakes.
+	Throttle *throttle.Throttle
+}
+
+// Filter permits addresses in Allow, or any address if it is empty, unless
+// they are in Deny.
+type Filter struct {
+	Allow []netip.Prefix
+	Deny  []netip.Prefix
+}
+
+// Permits reports whether addr may connect.
+func (f Filter) Permits(addr net.Addr) bool {
+	if len(f.Allow) == 0 && len(f.Deny) == 0 {
+		return true
+	}
+
+	return !contains(f.Deny, addr) && (len(f.Allow) == 0 || contains(f.Allow, addr))
+}
+
+// contains reports whether addr is in one of the prefixes.
+func contains(prefixes []netip.Prefix, addr net.Addr) bool {
+	addrPort, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return false
+	}
+
+	ip := addrPort.Addr().Unmap()
+	return slices.ContainsFunc(prefixes, func(prefix netip.Prefix) bool {
+		return prefix.Contains(ip)
+	})
+}
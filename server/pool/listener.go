@@ -0,0 +1,64 @@
+package pool
+
+import (
+	"net"
+	"sync"
+)
+
+// listener hands connections sniffed by the pool to a server, such as an
+// http.Server, as if they were accepted from a listener of their own.
+type listener struct {
+	addr  net.Addr
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newListener(addr net.Addr) *listener {
+	return &listener{
+		addr:  addr,
+		conns: make(chan net.Conn, 10), //nolint:mnd // buffer size 10
+		done:  make(chan struct{}),
+	}
+}
+
+// Accept returns the next connection handed to the listener.
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case <-l.done:
+		return nil, net.ErrClosed
+	case conn := <-l.conns:
+		return conn, nil
+	}
+}
+
+// Close stops accepting connections, the pool then closes them instead.
+func (l *listener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+	})
+
+	return nil
+}
+
+// Addr returns the address of the pool's listener.
+func (l *listener) Addr() net.Addr {
+	return l.addr
+}
+
+// hand passes a connection to the server, returning false if it is closed
+// or too busy to take it.
+func (l *listener) hand(conn net.Conn) bool {
+	select {
+	case <-l.done:
+		return false
+	default:
+	}
+
+	select {
+	case l.conns <- conn:
+		return true
+	default:
+		return false
+	}
+}
@@ -3,49 +3,111 @@ package pool
 import (
 	"context"
 	"errors"
-	"fmt"
 	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/trunners/runners/callback"
 	"github.com/trunners/runners/logger"
+	"github.com/trunners/runners/server/metrics"
+	"github.com/trunners/runners/server/throttle"
 )
 
+// The first bytes of a TLS ClientHello are the handshake record type and
+// the major version of TLS 1.x.
+const (
+	tlsHandshake    = 0x16
+	tlsMajorVersion = 0x03
+)
+
+// peekTimeout limits how long a new connection may take to send the bytes
+// that tell its protocol.
+const peekTimeout = 10 * time.Second
+
+// parkTimeout limits how long a runner is held for a session that does not
+// wait for it yet.
+const parkTimeout = time.Minute
+
+// httpMethods are the first bytes of HTTP requests.
+var httpMethods = []string{"GET", "HEA", "POS", "PUT", "DEL", "OPT", "PAT"}
+
 type Pool struct {
-	port     int
 	listener net.Listener
+	opts     Options
+
+	sshs chan Connection
 
-	tcps chan net.Conn
-	sshs chan net.Conn
+	mu      sync.Mutex
+	runners map[string]chan Connection
+	parked  map[string]parked
+	http    *listener
+	tls     *listener
 }
 
-func Start(ctx context.Context, port int) (*Pool, error) {
-	log := logger.FromContext(ctx)
+// State is what the pool holds.
+type State struct {
+	// SSH is the number of SSH connections waiting to be served.
+	SSH int `json:"ssh"`
+	// Waiting is the number of sessions waiting for their runner to call back.
+	Waiting int `json:"waiting"`
+	// Parked are the runners that called back before their session waited
+	// for them.
+	Parked []Parked `json:"parked"`
+}
 
-	cfg := net.ListenConfig{}
-	listener, err := cfg.Listen(ctx, "tcp", fmt.Sprintf(":%d", port))
-	if err != nil {
-		return nil, err
-	}
+// Parked is a runner connection held until the session it was dispatched for
+// takes it.
+type Parked struct {
+	// Runner is the identity of the runner, without its session token.
+	Runner callback.Runner `json:"runner"`
+	Remote string          `json:"remote"`
+	Since  time.Time       `json:"since"`
+}
 
+// parked is a runner connection held for the session token it sent.
+type parked struct {
+	connection Connection
+	since      time.Time
+}
+
+// Start accepts the connections permitted by opts on listener. Connections
+// from its proxies may start with a PROXY protocol header telling the
+// address of the client.
+func Start(ctx context.Context, listener net.Listener, opts Options) *Pool {
 	p := &Pool{
-		port:     port,
 		listener: listener,
-		tcps:     make(chan net.Conn, 10), //nolint:mnd // buffer size 10
-		sshs:     make(chan net.Conn, 10), //nolint:mnd // buffer size 10
+		opts:     opts,
+		sshs:     make(chan Connection, 10), //nolint:mnd // buffer size 10
+		runners:  map[string]chan Connection{},
+		parked:   map[string]parked{},
 	}
 
+	metrics.PoolDepth.Func(func() float64 { return float64(len(p.sshs)) }, "ssh")
+
 	// start listening for connections
 	go p.listen(ctx)
 
 	// close listener on context done
-	go func() {
-		<-ctx.Done()
-		err = p.listener.Close()
+	context.AfterFunc(ctx, func() {
+		err := p.Close()
 		if err != nil {
-			log.ErrorContext(ctx, "Could not close listener", "error", err)
+			logger.FromContext(ctx).ErrorContext(ctx, "Could not close listener", "error", err)
 		}
-	}()
+	})
+
+	return p
+}
 
-	return p, nil
+// Close stops accepting connections. Those accepted before stay in the pool.
+func (p *Pool) Close() error {
+	err := p.listener.Close()
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+
+	return err
 }
 
 func (p *Pool) listen(ctx context.Context) {
@@ -62,28 +124,90 @@ func (p *Pool) listen(ctx context.Context) {
 			continue
 		}
 
-		p.add(ctx, conn)
+		go p.add(ctx, conn)
+	}
+}
+
+// HTTP returns a listener for the HTTP connections to the pool's port.
+// They are closed unless it is called.
+func (p *Pool) HTTP() net.Listener {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.http == nil {
+		p.http = newListener(p.listener.Addr())
 	}
+
+	return p.http
+}
+
+// TLS returns a listener for the TLS connections to the pool's port, to be
+// wrapped by tls.NewListener. They are closed unless it is called.
+func (p *Pool) TLS() net.Listener {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.tls == nil {
+		p.tls = newListener(p.listener.Addr())
+	}
+
+	return p.tls
 }
 
 func (p *Pool) add(ctx context.Context, conn net.Conn) {
 	log := logger.FromContext(ctx)
+	opts := p.options()
 
 	connection := newConnection(conn)
 
+	_ = conn.SetReadDeadline(time.Now().Add(peekTimeout))
+	if contains(opts.Proxies, conn.RemoteAddr()) {
+		var err error
+		connection.Client, err = readProxy(connection.r)
+		if err != nil {
+			log.WarnContext(ctx, "Could not read PROXY header, closing connection", "proxy", conn.RemoteAddr(), "error", err)
+			_ = conn.Close()
+			return
+		}
+	}
+
+	if wait, ok := opts.Throttle.Allow(connection.RemoteAddr()); !ok {
+		log.InfoContext(ctx, "Refusing throttled connection", "remote", connection.RemoteAddr(), "wait", wait.Round(time.Second))
+		p.refuse(connection, "throttled")
+		return
+	}
+
 	test, err := connection.Peek(3) //nolint:mnd // peek at first 3 bytes to determine connection type
 	switch {
 	case err != nil:
-		log.WarnContext(ctx, "Could not peek connection", "error", err)
+		log.WarnContext(ctx, "Could not peek connection, closing it", "remote", connection.RemoteAddr(), "error", err)
+		p.fail(ctx, connection)
+		return
 	case string(test) == "SSH":
 		connection.Protocol = TypeSSH
-	case string(test) == "TCP":
+	case string(test) == callback.Preamble:
 		connection.Protocol = TypeTCP
 		_, err = connection.ReadBytes(3) //nolint:mnd // read the first 3 bytes to pop them
 		if err != nil {
 			log.WarnContext(ctx, "Could not read END bytes", "error", err)
 		}
+
+		connection.Runner, err = callback.Read(connection.r)
+		if err != nil {
+			log.WarnContext(ctx, "Could not read runner identity, closing connection", "remote", connection.RemoteAddr(), "error", err)
+			p.fail(ctx, connection)
+			return
+		}
+	case slices.Contains(httpMethods, string(test)):
+		connection.Protocol = TypeHTTP
+	case test[0] == tlsHandshake && test[1] == tlsMajorVersion:
+		connection.Protocol = TypeTLS
+	default:
+		log.WarnContext(ctx, "Unknown protocol, closing connection", "remote", connection.RemoteAddr())
+		p.fail(ctx, connection)
+		return
 	}
+	_ = conn.SetReadDeadline(time.Time{})
 
 	log.DebugContext(
 		ctx,
@@ -94,52 +218,207 @@ func (p *Pool) add(ctx context.Context, conn net.Conn) {
 		connection.RemoteAddr(),
 		"local",
 		connection.LocalAddr(),
+		"runner",
+		connection.Runner,
 	)
 
 	switch connection.Protocol {
+	case TypeHTTP, TypeTLS:
+		p.serve(ctx, connection)
+
 	case TypeSSH:
+		if !opts.SSH.Permits(connection.RemoteAddr()) {
+			log.WarnContext(ctx, "SSH client not permitted, closing connection", "remote", connection.RemoteAddr())
+			p.refuse(connection, "denied")
+			return
+		}
+
 		select {
 		case p.sshs <- connection:
 		default:
 			log.WarnContext(ctx, "SSH connection pool full, closing connection", "remote", connection.RemoteAddr())
+			metrics.PoolDrops.Inc("ssh")
 			_ = connection.Close()
 		}
 
 	case TypeTCP:
 		fallthrough
 	default:
+		if !opts.Runners.Permits(connection.RemoteAddr()) {
+			log.WarnContext(ctx, "Runner address not permitted, closing connection", "remote", connection.RemoteAddr(), "runner", connection.Runner)
+			p.refuse(connection, "denied")
+			return
+		}
+
+		// Only the session a runner was dispatched for may have it, so older
+		// runners that send no session token are refused
+		if connection.Runner.Session == "" {
+			log.WarnContext(ctx, "Runner called back without a session token, closing connection", "remote", connection.RemoteAddr(), "runner", connection.Runner)
+			p.refuse(connection, "tokenless")
+			return
+		}
+
+		p.runner(ctx, connection)
+	}
+}
+
+// fail closes a malformed connection, counting it against its client.
+func (p *Pool) fail(ctx context.Context, connection Connection) {
+	if p.Throttle().Fail(connection.RemoteAddr()) {
+		logger.FromContext(ctx).WarnContext(ctx, "Banning address", "remote", connection.RemoteAddr())
+	}
+	p.refuse(connection, "malformed")
+}
+
+// refuse closes a connection that is not accepted.
+func (p *Pool) refuse(connection Connection, reason string) {
+	metrics.Refused.Inc(strings.ToLower(connection.Type()), reason)
+	_ = connection.Close()
+}
+
+// Throttle returns the throttle of connections failing handshakes, if any.
+func (p *Pool) Throttle() *throttle.Throttle {
+	return p.options().Throttle
+}
+
+// Configure replaces the options of the pool for the connections accepted
+// from now on.
+func (p *Pool) Configure(opts Options) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.opts = opts
+}
+
+func (p *Pool) options() Options {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.opts
+}
+
+// serve hands an HTTP or TLS connection to its listener.
+func (p *Pool) serve(ctx context.Context, connection Connection) {
+	log := logger.FromContext(ctx)
+
+	p.mu.Lock()
+	l := p.http
+	if connection.Protocol == TypeTLS {
+		l = p.tls
+	}
+	p.mu.Unlock()
+
+	if l == nil || !l.hand(connection) {
+		log.WarnContext(ctx, "Not serving connection, closing it", "type", connection.Type(), "remote", connection.RemoteAddr())
+		metrics.PoolDrops.Inc(strings.ToLower(connection.Type()))
+		_ = connection.Close()
+	}
+}
+
+// runner hands a runner to the session it was dispatched for.
+func (p *Pool) runner(ctx context.Context, connection Connection) {
+	log := logger.FromContext(ctx)
+
+	token := connection.Runner.Session
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if runner, ok := p.runners[token]; ok {
 		select {
-		case p.tcps <- connection:
+		case runner <- connection:
 		default:
-			log.WarnContext(ctx, "TCP connection pool full, closing connection", "remote", connection.RemoteAddr())
+			log.WarnContext(ctx, "Session has a runner already, closing connection", "runner", connection.Runner)
 			_ = connection.Close()
 		}
+		return
 	}
-}
 
-// Next returns the next connection from the pool matching the given protocol.
-func (p *Pool) Next(ctx context.Context, protocol ConnectionProtocol) (net.Conn, error) {
-	for {
-		switch protocol {
-		case TypeSSH:
-			select {
-			case <-ctx.Done():
-				return nil, ctx.Err()
-
-			case connection := <-p.sshs:
-				return connection, nil
-			}
+	// The runner may call back before its session waits for it
+	if _, ok := p.parked[token]; ok {
+		log.WarnContext(ctx, "Runner of session parked already, closing connection", "runner", connection.Runner)
+		_ = connection.Close()
+		return
+	}
+	p.parked[token] = parked{connection: connection, since: time.Now()}
 
-		case TypeTCP:
-			fallthrough
-		default:
-			select {
-			case <-ctx.Done():
-				return nil, ctx.Err()
+	time.AfterFunc(parkTimeout, func() {
+		p.mu.Lock()
+		held, ok := p.parked[token]
+		if ok && held.connection.Conn == connection.Conn {
+			delete(p.parked, token)
+		}
+		p.mu.Unlock()
 
-			case connection := <-p.tcps:
-				return connection, nil
-			}
+		if ok && held.connection.Conn == connection.Conn {
+			log.WarnContext(ctx, "No session waiting for runner, closing connection", "runner", connection.Runner)
+			_ = connection.Close()
 		}
+	})
+}
+
+// Runner returns the runner calling back for the session with the given
+// token, or parked for it already.
+func (p *Pool) Runner(ctx context.Context, token string) (Connection, error) {
+	runner := make(chan Connection, 1)
+
+	p.mu.Lock()
+	held, ok := p.parked[token]
+	if ok {
+		delete(p.parked, token)
+		p.mu.Unlock()
+		return held.connection, nil
+	}
+	p.runners[token] = runner
+	p.mu.Unlock()
+
+	defer func() {
+		p.mu.Lock()
+		delete(p.runners, token)
+		p.mu.Unlock()
+	}()
+
+	select {
+	case <-ctx.Done():
+		return Connection{}, ctx.Err()
+	case connection := <-runner:
+		return connection, nil
+	}
+}
+
+// State returns what the pool holds.
+func (p *Pool) State() State {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	state := State{
+		SSH:     len(p.sshs),
+		Waiting: len(p.runners),
+		Parked:  make([]Parked, 0, len(p.parked)),
+	}
+	for _, held := range p.parked {
+		runner := held.connection.Runner
+		runner.Session = ""
+		state.Parked = append(state.Parked, Parked{
+			Runner: runner,
+			Remote: held.connection.RemoteAddr().String(),
+			Since:  held.since,
+		})
+	}
+	slices.SortFunc(state.Parked, func(a, b Parked) int {
+		return a.Since.Compare(b.Since)
+	})
+
+	return state
+}
+
+// Next returns the next SSH connection from the pool.
+func (p *Pool) Next(ctx context.Context) (Connection, error) {
+	select {
+	case <-ctx.Done():
+		return Connection{}, ctx.Err()
+
+	case connection := <-p.sshs:
+		return connection, nil
 	}
 }
@@ -0,0 +1,136 @@
+package pool
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// PROXY protocol headers, see https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt.
+const (
+	proxyV1Prefix    = "PROXY "
+	proxyV1MaxLength = 107
+	proxyV2Header    = 16
+
+	proxyV2Local  = 0x20
+	proxyV2Proxy  = 0x21
+	proxyV2TCP4   = 0x11
+	proxyV2TCP6   = 0x21
+	proxyV2IPv4   = 12
+	proxyV2IPv6   = 36
+	proxyV2Offset = 12
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var errProxyHeader = errors.New("invalid PROXY protocol header")
+
+// readProxy reads a PROXY protocol v1 or v2 header if the connection starts
+// with one, returning the address of the client it was proxied for. The
+// address is nil without a header or if the proxy does not tell it.
+func readProxy(r *bufio.Reader) (net.Addr, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	switch first[0] {
+	case proxyV1Prefix[0]:
+		prefix, err := r.Peek(len(proxyV1Prefix))
+		if err != nil || string(prefix) != proxyV1Prefix {
+			return nil, nil //nolint:nilerr // not a PROXY header
+		}
+
+		return readProxyV1(r)
+
+	case proxyV2Signature[0]:
+		signature, err := r.Peek(len(proxyV2Signature))
+		if err != nil || !bytes.Equal(signature, proxyV2Signature) {
+			return nil, nil //nolint:nilerr // not a PROXY header
+		}
+
+		return readProxyV2(r)
+
+	default:
+		return nil, nil
+	}
+}
+
+// readProxyV1 reads a header like "PROXY TCP4 192.0.2.1 192.0.2.2 56324 22\r\n".
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLength {
+			return nil, errProxyHeader
+		}
+
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || fields[1] != "TCP4" && fields[1] != "TCP6" { //nolint:mnd // PROXY, protocol, addresses and ports
+		return nil, errProxyHeader
+	}
+
+	addr, err := netip.ParseAddr(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errProxyHeader, err)
+	}
+
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errProxyHeader, err)
+	}
+
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(port))), nil
+}
+
+// readProxyV2 reads a binary header, skipping any TLVs after the addresses.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, proxyV2Header)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+
+	command, family := header[proxyV2Offset], header[proxyV2Offset+1]
+	length := int(binary.BigEndian.Uint16(header[proxyV2Offset+2:]))
+
+	body := make([]byte, length)
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case command == proxyV2Local:
+		return nil, nil
+	case command != proxyV2Proxy:
+		return nil, errProxyHeader
+	case family == proxyV2TCP4 && length >= proxyV2IPv4:
+		addr := netip.AddrFrom4([4]byte(body[0:4]))
+		port := binary.BigEndian.Uint16(body[8:10])
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, port)), nil
+	case family == proxyV2TCP6 && length >= proxyV2IPv6:
+		addr := netip.AddrFrom16([16]byte(body[0:16])).Unmap()
+		port := binary.BigEndian.Uint16(body[32:34])
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, port)), nil
+	default:
+		// other families such as UNIX sockets have no client address to tell
+		return nil, nil
+	}
+}
@@ -0,0 +1,112 @@
+package pool
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// proxyV2 returns a binary header with the given command, family and body.
+func proxyV2(command, family byte, body []byte) string {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, command, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(body)))
+
+	return string(append(header, body...))
+}
+
+// addresses returns the body of a binary header from src to dst.
+func addresses(src, dst netip.AddrPort) []byte {
+	var body []byte
+	body = append(body, src.Addr().AsSlice()...)
+	body = append(body, dst.Addr().AsSlice()...)
+	body = binary.BigEndian.AppendUint16(body, src.Port())
+	body = binary.BigEndian.AppendUint16(body, dst.Port())
+
+	return body
+}
+
+func TestReadProxy(t *testing.T) {
+	tcp4 := addresses(netip.MustParseAddrPort("192.0.2.1:56324"), netip.MustParseAddrPort("192.0.2.2:22"))
+	tcp6 := addresses(netip.MustParseAddrPort("[2001:db8::1]:56324"), netip.MustParseAddrPort("[2001:db8::2]:22"))
+	mapped := addresses(netip.MustParseAddrPort("[::ffff:192.0.2.1]:56324"), netip.MustParseAddrPort("[::1]:22"))
+	tlvs := append(slices.Clone(tcp4), 0x04, 0x00, 0x01, 0xff)
+
+	tests := []struct {
+		name   string
+		header string
+		addr   string
+		err    bool
+		// kept is set if the connection does not start with a header
+		kept bool
+	}{
+		{name: "none", header: "", kept: true},
+		{name: "not a header", header: "PROXIED", kept: true},
+		{name: "v1 tcp4", header: "PROXY TCP4 192.0.2.1 192.0.2.2 56324 22\r\n", addr: "192.0.2.1:56324"},
+		{name: "v1 tcp6", header: "PROXY TCP6 2001:db8::1 2001:db8::2 56324 22\r\n", addr: "[2001:db8::1]:56324"},
+		{name: "v1 unknown", header: "PROXY UNKNOWN\r\n"},
+		{name: "v1 unknown with addresses", header: "PROXY UNKNOWN 192.0.2.1 192.0.2.2 56324 22\r\n"},
+		{name: "v1 protocol", header: "PROXY UDP4 192.0.2.1 192.0.2.2 56324 22\r\n", err: true},
+		{name: "v1 fields", header: "PROXY TCP4 192.0.2.1 192.0.2.2 56324\r\n", err: true},
+		{name: "v1 address", header: "PROXY TCP4 192.0.2.256 192.0.2.2 56324 22\r\n", err: true},
+		{name: "v1 port", header: "PROXY TCP4 192.0.2.1 192.0.2.2 65536 22\r\n", err: true},
+		{name: "v1 too long", header: "PROXY TCP4 " + strings.Repeat(" ", proxyV1MaxLength) + "\r\n", err: true},
+		{name: "v1 cut off", header: "PROXY TCP4 192.0.2.1", err: true},
+		{name: "v2 tcp4", header: proxyV2(proxyV2Proxy, proxyV2TCP4, tcp4), addr: "192.0.2.1:56324"},
+		{name: "v2 tcp6", header: proxyV2(proxyV2Proxy, proxyV2TCP6, tcp6), addr: "[2001:db8::1]:56324"},
+		{name: "v2 tcp6 mapped", header: proxyV2(proxyV2Proxy, proxyV2TCP6, mapped), addr: "192.0.2.1:56324"},
+		{name: "v2 tlvs", header: proxyV2(proxyV2Proxy, proxyV2TCP4, tlvs), addr: "192.0.2.1:56324"},
+		{name: "v2 local", header: proxyV2(proxyV2Local, 0x00, nil)},
+		{name: "v2 unix", header: proxyV2(proxyV2Proxy, 0x31, make([]byte, 216))},
+		{name: "v2 command", header: proxyV2(0x2f, proxyV2TCP4, tcp4), err: true},
+		{name: "v2 short body", header: proxyV2(proxyV2Proxy, proxyV2TCP4, tcp4[:8])},
+		{name: "v2 cut off", header: proxyV2(proxyV2Proxy, proxyV2TCP4, tcp4)[:20], err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// the client speaks once the header was read, unless it was cut off
+			const hello = "SSH-2.0-client\r\n"
+			stream := test.header
+			if !test.err {
+				stream += hello
+			}
+			r := bufio.NewReader(strings.NewReader(stream))
+
+			addr, err := readProxy(r)
+			if test.err {
+				if err == nil {
+					t.Fatalf("read %v, want an error", addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := ""
+			if addr != nil {
+				got = addr.String()
+			}
+			if got != test.addr {
+				t.Errorf("got address %q, want %q", got, test.addr)
+			}
+
+			rest, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := hello
+			if test.kept {
+				want = stream
+			}
+			if string(rest) != want {
+				t.Errorf("left %q to read, want %q", rest, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/trunners/runners/logger"
+	"github.com/trunners/runners/server/quota"
+)
+
+const ctrlC = 0x03
+
+// envWait is how long to wait for the environment variables a user sends
+// before starting a shell or command.
+const envWait = 2 * time.Second
+
+var (
+	errLeft         = errors.New("left while waiting")
+	errDisconnected = errors.New("disconnected while waiting")
+)
+
+// lobby holds the channels a user opens while waiting for their runner. The
+// first session channel is accepted to show them what is happening, and they
+// leave by pressing Ctrl-C. The other channels are handled once the runner
+// is ready.
+type lobby struct {
+	mu      sync.Mutex
+	held    *held
+	arrived chan struct{}
+	pending []ssh.NewChannel
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// enter starts holding the channels of a user, beginning with h if the
+// user's first session channel is held already. Leaving or disconnecting
+// calls leave with errLeft or errDisconnected.
+func enter(ctx context.Context, channels <-chan ssh.NewChannel, leave context.CancelCauseFunc, h *held) *lobby {
+	log := logger.FromContext(ctx)
+
+	l := &lobby{done: make(chan struct{}), arrived: make(chan struct{})}
+	if h != nil {
+		h.setLeave(func() { leave(errLeft) })
+		l.held = h
+		close(l.arrived)
+	}
+	l.wg.Go(func() {
+		for {
+			select {
+			case <-l.done:
+				return
+
+			case channel, ok := <-channels:
+				if !ok {
+					leave(errDisconnected)
+					return
+				}
+
+				l.mu.Lock()
+				if l.held == nil && channel.ChannelType() == "session" {
+					var err error
+					l.held, err = hold(channel, func() { leave(errLeft) })
+					if err != nil {
+						log.WarnContext(ctx, "Could not accept channel", "error", err)
+					} else {
+						close(l.arrived)
+					}
+				} else {
+					l.pending = append(l.pending, channel)
+				}
+				l.mu.Unlock()
+			}
+		}
+	})
+
+	return l
+}
+
+// exit stops holding channels and returns the held channel, if any, and the
+// other channels opened meanwhile.
+func (l *lobby) exit() (*held, []ssh.NewChannel) {
+	l.mu.Lock()
+	select {
+	case <-l.done:
+	default:
+		close(l.done)
+	}
+	l.mu.Unlock()
+	l.wg.Wait()
+
+	return l.held, l.pending
+}
+
+// env returns the environment variables sent on the held channel before the
+// user started a shell or command, waiting up to timeout for them. It is
+// empty if no session channel is opened meanwhile.
+func (l *lobby) env(ctx context.Context, timeout time.Duration) map[string]string {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	select {
+	case <-l.arrived:
+	case <-ctx.Done():
+		return nil
+	}
+
+	l.mu.Lock()
+	h := l.held
+	l.mu.Unlock()
+
+	select {
+	case <-h.started:
+	case <-ctx.Done():
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return maps.Clone(h.env)
+}
+
+// status shows the position in the queue of target.
+func (l *lobby) status(target string, p quota.Position) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.held.status(target, p)
+}
+
+// notify shows a message on a line of its own until the lobby is exited,
+// the held channel is then shown messages as any other.
+func (l *lobby) notify(message string) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	select {
+	case <-l.done:
+	default:
+		l.held.notify(message)
+	}
+}
+
+// turnAway tells the user why their session does not start, on the held
+// channel or else on the next session channel.
+func (l *lobby) turnAway(ctx context.Context, channels <-chan ssh.NewChannel, message string) {
+	h, pending := l.exit()
+	if h != nil {
+		h.abandon()
+		fail(ctx, h.channel, "\r\n"+message)
+		return
+	}
+
+	reject(ctx, prepend(pending, channels), message)
+}
+
+// queue waits in the lobby for a runner of a busy target until ctx is done,
+// returning its cause.
+func queue(ctx context.Context, q *quota.Quota, req quota.Request, priority int, l *lobby) (*quota.Lease, error) {
+	lease, err := q.Wait(ctx, req, priority, func(p quota.Position) {
+		l.status(req.Target, p)
+	})
+	if cause := context.Cause(ctx); err != nil && cause != nil {
+		err = cause
+	}
+
+	return lease, err
+}
+
+// held is the first session channel of a user waiting in a queue. Its
+// requests and input are kept until the runner is ready.
+type held struct {
+	channel  ssh.Channel
+	requests chan *ssh.Request
+	input    *buffer
+
+	mu      sync.Mutex
+	env     map[string]string
+	started chan struct{}
+	leave   func()
+
+	pty      atomic.Bool
+	queued   atomic.Bool
+	ready    chan struct{}
+	once     sync.Once
+	resumed  bool
+	position int
+}
+
+// hold accepts the channel and starts keeping its requests and input.
+// Pressing Ctrl-C on a pty calls leave.
+func hold(channel ssh.NewChannel, leave func()) (*held, error) {
+	serverChannel, serverReqs, err := channel.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return keep(serverChannel, nil, serverReqs, leave), nil
+}
+
+// keep starts keeping the requests and input of an accepted channel. The
+// requests received before, which were replied to already, are kept first.
+func keep(channel ssh.Channel, received []*ssh.Request, requests <-chan *ssh.Request, leave func()) *held {
+	h := &held{
+		channel:  channel,
+		requests: make(chan *ssh.Request),
+		input:    newBuffer(),
+		env:      map[string]string{},
+		started:  make(chan struct{}),
+		leave:    leave,
+		ready:    make(chan struct{}),
+	}
+	h.queued.Store(true)
+
+	kept := make([]*ssh.Request, 0, len(received))
+	for _, req := range received {
+		kept = append(kept, &ssh.Request{Type: req.Type, Payload: req.Payload})
+	}
+
+	go h.keepRequests(kept, requests)
+	go h.keepInput()
+
+	return h
+}
+
+// setLeave replaces the function called when the user presses Ctrl-C.
+func (h *held) setLeave(leave func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.leave = leave
+}
+
+// keepRequests passes on the requests of the channel once the runner is
+// ready, after those kept already. The environment variables set meanwhile
+// are recorded until a shell or command is started.
+func (h *held) keepRequests(kept []*ssh.Request, requests <-chan *ssh.Request) {
+	started := false
+	observe := func(req *ssh.Request) {
+		switch req.Type {
+		case "pty-req":
+			h.pty.Store(true)
+		case "env":
+			var env struct{ Name, Value string }
+			if !started && ssh.Unmarshal(req.Payload, &env) == nil {
+				h.mu.Lock()
+				h.env[env.Name] = env.Value
+				h.mu.Unlock()
+			}
+		case "shell", "exec", "subsystem":
+			if !started {
+				started = true
+				close(h.started)
+			}
+		}
+	}
+	for _, req := range kept {
+		observe(req)
+	}
+
+	for {
+		select {
+		case req, ok := <-requests:
+			if !ok {
+				requests = nil
+				continue
+			}
+
+			observe(req)
+			kept = append(kept, req)
+
+		case <-h.ready:
+			if !h.resumed {
+				if requests != nil {
+					ssh.DiscardRequests(requests)
+				}
+				return
+			}
+
+			for _, req := range kept {
+				h.requests <- req
+			}
+			if requests != nil {
+				for req := range requests {
+					h.requests <- req
+				}
+			}
+			close(h.requests)
+			return
+		}
+	}
+}
+
+// keepInput buffers the input of the channel until the runner reads it.
+func (h *held) keepInput() {
+	buf := make([]byte, 32*1024) //nolint:mnd // 32 KiB like io.Copy
+	for {
+		n, err := h.channel.Read(buf)
+		data := buf[:n]
+
+		if h.queued.Load() && h.pty.Load() {
+			if i := bytes.IndexByte(data, ctrlC); i >= 0 {
+				h.mu.Lock()
+				leave := h.leave
+				h.mu.Unlock()
+				leave()
+				data = data[:i]
+			}
+		}
+		_, _ = h.input.Write(data)
+
+		if err != nil {
+			h.input.CloseWithError(err)
+			return
+		}
+	}
+}
+
+// status shows the position in the queue, on a single line that is
+// rewritten if there is a pty. Nothing is shown without a held channel.
+func (h *held) status(target string, p quota.Position) {
+	if h == nil {
+		return
+	}
+
+	message := fmt.Sprintf("Waiting for a runner of %q: position %d in the queue", target, p.Position)
+	if p.Estimate > 0 {
+		message += fmt.Sprintf(", about %s", p.Estimate.Round(time.Second))
+	}
+	message += "."
+
+	switch {
+	case h.pty.Load():
+		_, _ = h.channel.Stderr().Write([]byte("\r\033[K" + message))
+	case p.Position != h.position:
+		_, _ = h.channel.Stderr().Write([]byte(message + "\r\n"))
+	}
+	h.position = p.Position
+}
+
+// notify shows a message on a line of its own, replacing the status line if
+// there is a pty. Nothing is shown without a held channel.
+func (h *held) notify(message string) {
+	if h == nil {
+		return
+	}
+
+	if h.pty.Load() {
+		message = "\r\033[K" + message
+	}
+	_, _ = h.channel.Stderr().Write([]byte(message + "\r\n"))
+}
+
+// resume relays the held channel to a session on the runner.
+func (h *held) resume(ctx context.Context, s *session) {
+	h.queued.Store(false)
+	if h.pty.Load() {
+		_, _ = h.channel.Stderr().Write([]byte("\r\033[K"))
+	}
+
+	clientChannel, clientReqs, err := s.client.OpenChannel("session", nil)
+	if err != nil {
+		logger.FromContext(ctx).ErrorContext(ctx, "Could not open channel on runner", "type", "session", "error", err)
+		h.abandon()
+		fail(ctx, h.channel, "Could not open a session on the runner.")
+		return
+	}
+
+	h.once.Do(func() {
+		h.resumed = true
+		close(h.ready)
+	})
+
+	relay(ctx, s, link{
+		channelType: "session",
+		server:      h.channel,
+		serverReqs:  h.requests,
+		input:       h.input,
+		client:      clientChannel,
+		clientReqs:  clientReqs,
+	})
+}
+
+// abandon stops keeping requests of a channel that will not be resumed,
+// if there is one.
+func (h *held) abandon() {
+	if h == nil {
+		return
+	}
+
+	h.queued.Store(false)
+	h.once.Do(func() {
+		close(h.ready)
+	})
+}
+
+// buffer is a pipe that keeps everything written to it until it is read.
+type buffer struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	data bytes.Buffer
+	err  error
+}
+
+func newBuffer() *buffer {
+	b := &buffer{}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+func (b *buffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.data.Write(p)
+	b.cond.Broadcast()
+	return len(p), nil
+}
+
+// CloseWithError makes reads fail with err once all data was read.
+func (b *buffer) CloseWithError(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.err = err
+	b.cond.Broadcast()
+}
+
+func (b *buffer) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for b.data.Len() == 0 && b.err == nil {
+		b.cond.Wait()
+	}
+
+	if b.data.Len() > 0 {
+		return b.data.Read(p)
+	}
+
+	return 0, b.err
+}
+
+// prepend returns a channel yielding channels and then those of rest.
+func prepend(channels []ssh.NewChannel, rest <-chan ssh.NewChannel) <-chan ssh.NewChannel {
+	if len(channels) == 0 {
+		return rest
+	}
+
+	all := make(chan ssh.NewChannel)
+	go func() {
+		defer close(all)
+
+		for _, channel := range channels {
+			all <- channel
+		}
+		for channel := range rest {
+			all <- channel
+		}
+	}()
+
+	return all
+}
@@ -0,0 +1,196 @@
+package quota
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"time"
+)
+
+// smoothing is the weight of a new observation in the moving averages of a target's history.
+const smoothing = 0.2
+
+// stats is the history of a target used to estimate waiting times: the
+// moving averages of the seconds from dispatch until the runner connected
+// and of the duration of its sessions.
+type stats struct {
+	Latency  float64 `json:"latency"`
+	Duration float64 `json:"duration"`
+}
+
+// waiter is a session waiting for a runner of a busy target.
+type waiter struct {
+	priority int
+	arrival  int
+}
+
+// Position is the place of a session in the queue of its target.
+type Position struct {
+	// Position counts from 1 for the session that is served next.
+	Position int
+
+	// Estimate is the expected time until the runner connects, zero if unknown.
+	Estimate time.Duration
+}
+
+// Wait queues for a lease, calling update whenever the position or the
+// estimate may have changed. Sessions with a higher priority are served
+// first, those with the same priority in order of arrival. Errors other
+// than a *BusyError end the wait, as does the context.
+func (q *Quota) Wait(ctx context.Context, req Request, priority int, update func(Position)) (*Lease, error) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	q.mu.Lock()
+	q.arrivals++
+	w := &waiter{priority: priority, arrival: q.arrivals}
+	queue := append(q.queues[req.Target], w)
+	slices.SortStableFunc(queue, func(a, b *waiter) int {
+		if a.priority != b.priority {
+			return b.priority - a.priority
+		}
+
+		return a.arrival - b.arrival
+	})
+	q.queues[req.Target] = queue
+	q.notify()
+	q.mu.Unlock()
+
+	defer q.leave(req.Target, w)
+
+	for {
+		q.mu.Lock()
+		lease, err := q.acquire(req, w)
+		var busy *BusyError
+		if !errors.As(err, &busy) {
+			q.mu.Unlock()
+			return lease, err
+		}
+
+		position := slices.Index(q.queues[req.Target], w)
+		estimate := q.estimate(req, position)
+		changed := q.changed
+		q.mu.Unlock()
+
+		update(Position{Position: position + 1, Estimate: estimate})
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-changed:
+		case <-ticker.C:
+		}
+	}
+}
+
+// Provisioned records how long it took until a runner of the target connected.
+func (q *Quota) Provisioned(target string, latency time.Duration) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	average(&q.stats(target).Latency, latency)
+	return q.save()
+}
+
+// Expected returns how long a session of the request is expected to wait
+// for its runner: to be provisioned, and for a runner to be free if the
+// target is at capacity. It is zero without any history of the target.
+func (q *Quota) Expected(req Request) time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	queued := len(q.queues[req.Target])
+	leased := q.count(func(l *Lease) bool { return l.target == req.Target })
+	if req.Runners <= 0 || queued == 0 && leased < req.Runners {
+		if history := q.usage.Targets[req.Target]; history != nil {
+			return seconds(history.Latency)
+		}
+		return 0
+	}
+
+	return q.estimate(req, queued)
+}
+
+// leave removes w from the queue of target.
+func (q *Quota) leave(target string, w *waiter) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.queues[target] = slices.DeleteFunc(q.queues[target], func(other *waiter) bool {
+		return other == w
+	})
+	if len(q.queues[target]) == 0 {
+		delete(q.queues, target)
+	}
+
+	q.notify()
+}
+
+// estimate returns the expected wait at position in the queue: until the
+// session holding the runner it will get is expected to end, plus the time
+// it takes to provision a runner.
+func (q *Quota) estimate(req Request, position int) time.Duration {
+	history := q.usage.Targets[req.Target]
+	if history == nil || history.Latency == 0 || history.Duration == 0 {
+		return 0
+	}
+	duration := seconds(history.Duration)
+
+	now := time.Now()
+	var ends []time.Time
+	for l := range q.leases {
+		if l.target != req.Target {
+			continue
+		}
+
+		end := l.start.Add(duration)
+		if !l.Deadline.IsZero() && l.Deadline.Before(end) {
+			end = l.Deadline
+		}
+		ends = append(ends, end)
+	}
+	if len(ends) == 0 {
+		return seconds(history.Latency)
+	}
+	slices.SortFunc(ends, func(a, b time.Time) int {
+		return a.Compare(b)
+	})
+
+	// later positions wait for the sessions of those ahead of them to end as well
+	end := ends[position%len(ends)].Add(time.Duration(position/len(ends)) * duration)
+
+	return max(end.Sub(now), 0) + seconds(history.Latency)
+}
+
+// stats returns the history of target.
+func (q *Quota) stats(target string) *stats {
+	if q.usage.Targets == nil {
+		q.usage.Targets = map[string]*stats{}
+	}
+
+	if q.usage.Targets[target] == nil {
+		q.usage.Targets[target] = &stats{}
+	}
+
+	return q.usage.Targets[target]
+}
+
+// notify wakes up all waiting sessions.
+func (q *Quota) notify() {
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
+
+// average adds an observation to a moving average of seconds.
+func average(avg *float64, d time.Duration) {
+	if *avg == 0 {
+		*avg = d.Seconds()
+		return
+	}
+
+	*avg += smoothing * (d.Seconds() - *avg)
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
@@ -0,0 +1,388 @@
+package quota
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/trunners/runners/server/config"
+	"github.com/trunners/runners/server/state"
+)
+
+// Quota enforces concurrency limits and runner time budgets. Usage is kept
+// in the broker's state so that budgets survive restarts.
+type Quota struct {
+	mu    sync.Mutex
+	store *state.Store
+	usage usage
+	// saved is the usage as saved last, which the changes since are
+	// merged into the usage saved by other brokers meanwhile.
+	saved    usage
+	leases   map[*Lease]struct{}
+	queues   map[string][]*waiter
+	arrivals int
+	changed  chan struct{}
+}
+
+// usage is the weighted runner time in seconds used per user or group in
+// the current day and month, and the history of each target.
+type usage struct {
+	Day     string             `json:"day"`
+	Month   string             `json:"month"`
+	Daily   map[string]float64 `json:"daily"`
+	Monthly map[string]float64 `json:"monthly"`
+	Targets map[string]*stats  `json:"targets,omitempty"`
+}
+
+// BusyError is returned when all runners of a target are in use.
+type BusyError struct {
+	Target  string
+	Runners int
+}
+
+func (e *BusyError) Error() string {
+	return fmt.Sprintf("all %d runners of %q are in use", e.Runners, e.Target)
+}
+
+// Subject is a user, or a group named as "@group", whose limits apply to a session.
+type Subject struct {
+	Name   string
+	Limits config.Limits
+}
+
+// Request describes the session to be started.
+type Request struct {
+	Subjects []Subject
+	Target   string
+	Runners  int
+	Weight   float64
+}
+
+// Lease is held for the duration of a session.
+type Lease struct {
+	quota    *Quota
+	subjects []string
+	target   string
+	weight   float64
+	start    time.Time
+	// recorded is when the runner time used until was recorded last.
+	recorded time.Time
+
+	// Deadline is when the session must end, zero if it may run indefinitely.
+	Deadline time.Time
+}
+
+// Load reads the usage recorded in store.
+func Load(store *state.Store) (*Quota, error) {
+	q := &Quota{
+		store:   store,
+		leases:  map[*Lease]struct{}{},
+		queues:  map[string][]*waiter{},
+		changed: make(chan struct{}),
+	}
+
+	err := store.Usage(&q.usage)
+	if err != nil {
+		return nil, err
+	}
+
+	q.roll(time.Now())
+	q.saved = q.usage.clone()
+	return q, nil
+}
+
+// Acquire checks the request against all limits and returns a lease for the
+// session. The error explains which limit was hit, it is a *BusyError if the
+// target is at capacity or others are queued for it.
+func (q *Quota) Acquire(req Request) (*Lease, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.acquire(req, nil)
+}
+
+// acquire acquires a lease unless the target is busy, or others than w are
+// first in its queue.
+func (q *Quota) acquire(req Request, w *waiter) (*Lease, error) {
+	now := time.Now()
+	q.roll(now)
+
+	if req.Weight <= 0 {
+		req.Weight = 1
+	}
+
+	if req.Runners > 0 {
+		queue := q.queues[req.Target]
+		if len(queue) > 0 && queue[0] != w ||
+			q.count(func(l *Lease) bool { return l.target == req.Target }) >= req.Runners {
+			return nil, &BusyError{Target: req.Target, Runners: req.Runners}
+		}
+	}
+
+	lease := &Lease{
+		quota:    q,
+		target:   req.Target,
+		weight:   req.Weight,
+		start:    now,
+		recorded: now,
+	}
+
+	var limit time.Duration
+	shorten := func(d time.Duration) {
+		if d > 0 && (limit == 0 || d < limit) {
+			limit = d
+		}
+	}
+
+	for _, subject := range req.Subjects {
+		lease.subjects = append(lease.subjects, subject.Name)
+
+		sessions := q.count(func(l *Lease) bool { return slices.Contains(l.subjects, subject.Name) })
+		if subject.Limits.Sessions > 0 && sessions >= subject.Limits.Sessions {
+			return nil, fmt.Errorf("%s already has %d of %d sessions", subject.Name, sessions, subject.Limits.Sessions)
+		}
+
+		shorten(time.Duration(subject.Limits.Duration))
+
+		for _, budget := range []struct {
+			name   string
+			limit  config.Duration
+			period map[string]float64
+		}{
+			{"daily", subject.Limits.Daily, q.usage.Daily},
+			{"monthly", subject.Limits.Monthly, q.usage.Monthly},
+		} {
+			if budget.limit <= 0 {
+				continue
+			}
+
+			remaining := time.Duration(budget.limit) - q.used(budget.period, subject.Name, now)
+			if remaining <= 0 {
+				return nil, fmt.Errorf(
+					"%s used up the %s budget of %s",
+					subject.Name,
+					budget.name,
+					time.Duration(budget.limit),
+				)
+			}
+
+			shorten(time.Duration(float64(remaining) / req.Weight))
+		}
+	}
+
+	if limit > 0 {
+		lease.Deadline = now.Add(limit)
+	}
+
+	q.leases[lease] = struct{}{}
+	return lease, nil
+}
+
+// Release ends the session and records the runner time it used.
+func (l *Lease) Release() error {
+	q := l.quota
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, ok := q.leases[l]; !ok {
+		return nil
+	}
+	delete(q.leases, l)
+	q.notify()
+
+	now := time.Now()
+	q.roll(now)
+
+	q.record(l, now)
+	average(&q.stats(l.target).Duration, now.Sub(l.start))
+
+	return q.save()
+}
+
+// Checkpoint records the runner time the active sessions used so far, so
+// that little of it is lost if the broker crashes.
+func (q *Quota) Checkpoint() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.leases) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	q.roll(now)
+
+	for l := range q.leases {
+		q.record(l, now)
+	}
+
+	return q.save()
+}
+
+// record adds the runner time the lease used since it was recorded last to
+// the usage of its subjects.
+func (q *Quota) record(l *Lease, now time.Time) {
+	used := now.Sub(l.recorded).Seconds() * l.weight
+	for _, subject := range l.subjects {
+		q.usage.Daily[subject] += used
+		q.usage.Monthly[subject] += used
+	}
+	l.recorded = now
+}
+
+// Remaining returns the weighted runner time the subjects have left of their
+// daily and monthly budgets, whichever is least, and false if they are not
+// limited by any.
+func (q *Quota) Remaining(subjects []Subject) (time.Duration, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	q.roll(now)
+
+	var remaining time.Duration
+	limited := false
+	for _, subject := range subjects {
+		for _, budget := range []struct {
+			limit  config.Duration
+			period map[string]float64
+		}{
+			{subject.Limits.Daily, q.usage.Daily},
+			{subject.Limits.Monthly, q.usage.Monthly},
+		} {
+			if budget.limit <= 0 {
+				continue
+			}
+
+			left := max(time.Duration(budget.limit)-q.used(budget.period, subject.Name, now), 0)
+			if !limited || left < remaining {
+				remaining = left
+			}
+			limited = true
+		}
+	}
+
+	return remaining, limited
+}
+
+// count returns the number of active leases matching f.
+func (q *Quota) count(f func(*Lease) bool) int {
+	n := 0
+	for l := range q.leases {
+		if f(l) {
+			n++
+		}
+	}
+
+	return n
+}
+
+// used returns the recorded usage of subject in period plus that of its active sessions.
+func (q *Quota) used(period map[string]float64, subject string, now time.Time) time.Duration {
+	seconds := period[subject]
+	for l := range q.leases {
+		if slices.Contains(l.subjects, subject) {
+			seconds += now.Sub(l.recorded).Seconds() * l.weight
+		}
+	}
+
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// roll starts new periods when the day or month changed.
+func (q *Quota) roll(now time.Time) {
+	day, month := now.Format(time.DateOnly), now.Format("2006-01")
+
+	if q.usage.Day != day || q.usage.Daily == nil {
+		q.usage.Day = day
+		q.usage.Daily = map[string]float64{}
+	}
+
+	if q.usage.Month != month || q.usage.Monthly == nil {
+		q.usage.Month = month
+		q.usage.Monthly = map[string]float64{}
+	}
+}
+
+// save records the usage in the store. The usage recorded meanwhile by
+// another broker sharing the store, as during an upgrade, is kept and the
+// changes since the last save are added to it.
+func (q *Quota) save() error {
+	q.roll(time.Now())
+
+	return q.store.UpdateUsage(func(recorded json.RawMessage) (any, error) {
+		latest := q.saved
+		if recorded != nil {
+			latest = usage{}
+			err := json.Unmarshal(recorded, &latest)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		q.usage = q.merge(latest)
+		q.saved = q.usage.clone()
+		return q.usage, nil
+	})
+}
+
+// merge adds the changes to the usage since it was saved last to latest.
+func (q *Quota) merge(latest usage) usage {
+	merged := latest.clone()
+	merged.Day, merged.Month = q.usage.Day, q.usage.Month
+	if latest.Day != q.usage.Day || merged.Daily == nil {
+		merged.Daily = map[string]float64{}
+	}
+	if latest.Month != q.usage.Month || merged.Monthly == nil {
+		merged.Monthly = map[string]float64{}
+	}
+
+	for _, period := range []struct {
+		current, saved, merged map[string]float64
+		same                   bool
+	}{
+		{q.usage.Daily, q.saved.Daily, merged.Daily, q.usage.Day == q.saved.Day},
+		{q.usage.Monthly, q.saved.Monthly, merged.Monthly, q.usage.Month == q.saved.Month},
+	} {
+		for subject, seconds := range period.current {
+			if period.same {
+				seconds -= period.saved[subject]
+			}
+			period.merged[subject] += seconds
+		}
+	}
+
+	// the history is replaced where it changed, its moving averages do not add up
+	for target, s := range q.usage.Targets {
+		if saved, ok := q.saved.Targets[target]; ok && *saved == *s {
+			continue
+		}
+
+		if merged.Targets == nil {
+			merged.Targets = map[string]*stats{}
+		}
+		merged.Targets[target] = &stats{Latency: s.Latency, Duration: s.Duration}
+	}
+
+	return merged
+}
+
+// clone returns a deep copy of u.
+func (u usage) clone() usage {
+	c := u
+	c.Daily = maps.Clone(u.Daily)
+	c.Monthly = maps.Clone(u.Monthly)
+	c.Targets = nil
+	for target, s := range u.Targets {
+		if c.Targets == nil {
+			c.Targets = map[string]*stats{}
+		}
+		c.Targets[target] = &stats{Latency: s.Latency, Duration: s.Duration}
+	}
+
+	return c
+}
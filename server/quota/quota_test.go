@@ -0,0 +1,149 @@
+package quota
+
+import (
+	"maps"
+	"testing"
+)
+
+func TestMerge(t *testing.T) {
+	tests := []struct {
+		name    string
+		saved   usage
+		current usage
+		latest  usage
+		want    usage
+	}{
+		{
+			name: "adds the changes since the save",
+			saved: usage{
+				Day: "d1", Month: "m1",
+				Daily:   map[string]float64{"alice": 10},
+				Monthly: map[string]float64{"alice": 100},
+			},
+			current: usage{
+				Day: "d1", Month: "m1",
+				Daily:   map[string]float64{"alice": 15},
+				Monthly: map[string]float64{"alice": 105},
+			},
+			latest: usage{
+				Day: "d1", Month: "m1",
+				Daily:   map[string]float64{"alice": 12, "bob": 5},
+				Monthly: map[string]float64{"alice": 102, "bob": 5},
+			},
+			want: usage{
+				Day: "d1", Month: "m1",
+				Daily:   map[string]float64{"alice": 17, "bob": 5},
+				Monthly: map[string]float64{"alice": 107, "bob": 5},
+			},
+		},
+		{
+			name: "drops the usage of the day before",
+			saved: usage{
+				Day: "d1", Month: "m1",
+				Daily:   map[string]float64{"alice": 10},
+				Monthly: map[string]float64{"alice": 100},
+			},
+			current: usage{
+				Day: "d2", Month: "m1",
+				Daily:   map[string]float64{"alice": 3},
+				Monthly: map[string]float64{"alice": 103},
+			},
+			latest: usage{
+				Day: "d1", Month: "m1",
+				Daily:   map[string]float64{"alice": 12},
+				Monthly: map[string]float64{"alice": 102},
+			},
+			want: usage{
+				Day: "d2", Month: "m1",
+				Daily:   map[string]float64{"alice": 3},
+				Monthly: map[string]float64{"alice": 105},
+			},
+		},
+		{
+			name: "keeps the day another broker started",
+			saved: usage{
+				Day: "d1", Month: "m1",
+				Daily:   map[string]float64{"alice": 10},
+				Monthly: map[string]float64{},
+			},
+			current: usage{
+				Day: "d2", Month: "m1",
+				Daily:   map[string]float64{"alice": 3},
+				Monthly: map[string]float64{},
+			},
+			latest: usage{
+				Day: "d2", Month: "m1",
+				Daily:   map[string]float64{"bob": 4},
+				Monthly: map[string]float64{},
+			},
+			want: usage{
+				Day: "d2", Month: "m1",
+				Daily:   map[string]float64{"alice": 3, "bob": 4},
+				Monthly: map[string]float64{},
+			},
+		},
+		{
+			name: "starts without recorded usage",
+			current: usage{
+				Day: "d1", Month: "m1",
+				Daily:   map[string]float64{"alice": 3},
+				Monthly: map[string]float64{"alice": 3},
+			},
+			want: usage{
+				Day: "d1", Month: "m1",
+				Daily:   map[string]float64{"alice": 3},
+				Monthly: map[string]float64{"alice": 3},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			q := &Quota{usage: test.current, saved: test.saved}
+
+			got := q.merge(test.latest)
+			if got.Day != test.want.Day || got.Month != test.want.Month {
+				t.Errorf("got period %s %s, want %s %s", got.Day, got.Month, test.want.Day, test.want.Month)
+			}
+			if !maps.Equal(got.Daily, test.want.Daily) {
+				t.Errorf("got daily %v, want %v", got.Daily, test.want.Daily)
+			}
+			if !maps.Equal(got.Monthly, test.want.Monthly) {
+				t.Errorf("got monthly %v, want %v", got.Monthly, test.want.Monthly)
+			}
+		})
+	}
+}
+
+func TestMergeTargets(t *testing.T) {
+	q := &Quota{
+		usage: usage{Targets: map[string]*stats{
+			"changed":   {Latency: 20, Duration: 60},
+			"unchanged": {Latency: 10, Duration: 30},
+		}},
+		saved: usage{Targets: map[string]*stats{
+			"changed":   {Latency: 10, Duration: 30},
+			"unchanged": {Latency: 10, Duration: 30},
+		}},
+	}
+	latest := usage{Targets: map[string]*stats{
+		"changed":   {Latency: 15, Duration: 45},
+		"unchanged": {Latency: 12, Duration: 40},
+		"other":     {Latency: 5, Duration: 5},
+	}}
+
+	got := q.merge(latest)
+	for target, want := range map[string]stats{
+		"changed":   {Latency: 20, Duration: 60},
+		"unchanged": {Latency: 12, Duration: 40},
+		"other":     {Latency: 5, Duration: 5},
+	} {
+		if s := got.Targets[target]; s == nil || *s != want {
+			t.Errorf("got %s history %v, want %v", target, s, want)
+		}
+	}
+
+	if *latest.Targets["changed"] != (stats{Latency: 15, Duration: 45}) {
+		t.Error("merge changed the latest usage")
+	}
+}
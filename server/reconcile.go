@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/trunners/runners/logger"
+	"github.com/trunners/runners/server/github"
+	"github.com/trunners/runners/server/state"
+)
+
+// staleAfter is how long a session left behind is remembered while its run
+// cannot be cancelled, longer than GitHub lets a job run. No broker serves a
+// session this old.
+const staleAfter = 24 * time.Hour
+
+// reconcile cancels the workflow runs of the sessions recorded at startup
+// that were left behind by brokers not running anymore, such as one that
+// crashed, and forgets the sessions with their tokens.
+func reconcile(ctx context.Context, gh github.Github, store *state.Store, sessions []state.Session) {
+	log := logger.FromContext(ctx)
+
+	for _, s := range sessions {
+		// A broker being upgraded serves its sessions until they end. A stale
+		// session outlived its broker, whose process ID may have been reused.
+		stale := time.Since(s.Started) >= staleAfter
+		if !stale && s.Broker != os.Getpid() && alive(s.Broker) {
+			continue
+		}
+
+		err := gh.Cancel(ctx, s.Owner, s.Repository, s.RunID)
+		switch {
+		case err != nil && !stale:
+			log.WarnContext(ctx, "Failed to cancel orphaned workflow run, retrying on restart", "session", s.ID, "run", s.RunID, "error", err)
+			continue
+		case err != nil:
+			log.WarnContext(ctx, "Failed to cancel orphaned workflow run, forgetting stale session", "session", s.ID, "run", s.RunID, "error", err)
+		default:
+			log.InfoContext(ctx, "Cancelled orphaned workflow run", "session", s.ID, "user", s.User, "target", s.Target, "run", s.RunID)
+		}
+
+		err = store.End(s.ID)
+		if err != nil {
+			log.ErrorContext(ctx, "Failed to forget session", "session", s.ID, "error", err)
+		}
+	}
+}
+
+// alive reports whether the process with the given ID is running.
+func alive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/trunners/runners/logger"
+	"github.com/trunners/runners/server/recording"
+)
+
+// record starts the recording on a pty request and records terminal size changes.
+func record(ctx context.Context, cast *recording.Cast, req *ssh.Request) {
+	log := logger.FromContext(ctx)
+
+	switch req.Type {
+	case "pty-req":
+		var pty ptyRequest
+		err := ssh.Unmarshal(req.Payload, &pty)
+		if err != nil {
+			log.WarnContext(ctx, "Could not parse pty request", "error", err)
+			return
+		}
+
+		err = cast.Start(pty.Columns, pty.Rows, pty.Term)
+		if err != nil {
+			log.WarnContext(ctx, "Could not start recording", "error", err)
+		}
+
+	case "window-change":
+		var change windowChange
+		err := ssh.Unmarshal(req.Payload, &change)
+		if err != nil {
+			log.WarnContext(ctx, "Could not parse window change", "error", err)
+			return
+		}
+
+		cast.Resize(change.Columns, change.Rows)
+	}
+}
+
+// replay implements the replay subcommand.
+func replay(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	speed := flags.Float64("speed", 1, "playback speed multiplier")
+	idle := flags.Duration("idle", 0, "maximum delay between events, 0 for no limit")
+	export := flags.String("export", "", "write the output without delays to this file, - for stdout")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 {
+		return errors.New("usage: server replay [-speed n] [-idle d] [-export file] recording.cast")
+	}
+
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	switch *export {
+	case "":
+		return recording.Play(ctx, file, os.Stdout, *speed, *idle)
+
+	case "-":
+		return recording.Export(file, os.Stdout)
+
+	default:
+		var out *os.File
+		out, err = os.Create(*export)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+
+		return recording.Export(file, out)
+	}
+}
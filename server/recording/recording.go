@@ -0,0 +1,248 @@
+package recording
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	version   = 2
+	extension = ".cast"
+)
+
+// Header is the first line of an asciicast v2 file.
+type Header struct {
+	Version   int               `json:"version"`
+	Width     uint32            `json:"width"`
+	Height    uint32            `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// Recorder creates recordings for the sessions of a single connection.
+// A nil Recorder records nothing.
+type Recorder struct {
+	dir       string
+	target    string
+	user      string
+	retention time.Duration
+}
+
+// New returns a Recorder writing into a per target directory below dir.
+func New(dir, target, user string, retention time.Duration) *Recorder {
+	return &Recorder{
+		dir:       filepath.Join(dir, sanitize(target)),
+		target:    target,
+		user:      user,
+		retention: retention,
+	}
+}
+
+// Prune removes recordings of the target older than the retention period.
+func (r *Recorder) Prune() error {
+	if r == nil || r.retention <= 0 {
+		return nil
+	}
+
+	entries, err := os.ReadDir(r.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-r.retention)
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != extension {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		if info.ModTime().Before(cutoff) {
+			err = os.Remove(filepath.Join(r.dir, entry.Name()))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Cast returns a recording for a single channel.
+// Nothing is written until the pty is started.
+func (r *Recorder) Cast() *Cast {
+	if r == nil {
+		return nil
+	}
+
+	return &Cast{recorder: r}
+}
+
+// Cast is a single asciicast v2 recording.
+// All methods are safe for concurrent use and on a nil Cast.
+type Cast struct {
+	recorder *Recorder
+
+	mu      sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+	start   time.Time
+	// partial is the start of a character split across writes.
+	partial []byte
+}
+
+// Start creates the recording file and writes the header.
+func (c *Cast) Start(width, height uint32, term string) error {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.file != nil {
+		return nil
+	}
+
+	err := os.MkdirAll(c.recorder.dir, 0o750)
+	if err != nil {
+		return err
+	}
+
+	c.start = time.Now()
+	prefix := c.start.UTC().Format("20060102T150405Z") + "-" + sanitize(c.recorder.user) + "-"
+	c.file, err = os.CreateTemp(c.recorder.dir, prefix+"*"+extension)
+	if err != nil {
+		return err
+	}
+
+	header := Header{
+		Version:   version,
+		Width:     width,
+		Height:    height,
+		Timestamp: c.start.Unix(),
+		Title:     c.recorder.user + "@" + c.recorder.target,
+	}
+	if term != "" {
+		header.Env = map[string]string{"TERM": term}
+	}
+
+	c.encoder = json.NewEncoder(c.file)
+	return c.encoder.Encode(header)
+}
+
+// Write records p as terminal output. It never fails so that a broken
+// recording does not interrupt the session it belongs to.
+// A character split across writes is recorded with the write completing it.
+func (c *Cast) Write(p []byte) (int, error) {
+	if c == nil {
+		return len(p), nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.encoder == nil {
+		return len(p), nil
+	}
+
+	data := append(c.partial, p...)
+	n := complete(data)
+	c.partial = bytes.Clone(data[n:])
+	if n > 0 {
+		c.encode("o", string(data[:n]))
+	}
+
+	return len(p), nil
+}
+
+// Resize records a terminal size change.
+func (c *Cast) Resize(width, height uint32) {
+	c.event("r", fmt.Sprintf("%dx%d", width, height))
+}
+
+// Close closes the recording file.
+func (c *Cast) Close() error {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.file == nil {
+		return nil
+	}
+
+	if len(c.partial) > 0 {
+		c.encode("o", string(c.partial))
+		c.partial = nil
+	}
+
+	err := c.file.Close()
+	c.file = nil
+	c.encoder = nil
+	return err
+}
+
+func (c *Cast) event(code, data string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.encoder == nil {
+		return
+	}
+
+	c.encode(code, data)
+}
+
+// encode writes an event, with c.mu held.
+func (c *Cast) encode(code, data string) {
+	_ = c.encoder.Encode([]any{time.Since(c.start).Seconds(), code, data})
+}
+
+// complete returns the length of data without a character it ends in the
+// middle of. Invalid bytes count as complete characters.
+func complete(data []byte) int {
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				return i
+			}
+			break
+		}
+	}
+
+	return len(data)
+}
+
+// sanitize makes name safe for use in a file name.
+func sanitize(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '_', r == '-':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+}
@@ -0,0 +1,111 @@
+package recording
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestComplete(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want int
+	}{
+		{name: "empty", data: "", want: 0},
+		{name: "ascii", data: "ls\r\n", want: 4},
+		{name: "complete", data: "é€😀", want: 9},
+		{name: "two byte cut", data: "a\xc3", want: 1},
+		{name: "three byte cut", data: "a\xe2\x82", want: 1},
+		{name: "four byte cut", data: "a\xf0\x9f\x98", want: 1},
+		{name: "only a cut character", data: "\xf0\x9f", want: 0},
+		{name: "invalid", data: "a\xff", want: 2},
+		{name: "stray continuation", data: "a\x80\x80\x80\x80", want: 5},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := complete([]byte(test.data)); got != test.want {
+				t.Errorf("got %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+// record writes the writes to a recording and returns its output events.
+func record(t *testing.T, writes []string) []string {
+	t.Helper()
+
+	dir := t.TempDir()
+	cast := New(dir, "ubuntu", "alice", 0).Cast()
+	err := cast.Start(80, 24, "xterm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range writes {
+		_, err = cast.Write([]byte(p))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = cast.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "ubuntu", "*"+extension))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("got recordings %v, %v", files, err)
+	}
+
+	file, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	r, err := NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var output []string
+	for {
+		event, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			return output
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if event.Code == "o" {
+			output = append(output, event.Data)
+		}
+	}
+}
+
+func TestCastWrite(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []string
+		want   []string
+	}{
+		{name: "whole characters", writes: []string{"é", "€"}, want: []string{"é", "€"}},
+		{name: "split character", writes: []string{"a\xe2", "\x82\xacb"}, want: []string{"a", "€b"}},
+		{name: "split over three writes", writes: []string{"\xf0", "\x9f\x98", "\x80"}, want: []string{"😀"}},
+		// JSON replaces each invalid byte
+		{name: "cut off at the end", writes: []string{"a\xe2\x82"}, want: []string{"a", "\ufffd\ufffd"}},
+		{name: "invalid bytes", writes: []string{"\xff", "b"}, want: []string{"\ufffd", "b"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := record(t, test.writes); !slices.Equal(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
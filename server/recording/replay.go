@@ -0,0 +1,142 @@
+package recording
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Event is a single line following the header of an asciicast v2 file.
+type Event struct {
+	Time float64
+	Code string
+	Data string
+}
+
+func (e *Event) UnmarshalJSON(b []byte) error {
+	var raw []json.RawMessage
+	err := json.Unmarshal(b, &raw)
+	if err != nil {
+		return err
+	}
+
+	if len(raw) != 3 { //nolint:mnd // time, code and data
+		return fmt.Errorf("invalid event: %s", b)
+	}
+
+	err = json.Unmarshal(raw[0], &e.Time)
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(raw[1], &e.Code)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(raw[2], &e.Data)
+}
+
+// Reader reads an asciicast v2 file.
+type Reader struct {
+	Header Header
+
+	decoder *json.Decoder
+}
+
+// NewReader reads the header of the recording in r.
+func NewReader(r io.Reader) (*Reader, error) {
+	reader := &Reader{
+		decoder: json.NewDecoder(bufio.NewReader(r)),
+	}
+
+	err := reader.decoder.Decode(&reader.Header)
+	if err != nil {
+		return nil, err
+	}
+
+	if reader.Header.Version != version {
+		return nil, fmt.Errorf("unsupported asciicast version: %d", reader.Header.Version)
+	}
+
+	return reader, nil
+}
+
+// Next returns the next event, or io.EOF at the end of the recording.
+func (r *Reader) Next() (Event, error) {
+	var event Event
+	err := r.decoder.Decode(&event)
+	return event, err
+}
+
+// Play writes the output of the recording to w with its original timing.
+// Delays are divided by speed and capped at idle if it is positive.
+func Play(ctx context.Context, r io.Reader, w io.Writer, speed float64, idle time.Duration) error {
+	reader, err := NewReader(r)
+	if err != nil {
+		return err
+	}
+
+	if speed <= 0 {
+		speed = 1
+	}
+
+	var last float64
+	for {
+		event, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		delay := time.Duration((event.Time - last) / speed * float64(time.Second))
+		if idle > 0 {
+			delay = min(delay, idle)
+		}
+		last = event.Time
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+
+		if event.Code == "o" {
+			_, err = io.WriteString(w, event.Data)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Export writes the output of the recording to w without any delays.
+func Export(r io.Reader, w io.Writer) error {
+	reader, err := NewReader(r)
+	if err != nil {
+		return err
+	}
+
+	for {
+		event, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if event.Code == "o" {
+			_, err = io.WriteString(w, event.Data)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
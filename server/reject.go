@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/trunners/runners/logger"
+)
+
+const rejectTimeout = 30 * time.Second
+
+// reject shows message to the user on their first session channel and
+// ends it with a non-zero exit status, so that the user sees why they were
+// turned away rather than a silently closed connection.
+func reject(ctx context.Context, channels <-chan ssh.NewChannel, message string) {
+	ctx, cancel := context.WithTimeout(ctx, rejectTimeout)
+	defer cancel()
+
+	serverChannel, serverReqs, ok := accept(ctx, channels, message)
+	if !ok {
+		return
+	}
+	go ssh.DiscardRequests(serverReqs)
+
+	fail(ctx, serverChannel, message)
+}
+
+// accept waits for the first session channel and accepts it. Channels of
+// other types are rejected with message.
+func accept(ctx context.Context, channels <-chan ssh.NewChannel, message string) (ssh.Channel, <-chan *ssh.Request, bool) {
+	log := logger.FromContext(ctx)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, nil, false
+
+		case channel, ok := <-channels:
+			if !ok {
+				return nil, nil, false
+			}
+
+			if channel.ChannelType() != "session" {
+				err := channel.Reject(ssh.Prohibited, message)
+				if err != nil {
+					log.WarnContext(ctx, "Could not reject channel", "error", err)
+				}
+
+				continue
+			}
+
+			serverChannel, serverReqs, err := channel.Accept()
+			if err != nil {
+				log.WarnContext(ctx, "Could not accept channel", "error", err)
+				return nil, nil, false
+			}
+
+			return serverChannel, serverReqs, true
+		}
+	}
+}
+
+// fail writes message to stderr and ends the channel with exit status 1.
+func fail(ctx context.Context, channel ssh.Channel, message string) {
+	_, err := channel.Stderr().Write([]byte(message + "\r\n"))
+	if err != nil {
+		logger.FromContext(ctx).WarnContext(ctx, "Could not write rejection", "error", err)
+	}
+
+	exit(ctx, channel, 1)
+}
+
+// exit sends the exit status and closes the channel.
+func exit(ctx context.Context, channel ssh.Channel, status uint32) {
+	log := logger.FromContext(ctx)
+
+	_, err := channel.SendRequest("exit-status", false, ssh.Marshal(exitStatus{Status: status}))
+	if err != nil {
+		log.WarnContext(ctx, "Could not send exit status", "error", err)
+	}
+
+	err = channel.Close()
+	if err != nil {
+		log.WarnContext(ctx, "Could not close channel", "error", err)
+	}
+}
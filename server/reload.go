@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/trunners/runners/logger"
+	"github.com/trunners/runners/server/config"
+	"github.com/trunners/runners/server/pool"
+	"github.com/trunners/runners/server/throttle"
+)
+
+// settings holds the config new logins and requests are served with. It is
+// replaced on reload, while sessions keep the config they started with.
+type settings struct {
+	atomic.Pointer[config.Config]
+
+	mu   sync.Mutex
+	pool *pool.Pool
+}
+
+func newSettings(cfg *config.Config, p *pool.Pool) *settings {
+	s := &settings{pool: p}
+	s.Store(cfg)
+	return s
+}
+
+// reload loads the config again and swaps it in unless it is invalid, then
+// logs what changed.
+func (s *settings) reload(ctx context.Context) error {
+	log := logger.FromContext(ctx)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	next, err := config.Load(ctx)
+	if err != nil {
+		return err
+	}
+
+	prev := s.Load()
+	t := s.pool.Throttle()
+	if next.Throttle != prev.Throttle {
+		t = newThrottle(next)
+	}
+	s.pool.Configure(poolOptions(next, t))
+	logger.Level.Set(next.LogLevel)
+	s.Store(next)
+
+	changes := next.Diff(prev)
+	log.InfoContext(ctx, "Reloaded config", "changes", len(changes))
+	for _, change := range changes {
+		log.InfoContext(ctx, "Config changed", "change", change)
+	}
+
+	return nil
+}
+
+// watch reloads the config when one of its files changes, checking their
+// modification times every interval.
+func (s *settings) watch(ctx context.Context, interval time.Duration) {
+	log := logger.FromContext(ctx)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	seen := modified(s.Load().Files)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		current := modified(s.Load().Files)
+		if maps.Equal(current, seen) {
+			continue
+		}
+		seen = current
+
+		log.InfoContext(ctx, "Config files changed, reloading")
+		err := s.reload(ctx)
+		if err != nil {
+			log.ErrorContext(ctx, "Failed to reload config, keeping the current one", "error", err)
+		}
+	}
+}
+
+// modified returns the modification times of files, zero for missing ones.
+func modified(files []string) map[string]time.Time {
+	times := make(map[string]time.Time, len(files))
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err == nil {
+			times[file] = info.ModTime()
+		} else {
+			times[file] = time.Time{}
+		}
+	}
+
+	return times
+}
+
+// newThrottle returns the throttle of failing addresses, nil if it is off.
+func newThrottle(cfg *config.Config) *throttle.Throttle {
+	if cfg.Throttle.Backoff <= 0 {
+		return nil
+	}
+
+	return throttle.New(cfg.Throttle.Backoff, cfg.Throttle.MaxBackoff, cfg.Throttle.BanAfter, cfg.Throttle.Ban)
+}
+
+// poolOptions returns the options of the pool for cfg.
+func poolOptions(cfg *config.Config, t *throttle.Throttle) pool.Options {
+	return pool.Options{
+		Proxies:  cfg.Proxies,
+		SSH:      pool.Filter{Allow: cfg.Network.SSHAllow, Deny: cfg.Network.SSHDeny},
+		Runners:  pool.Filter{Allow: cfg.Network.RunnerAllow, Deny: cfg.Network.RunnerDeny},
+		Throttle: t,
+	}
+}
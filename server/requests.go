@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/trunners/runners/logger"
+	"github.com/trunners/runners/server/audit"
+	"github.com/trunners/runners/server/config"
+)
+
+// ptyRequest is the payload of a "pty-req" request (RFC 4254 section 6.2).
+type ptyRequest struct {
+	Term    string
+	Columns uint32
+	Rows    uint32
+	Width   uint32
+	Height  uint32
+	Modes   string
+}
+
+// windowChange is the payload of a "window-change" request (RFC 4254 section 6.7).
+type windowChange struct {
+	Columns uint32
+	Rows    uint32
+	Width   uint32
+	Height  uint32
+}
+
+// commandRequest is the payload of an "exec" or "subsystem" request (RFC 4254 section 6.5).
+type commandRequest struct {
+	Command string
+}
+
+// exitStatus is the payload of an "exit-status" request (RFC 4254 section 6.10).
+type exitStatus struct {
+	Status uint32
+}
+
+// parseExitStatus returns the exit status if req is an "exit-status" request.
+func parseExitStatus(req *ssh.Request) (uint32, bool) {
+	if req.Type != "exit-status" {
+		return 0, false
+	}
+
+	var status exitStatus
+	err := ssh.Unmarshal(req.Payload, &status)
+	if err != nil {
+		return 0, false
+	}
+
+	return status.Status, true
+}
+
+// envRequest is the payload of an "env" request (RFC 4254 section 6.4).
+type envRequest struct {
+	Name  string
+	Value string
+}
+
+// directTCPIP is the extra data of a "direct-tcpip" channel (RFC 4254 section 7.2).
+type directTCPIP struct {
+	Host       string
+	Port       uint32
+	OriginHost string
+	OriginPort uint32
+}
+
+// requestEvent returns the audit event for a request made by the user,
+// or false if the request is not worth auditing.
+func requestEvent(channel string, req *ssh.Request) (audit.Event, bool) {
+	event := audit.Event{
+		Event:   audit.ChannelRequest,
+		Channel: channel,
+		Request: req.Type,
+	}
+
+	switch req.Type {
+	case "window-change":
+		// too noisy to be useful
+		return event, false
+
+	case "exec", "subsystem":
+		var command commandRequest
+		err := ssh.Unmarshal(req.Payload, &command)
+		if err == nil {
+			event.Command = command.Command
+		}
+	}
+
+	return event, true
+}
+
+// permitChannel checks that the permissions allow the channel to be opened.
+// For forwarding channels it also returns the destination.
+func permitChannel(perms *ssh.Permissions, channel ssh.NewChannel) (string, ssh.RejectionReason, error) {
+	switch t := channel.ChannelType(); t {
+	case "session":
+		return "", 0, nil
+
+	case "direct-tcpip":
+		var dest directTCPIP
+		err := ssh.Unmarshal(channel.ExtraData(), &dest)
+		if err != nil {
+			return "", ssh.ConnectionFailed, fmt.Errorf("invalid direct-tcpip request: %w", err)
+		}
+
+		forward := net.JoinHostPort(dest.Host, strconv.FormatUint(uint64(dest.Port), 10))
+		if !config.PermitOpen(perms, dest.Host, dest.Port) {
+			return forward, ssh.Prohibited, fmt.Errorf("port forwarding to %s is not permitted", forward)
+		}
+
+		return forward, 0, nil
+
+	default:
+		return "", ssh.UnknownChannelType, fmt.Errorf("unknown channel type: %s", t)
+	}
+}
+
+// forcedEnv are the environment variables a user may still set when a
+// command is forced, like AcceptEnv of sshd. Others could change what the
+// forced command runs, as BASH_ENV or LD_PRELOAD do.
+var forcedEnv = []string{"LANG", "LC_*"}
+
+// restrict applies the permissions to a session request from the user.
+// Shell, exec and subsystem requests are rewritten to the forced command if
+// there is one, which receives the requested command in SSH_ORIGINAL_COMMAND
+// like it would from sshd.
+func restrict(ctx context.Context, perms *ssh.Permissions, channel ssh.Channel, req *ssh.Request) bool {
+	log := logger.FromContext(ctx)
+
+	switch req.Type {
+	case "pty-req":
+		return config.Permitted(perms, config.ExtensionPTY)
+
+	case "auth-agent-req@openssh.com":
+		return config.Permitted(perms, config.ExtensionAgentForward)
+
+	case "x11-req":
+		return config.Permitted(perms, config.ExtensionX11Forward)
+
+	case "env":
+		if config.ForceCommand(perms) == "" {
+			return true
+		}
+
+		var env envRequest
+		return ssh.Unmarshal(req.Payload, &env) == nil && acceptEnv(env.Name)
+
+	case "shell", "exec", "subsystem":
+		command := config.ForceCommand(perms)
+		if command == "" {
+			return true
+		}
+
+		var original commandRequest
+		if req.Type == "exec" && ssh.Unmarshal(req.Payload, &original) == nil {
+			env := ssh.Marshal(envRequest{Name: "SSH_ORIGINAL_COMMAND", Value: original.Command})
+			_, err := channel.SendRequest("env", false, env)
+			if err != nil {
+				log.WarnContext(ctx, "Could not send original command", "error", err)
+			}
+		}
+
+		req.Type = "exec"
+		req.Payload = ssh.Marshal(commandRequest{Command: command})
+	}
+
+	return true
+}
+
+// acceptEnv reports whether a user may set the environment variable name
+// when a command is forced.
+func acceptEnv(name string) bool {
+	if strings.ContainsAny(name, "=\x00") {
+		return false
+	}
+
+	for _, pattern := range forcedEnv {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
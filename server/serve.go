@@ -0,0 +1,517 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/trunners/runners/logger"
+	"github.com/trunners/runners/server/audit"
+	"github.com/trunners/runners/server/config"
+	"github.com/trunners/runners/server/github"
+	"github.com/trunners/runners/server/metrics"
+	"github.com/trunners/runners/server/pool"
+	"github.com/trunners/runners/server/quota"
+	"github.com/trunners/runners/server/recording"
+	"github.com/trunners/runners/server/state"
+)
+
+// services are what sessions are served with. The config is the one current
+// when the user connected.
+type services struct {
+	cfg      *config.Config
+	gh       github.Github
+	pool     *pool.Pool
+	quota    *quota.Quota
+	store    *state.Store
+	audit    *audit.Logger
+	sessions *sessions
+}
+
+// wanted is what a user asked to launch, in the username or by picking it.
+type wanted struct {
+	// name is the target or alias named, or the capabilities asked for.
+	name string
+	// candidates are the targets that may serve the user.
+	candidates []string
+	// named is set if name names a target rather than capabilities.
+	named bool
+	// params are the parameters chosen in the username.
+	params map[string]string
+	// err tells why the username does not resolve.
+	err error
+	// held is the channel the target was picked on, if it was picked.
+	held *held
+}
+
+// serve serves an SSH connection: it authenticates the user, finds the
+// targets they may launch, leases a runner, launches it and relays the
+// session to it.
+func serve(ctx context.Context, svc *services, serverTCP pool.Connection) {
+	log := logger.FromContext(ctx)
+	defer serverTCP.Close()
+
+	serverSSH, serverChans, ok := svc.handshake(ctx, serverTCP)
+	if !ok {
+		return
+	}
+
+	// The username names a target or alias, possibly with parameters
+	name, params, resolveErr := svc.cfg.Resolve(serverSSH.User())
+
+	s := svc.newSession(ctx, serverSSH, name)
+	reason := "connection closed"
+	defer func() {
+		if cause := ended(ctx); cause != nil {
+			reason = cause.Error()
+		}
+		s.audit.End(ctx, reason)
+	}()
+
+	want := wanted{name: name, params: params, err: resolveErr}
+	want, answered, ok := svc.choose(ctx, s, serverSSH, serverChans, want)
+	if answered != "" {
+		reason = answered
+	}
+	if !ok {
+		return
+	}
+
+	// Refuse on the channel of a picked target, or else on the first session channel
+	names, refused, message := svc.authorize(ctx, s, want, serverSSH.User())
+	if len(names) == 0 {
+		reason = refused
+		metrics.Connections.Inc("rejected", reason)
+		if want.held != nil {
+			want.held.abandon()
+			fail(ctx, want.held.channel, message)
+			return
+		}
+		reject(ctx, serverChans, message)
+		return
+	}
+
+	// End the session when it times out, is terminated or the user leaves
+	// while waiting for a runner, whose channels are held meanwhile
+	ctx, s.cancel = context.WithCancelCause(ctx)
+	defer s.cancel(nil)
+	l := enter(ctx, serverChans, s.cancel, want.held)
+	s.lobby = l
+
+	// Send the user away to reconnect if the broker shuts down before the runner connected
+	stopRestart := context.AfterFunc(svc.sessions.closing, func() {
+		if s.runner() == nil {
+			s.cancel(errRestart)
+		}
+	})
+	defer stopRestart()
+
+	targets, message := svc.targets(ctx, s, want, names)
+	if len(targets) == 0 {
+		reason = "invalid parameters"
+		metrics.Connections.Inc("rejected", reason)
+		l.turnAway(ctx, serverChans, message)
+		return
+	}
+
+	requests := make([]quota.Request, 0, len(targets))
+	for _, target := range targets {
+		requests = append(requests, launchRequest(svc.cfg, s.user, s.perms, target))
+	}
+	i, lease, err := svc.lease(ctx, s, requests)
+	if err != nil {
+		log.WarnContext(ctx, "Could not acquire runner", "user", s.user, "target", want.name, "error", err)
+		reason, message = leaseFailure(ctx, want.name, err)
+		metrics.Connections.Inc("rejected", reason)
+		l.turnAway(ctx, serverChans, message)
+		return
+	}
+	defer func() {
+		err = lease.Release()
+		if err != nil {
+			log.ErrorContext(ctx, "Failed to record usage", "error", err)
+		}
+	}()
+
+	target := targets[i]
+	s.target = target.Name
+	s.audit.SetTarget(target.String())
+	log.InfoContext(ctx, "Target chosen", "target", target.String())
+
+	metrics.Connections.Inc("accepted", "")
+	metrics.Sessions.Inc(s.target)
+	s.started = time.Now()
+	defer func() {
+		metrics.Sessions.Dec(s.target)
+		metrics.SessionDurations.Observe(time.Since(s.started).Seconds(), s.target)
+	}()
+
+	// Close the connection once the broker ended the session, after telling the user why
+	stop := context.AfterFunc(ctx, func() {
+		if !waited(context.Cause(ctx)) {
+			_ = serverSSH.Close()
+		}
+	})
+	defer stop()
+	s.activity.touch()
+
+	// The timeouts are those of the target, which changes on failover
+	var stopWatch context.CancelFunc
+	watch := func(w config.Workflow, lease *quota.Lease) {
+		if stopWatch != nil {
+			stopWatch()
+		}
+
+		var watchCtx context.Context
+		watchCtx, stopWatch = context.WithCancel(ctx)
+		go sessionTimeouts(w, lease).watch(watchCtx, s)
+	}
+	watch(target.Workflow, lease)
+	defer func() { stopWatch() }()
+
+	remove := svc.sessions.add(s)
+	defer remove()
+
+	// Dispatch the workflow, falling back to the next targets while runners take too long
+	launcher := &launcher{
+		cfg:      svc.cfg,
+		gh:       svc.gh,
+		pool:     svc.pool,
+		quota:    svc.quota,
+		store:    svc.store,
+		session:  s,
+		targets:  targets,
+		requests: requests,
+		switched: func(next config.Target, nextLease *quota.Lease) {
+			lease = nextLease
+			watch(next.Workflow, nextLease)
+		},
+	}
+	launched, err := launcher.launch(ctx, i, lease)
+	lease = launched.lease
+
+	// Remember the run until the session ends, to cancel it should the broker crash
+	defer func() {
+		if !launched.recorded {
+			return
+		}
+
+		err = svc.store.End(s.id)
+		if err != nil {
+			log.ErrorContext(ctx, "Failed to forget session", "error", err)
+		}
+	}()
+	defer func() {
+		if !cancelRun(context.Cause(ctx)) || launched.run.ID == 0 {
+			return
+		}
+
+		w := launched.target.Workflow
+		err = svc.gh.Cancel(context.WithoutCancel(ctx), w.Owner, w.Repository, launched.run.ID)
+		if err != nil {
+			log.WarnContext(ctx, "Failed to cancel workflow run", "error", err)
+		}
+	}()
+
+	if err != nil {
+		reason, message = launchFailure(ctx, launched.target.Name, err)
+		l.turnAway(ctx, serverChans, message)
+		return
+	}
+
+	refused = svc.relay(ctx, s, l, serverChans, launched)
+	if refused != "" {
+		reason = refused
+	}
+}
+
+// handshake authenticates the user of the connection, throttling addresses
+// that fail to.
+func (svc *services) handshake(
+	ctx context.Context,
+	serverTCP pool.Connection,
+) (*ssh.ServerConn, <-chan ssh.NewChannel, bool) {
+	log := logger.FromContext(ctx)
+
+	log.InfoContext(ctx, "Creating SSH server")
+	serverSSH, serverChans, serverReqs, err := ssh.NewServerConn(serverTCP, svc.cfg.Server)
+	if err != nil {
+		log.ErrorContext(ctx, "Failed to create SSH server", "error", err)
+		metrics.Connections.Inc("rejected", "handshake failed")
+		if svc.pool.Throttle().Fail(serverTCP.RemoteAddr()) {
+			log.WarnContext(ctx, "Banning address", "remote", serverTCP.RemoteAddr())
+		}
+		return nil, nil, false
+	}
+	svc.pool.Throttle().Succeed(serverTCP.RemoteAddr())
+	go hostKeys(ctx, serverSSH, serverReqs, svc.cfg.HostKeys)
+
+	return serverSSH, serverChans, true
+}
+
+// newSession starts the session of an authenticated connection and its
+// audit trail.
+func (svc *services) newSession(ctx context.Context, serverSSH *ssh.ServerConn, name string) *session {
+	user := serverSSH.Permissions.Extensions[config.ExtensionUser]
+	logger.FromContext(ctx).InfoContext(ctx, "SSH connection established", "target", serverSSH.User(), "user", user)
+
+	s := &session{
+		id:       hex.EncodeToString(serverSSH.SessionID()[:8]),
+		user:     user,
+		target:   name,
+		perms:    serverSSH.Permissions,
+		channels: map[ssh.Channel]struct{}{},
+	}
+	remoteIP, _, _ := net.SplitHostPort(serverSSH.RemoteAddr().String())
+	s.audit = svc.audit.Session(ctx, audit.Event{
+		Session:     s.id,
+		User:        user,
+		Fingerprint: serverSSH.Permissions.Extensions[config.ExtensionFingerprint],
+		RemoteIP:    remoteIP,
+		Target:      serverSSH.User(),
+	})
+
+	return s
+}
+
+// choose finds the targets that may serve what the user wants. Without any
+// the user runs broker commands or picks a target interactively, and choose
+// returns how the broker answered them. It fails unless a target was picked.
+func (svc *services) choose(
+	ctx context.Context,
+	s *session,
+	serverSSH *ssh.ServerConn,
+	serverChans <-chan ssh.NewChannel,
+	want wanted,
+) (wanted, string, bool) {
+	want.candidates, want.named = candidates(svc.cfg, serverSSH.User(), want.name)
+	if len(want.candidates) > 0 {
+		if !want.named {
+			want.name = serverSSH.User()
+		}
+		return want, "", true
+	}
+
+	log := logger.FromContext(ctx)
+	log.InfoContext(ctx, "No workflow found for user, answering broker commands", "user", serverSSH.User())
+	message := fmt.Sprintf("Unknown target %q.", serverSSH.User())
+	switch {
+	case want.name != config.Reserved:
+	case !config.Permitted(s.perms, config.ExtensionPTY):
+		message = "Name a target in the username, this key may not open a terminal to pick one."
+	default:
+		message = "Connect with a terminal to pick a target."
+	}
+
+	options := choices(svc.cfg, svc.quota, svc.sessions, s.user, s.perms)
+	reason, target := broker(ctx, svc.cfg, serverChans, s, message, options)
+	if target == nil {
+		metrics.Connections.Inc("accepted", "broker")
+		return want, reason, false
+	}
+
+	return wanted{
+		name:       target.target,
+		candidates: []string{target.target},
+		named:      true,
+		held:       target.held,
+	}, reason, true
+}
+
+// authorize narrows the candidates to the targets the user may launch and
+// that are not drained. If none is left, it returns why along with the
+// message to refuse the user with.
+func (svc *services) authorize(
+	ctx context.Context,
+	s *session,
+	want wanted,
+	username string,
+) ([]string, string, string) {
+	log := logger.FromContext(ctx)
+
+	names := slices.DeleteFunc(want.candidates, func(target string) bool {
+		return !config.Allowed(s.perms, target)
+	})
+	if len(names) == 0 {
+		log.WarnContext(ctx, "User may not launch target", "user", s.user, "target", want.name)
+		allowed := s.perms.Extensions[config.ExtensionTargets]
+		if allowed == "" {
+			allowed = "none"
+		}
+		message := fmt.Sprintf("%s is not allowed to launch %q. Allowed targets: %s.", s.user, want.name, allowed)
+		return nil, "not authorized", message
+	}
+
+	if want.named && want.err != nil {
+		log.InfoContext(ctx, "Invalid target parameters", "user", s.user, "target", username, "error", want.err)
+		return nil, "invalid parameters", fmt.Sprintf("Cannot launch %q: %s.", want.name, want.err)
+	}
+
+	names = slices.DeleteFunc(names, svc.sessions.draining)
+	if len(names) == 0 {
+		log.InfoContext(ctx, "Target is drained", "user", s.user, "target", want.name)
+		return nil, "target drained", fmt.Sprintf("Target %q is not accepting new sessions.", want.name)
+	}
+
+	return names, "", ""
+}
+
+// targets applies the parameters to the named target, which may also be sent
+// as environment variables, or else returns the targets with the
+// capabilities asked for with their default parameters, in the order they are
+// preferred in. If there are none, it returns the message to turn the user
+// away with.
+func (svc *services) targets(ctx context.Context, s *session, want wanted, names []string) ([]config.Target, string) {
+	log := logger.FromContext(ctx)
+
+	if want.named {
+		// Parameters may also be sent as environment variables, those in the username win
+		w := svc.cfg.Workflows[want.name]
+		params := map[string]string{}
+		if len(w.Params) > 0 {
+			params = w.FromEnv(s.lobby.env(ctx, envWait))
+		}
+		maps.Copy(params, want.params)
+		target, err := w.Target(want.name, params)
+		if err != nil {
+			log.InfoContext(ctx, "Invalid target parameters", "user", s.user, "target", want.name, "error", err)
+			return nil, fmt.Sprintf("Cannot launch %q:\r\n%s", want.name, strings.ReplaceAll(err.Error(), "\n", "\r\n"))
+		}
+		return []config.Target{target}, ""
+	}
+
+	// Targets matching capabilities are launched with their default parameters
+	var targets []config.Target
+	for _, match := range names {
+		target, err := svc.cfg.Workflows[match].Target(match, nil)
+		if err == nil {
+			targets = append(targets, target)
+		}
+	}
+	if svc.cfg.Selection.Prefer == config.PreferWait {
+		preferWait(svc.quota, targets, func(target config.Target) quota.Request {
+			return launchRequest(svc.cfg, s.user, s.perms, target)
+		})
+	}
+	log.InfoContext(ctx, "Targets matched", "user", s.user, "capabilities", want.name, "targets", len(targets))
+
+	if len(targets) == 0 {
+		return nil, fmt.Sprintf("Cannot launch %q: every matching target requires parameters.", want.name)
+	}
+	return targets, ""
+}
+
+// lease leases a runner of the first of the requested targets that is not at
+// capacity, and returns its index. If all are, it waits in the queue of the
+// preferred one.
+func (svc *services) lease(ctx context.Context, s *session, requests []quota.Request) (int, *quota.Lease, error) {
+	i, lease, err := acquire(svc.quota, requests, 0)
+
+	var busy *quota.BusyError
+	if errors.As(err, &busy) {
+		log := logger.FromContext(ctx)
+		log.InfoContext(ctx, "Target at capacity, queueing", "user", s.user, "target", requests[i].Target)
+		priority := svc.cfg.Priority(s.user, config.Groups(s.perms))
+		lease, err = queue(ctx, svc.quota, requests[i], priority, s.lobby)
+	}
+
+	return i, lease, err
+}
+
+// leaseFailure returns the reason a session ended without a runner leased,
+// and the message to turn the user away with.
+func leaseFailure(ctx context.Context, name string, err error) (string, string) {
+	switch {
+	case errors.Is(err, errLeft), errors.Is(err, errDisconnected):
+		return err.Error(), "Left the queue."
+	case errors.Is(context.Cause(ctx), errRestart):
+		return errRestart.Error(), restartMessage
+	default:
+		return "limit reached", fmt.Sprintf("Cannot launch %q: %s.", name, err)
+	}
+}
+
+// launchFailure returns the reason a session ended before its runner
+// connected, and the message to turn the user away with.
+func launchFailure(ctx context.Context, name string, err error) (string, string) {
+	var runErr *runError
+	switch cause := context.Cause(ctx); {
+	case errors.Is(cause, errRestart):
+		return cause.Error(), restartMessage
+	case errors.Is(err, errDispatch):
+		return errDispatch.Error(), fmt.Sprintf("Could not launch %q.", name)
+	case errors.As(cause, &runErr):
+		message := "The workflow run ended (%s) before its runner connected: %s"
+		return runErr.Error(), fmt.Sprintf(message, runErr.conclusion, runErr.url)
+	case errors.Is(cause, errLeft), errors.Is(cause, errDisconnected):
+		return cause.Error(), "Cancelled the launch."
+	default:
+		return "no runner", "No runner connected."
+	}
+}
+
+// relay connects to the runner that called back and relays the channels of
+// the user to it until the session ends. It returns why if it could not
+// connect.
+func (svc *services) relay(
+	ctx context.Context,
+	s *session,
+	l *lobby,
+	serverChans <-chan ssh.NewChannel,
+	launched launched,
+) string {
+	log := logger.FromContext(ctx)
+
+	clientTCP := launched.runner
+	defer clientTCP.Close()
+
+	target := launched.target
+	if w := target.Workflow; w.Record.Enabled {
+		s.recorder = recording.New(svc.cfg.Recordings, target.Name, s.user, time.Duration(w.Record.Retention))
+		err := s.recorder.Prune()
+		if err != nil {
+			log.WarnContext(ctx, "Failed to prune recordings", "error", err)
+		}
+	}
+
+	metrics.Callbacks.Observe(time.Since(launched.dispatched).Seconds(), s.target)
+	err := svc.quota.Provisioned(target.Name, time.Since(launched.dispatched))
+	if err != nil {
+		log.WarnContext(ctx, "Failed to record provisioning latency", "error", err)
+	}
+
+	s.audit.SetRunner(clientTCP.Runner.String())
+	s.audit.Log(ctx, audit.Event{Event: audit.RunnerConnect})
+
+	log.InfoContext(ctx, "Creating SSH client")
+	clientSSH, clientChans, clientReqs, err := ssh.NewClientConn(clientTCP, "localhost:22", svc.cfg.Client)
+	if err != nil {
+		log.ErrorContext(ctx, "Failed to create SSH client", "error", err)
+		l.turnAway(ctx, serverChans, "Could not connect to the runner.")
+		return "runner handshake failed"
+	}
+	s.mu.Lock()
+	s.client = ssh.NewClient(clientSSH, clientChans, clientReqs)
+	s.runnerName = clientTCP.Runner.String()
+	s.mu.Unlock()
+	s.activity.touch()
+
+	log.InfoContext(ctx, "Connecting server to client")
+	h, pending := l.exit()
+	defer h.abandon()
+	if h != nil {
+		go h.resume(ctx, s)
+	}
+	channel(ctx, prepend(pending, serverChans), s)
+
+	log.InfoContext(ctx, "Connection terminated")
+	return ""
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/trunners/runners/logger"
+	"github.com/trunners/runners/server/config"
+)
+
+var (
+	errRestart  = errors.New("broker restarting")
+	errShutdown = errors.New("broker shut down")
+)
+
+// restartMessage tells users sent away while waiting for a runner to try again.
+const restartMessage = "The broker is restarting, please reconnect."
+
+// shutdown stops the broker from starting sessions, sending away users that
+// still wait for a runner so that they reconnect to the broker taking over.
+// Sessions on runners go on until timeout, their users being warned before.
+func (a *sessions) shutdown(ctx context.Context, timeout time.Duration) {
+	log := logger.FromContext(ctx)
+	a.stop()
+
+	deadline := time.Now().Add(timeout)
+	warnings := config.Timeouts{}.WarningDurations()
+	for _, s := range a.list() {
+		if s.runner() == nil {
+			continue
+		}
+		s.notify(fmt.Sprintf("The broker is shutting down, this session ends in %s.", timeout.Round(time.Second)))
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	// the warnings due already are given with the first one
+	warned, _ := due(warnings, timeout, 0)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		list := a.list()
+		if len(list) == 0 {
+			log.InfoContext(ctx, "All sessions ended")
+			return
+		}
+
+		left := time.Until(deadline)
+		if left <= 0 {
+			log.InfoContext(ctx, "Ending remaining sessions", "sessions", len(list))
+			for _, s := range list {
+				s.end(ctx, errShutdown, "The broker shut down.")
+			}
+			return
+		}
+
+		if warning, ok := due(warnings, left, warned); ok {
+			warned = warning
+			for _, s := range list {
+				s.notify(fmt.Sprintf("The broker is shutting down, this session ends in %s.", left.Round(time.Second)))
+			}
+		}
+	}
+}
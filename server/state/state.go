@@ -0,0 +1,332 @@
+// Package state keeps what the broker must remember across restarts: the
+// sessions with the workflow runs dispatched for them, and the quota usage.
+// It is an append-only log of JSON lines that is compacted to a snapshot
+// when it is opened and once it grew long. A lock file serializes the
+// brokers sharing the log while one hands over to another.
+package state
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// compactAfter is the number of entries appended before the log is compacted.
+const compactAfter = 1000
+
+// Session is a session that dispatched a workflow run, recorded until it
+// ends so that the run can be cancelled if the broker does not end it.
+type Session struct {
+	ID         string    `json:"id"`
+	User       string    `json:"user"`
+	Target     string    `json:"target"`
+	Owner      string    `json:"owner"`
+	Repository string    `json:"repository"`
+	RunID      int64     `json:"run_id"`
+	Token      string    `json:"token"`
+	Started    time.Time `json:"started"`
+
+	// Broker is the process ID of the broker serving the session.
+	Broker int `json:"broker"`
+}
+
+// entry is a line of the log, recording a session, its end or the usage.
+type entry struct {
+	Session *Session        `json:"session,omitempty"`
+	End     string          `json:"end,omitempty"`
+	Usage   json.RawMessage `json:"usage,omitempty"`
+}
+
+// snapshot is the state the log adds up to.
+type snapshot struct {
+	sessions map[string]Session
+	usage    json.RawMessage
+}
+
+// Store appends to the log at its location.
+type Store struct {
+	mu       sync.Mutex
+	location string
+	lock     *os.File
+	file     *os.File
+	entries  int
+}
+
+// Open opens the log at location, creating it if it does not exist.
+func Open(location string) (*Store, error) {
+	lock, err := os.OpenFile(location+".lock", os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Store{location: location, lock: lock}
+	err = s.locked(s.compact)
+	if err != nil {
+		_ = lock.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Close closes the log.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err error
+	if s.file != nil {
+		err = s.file.Close()
+	}
+
+	return errors.Join(err, s.lock.Close())
+}
+
+// Start records a session.
+func (s *Store) Start(session Session) error {
+	return s.append(entry{Session: &session})
+}
+
+// End forgets the session with the given ID.
+func (s *Store) End(id string) error {
+	return s.append(entry{End: id})
+}
+
+// Sessions returns the recorded sessions, oldest first.
+func (s *Store) Sessions() ([]Session, error) {
+	var sessions []Session
+	err := s.locked(func() error {
+		snap, err := s.read()
+		for _, session := range snap.sessions {
+			sessions = append(sessions, session)
+		}
+
+		return err
+	})
+
+	slices.SortFunc(sessions, func(a, b Session) int {
+		return a.Started.Compare(b.Started)
+	})
+
+	return sessions, err
+}
+
+// Usage reads the recorded usage into v, leaving it as is if there is none.
+func (s *Store) Usage(v any) error {
+	var usage json.RawMessage
+	err := s.locked(func() error {
+		snap, err := s.read()
+		usage = snap.usage
+		return err
+	})
+	if err != nil || usage == nil {
+		return err
+	}
+
+	return json.Unmarshal(usage, v)
+}
+
+// UpdateUsage records the usage update returns when passed the usage
+// recorded last, nil if there is none. The log stays locked meanwhile, so
+// that brokers sharing it do not overwrite each other's usage.
+func (s *Store) UpdateUsage(update func(recorded json.RawMessage) (any, error)) error {
+	return s.locked(func() error {
+		snap, err := s.read()
+		if err != nil {
+			return err
+		}
+
+		v, err := update(snap.usage)
+		if err != nil {
+			return err
+		}
+
+		usage, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+
+		return s.write(entry{Usage: usage})
+	})
+}
+
+// append writes e to the end of the log.
+func (s *Store) append(e entry) error {
+	return s.locked(func() error {
+		return s.write(e)
+	})
+}
+
+// write writes e to the end of the log, compacting it once it grew long. The
+// lock must be held.
+func (s *Store) write(e entry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	err = s.reopen()
+	if err != nil {
+		return err
+	}
+
+	_, err = s.file.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+
+	s.entries++
+	if s.entries < compactAfter {
+		return nil
+	}
+
+	return s.compact()
+}
+
+// locked calls f holding the lock of the log, which other brokers honor too.
+func (s *Store) locked(f func() error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := syscall.Flock(int(s.lock.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		return fmt.Errorf("lock %s: %w", s.location, err)
+	}
+	defer syscall.Flock(int(s.lock.Fd()), syscall.LOCK_UN) //nolint:errcheck // closing the lock file unlocks it too
+
+	return f()
+}
+
+// reopen opens the log for appending unless the open file is still the log,
+// which it is not after another broker compacted it.
+func (s *Store) reopen() error {
+	if s.file != nil {
+		current, err := os.Stat(s.location)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+
+		open, err := s.file.Stat()
+		if err != nil {
+			return err
+		}
+
+		if current != nil && os.SameFile(current, open) {
+			return nil
+		}
+
+		_ = s.file.Close()
+		s.file = nil
+	}
+
+	file, err := os.OpenFile(s.location, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+
+	s.file = file
+	return nil
+}
+
+// read replays the log.
+func (s *Store) read() (snapshot, error) {
+	snap := snapshot{sessions: map[string]Session{}}
+
+	file, err := os.Open(s.location)
+	if errors.Is(err, os.ErrNotExist) {
+		return snap, nil
+	}
+	if err != nil {
+		return snap, err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	for n := 1; ; n++ {
+		line, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			// a line without newline was cut off by a crash while writing it
+			return snap, nil
+		}
+		if err != nil {
+			return snap, err
+		}
+
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		var e entry
+		err = json.Unmarshal(line, &e)
+		if err != nil {
+			return snap, fmt.Errorf("%s:%d: %w", s.location, n, err)
+		}
+
+		switch {
+		case e.Session != nil:
+			snap.sessions[e.Session.ID] = *e.Session
+		case e.End != "":
+			delete(snap.sessions, e.End)
+		case e.Usage != nil:
+			snap.usage = e.Usage
+		}
+	}
+}
+
+// compact replaces the log with the entries of its snapshot.
+func (s *Store) compact() error {
+	snap, err := s.read()
+	if err != nil {
+		return err
+	}
+
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	for _, session := range snap.sessions {
+		err = enc.Encode(entry{Session: &session})
+		if err != nil {
+			return err
+		}
+	}
+	if snap.usage != nil {
+		err = enc.Encode(entry{Usage: snap.usage})
+		if err != nil {
+			return err
+		}
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(s.location), filepath.Base(s.location)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.Write(b.Bytes())
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(file.Name(), s.location)
+	if err != nil {
+		return err
+	}
+
+	s.entries = len(snap.sessions)
+	return s.reopen()
+}
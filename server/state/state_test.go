@@ -0,0 +1,243 @@
+package state
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func open(t *testing.T, location string) *Store {
+	t.Helper()
+
+	s, err := Open(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+
+	return s
+}
+
+func ids(t *testing.T, s *Store) []string {
+	t.Helper()
+
+	sessions, err := s.Sessions()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []string
+	for _, session := range sessions {
+		ids = append(ids, session.ID)
+	}
+
+	return ids
+}
+
+func lines(t *testing.T, location string) int {
+	t.Helper()
+
+	b, err := os.ReadFile(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return bytes.Count(b, []byte("\n"))
+}
+
+func TestOpen(t *testing.T) {
+	tests := []struct {
+		name     string
+		log      string
+		sessions []string
+		usage    string
+		lines    int
+		err      string
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name: "ended sessions are forgotten",
+			log: `{"session":{"id":"a","started":"2026-01-01T00:00:00Z"}}
+{"session":{"id":"b","started":"2026-01-02T00:00:00Z"}}
+{"end":"a"}
+`,
+			sessions: []string{"b"},
+			lines:    1,
+		},
+		{
+			name: "the last usage wins",
+			log: `{"usage":{"n":1}}
+{"usage":{"n":2}}
+`,
+			usage: `{"n":2}`,
+			lines: 1,
+		},
+		{
+			name: "a line cut off is dropped",
+			log: `{"session":{"id":"a","started":"2026-01-01T00:00:00Z"}}
+{"session":{"id":"b","sta`,
+			sessions: []string{"a"},
+			lines:    1,
+		},
+		{
+			name: "blank lines are skipped",
+			log: `
+{"session":{"id":"a","started":"2026-01-01T00:00:00Z"}}
+
+`,
+			sessions: []string{"a"},
+			lines:    1,
+		},
+		{
+			name: "malformed",
+			log: `{"session":{"id":"a"}}
+not json
+`,
+			err: ":2: ",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			location := filepath.Join(t.TempDir(), "state.jsonl")
+			if test.log != "" {
+				err := os.WriteFile(location, []byte(test.log), 0o600)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			s, err := Open(location)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got error %v, want one containing %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { _ = s.Close() })
+
+			if got := ids(t, s); !slices.Equal(got, test.sessions) {
+				t.Errorf("got sessions %v, want %v", got, test.sessions)
+			}
+
+			var usage json.RawMessage
+			err = s.Usage(&usage)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(usage) != test.usage {
+				t.Errorf("got usage %s, want %s", usage, test.usage)
+			}
+
+			if got := lines(t, location); got != test.lines {
+				t.Errorf("got %d lines after compaction, want %d", got, test.lines)
+			}
+		})
+	}
+}
+
+func TestCompact(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "state.jsonl")
+	s := open(t, location)
+
+	err := s.Start(Session{ID: "kept", Started: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range compactAfter {
+		id := fmt.Sprint(i)
+		err = s.Start(Session{ID: id})
+		if err == nil {
+			err = s.End(id)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the log is compacted each time compactAfter entries were appended
+	if got := lines(t, location); got >= compactAfter {
+		t.Errorf("got %d lines, want the log compacted", got)
+	}
+	if got := ids(t, s); !slices.Equal(got, []string{"kept"}) {
+		t.Errorf("got sessions %v, want [kept]", got)
+	}
+
+	// the log reopened after compaction is still appended to
+	err = s.Start(Session{ID: "last", Started: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(t, open(t, location)); !slices.Equal(got, []string{"kept", "last"}) {
+		t.Errorf("got sessions %v after reopening, want [kept last]", got)
+	}
+}
+
+func TestShared(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "state.jsonl")
+	old := open(t, location)
+
+	err := old.Start(Session{ID: "a", Started: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the broker taking over compacts the log, replacing the file the old one appends to
+	upgraded := open(t, location)
+
+	err = old.Start(Session{ID: "b", Started: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = upgraded.End("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, s := range map[string]*Store{"old": old, "upgraded": upgraded} {
+		if got := ids(t, s); !slices.Equal(got, []string{"b"}) {
+			t.Errorf("%s broker got sessions %v, want [b]", name, got)
+		}
+	}
+}
+
+func TestUpdateUsage(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "state.jsonl")
+	s := open(t, location)
+
+	for i := 1; i <= 2; i++ {
+		err := s.UpdateUsage(func(recorded json.RawMessage) (any, error) {
+			if i == 1 && recorded != nil {
+				t.Errorf("got recorded usage %s, want none", recorded)
+			}
+			if i == 2 && string(recorded) != `{"N":1}` {
+				t.Errorf("got recorded usage %s, want {\"N\":1}", recorded)
+			}
+
+			return struct{ N int }{i}, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var usage struct{ N int }
+	err := open(t, location).Usage(&usage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.N != 2 {
+		t.Errorf("got usage %d, want 2", usage.N)
+	}
+}
@@ -0,0 +1,149 @@
+// Package throttle backs off addresses that keep failing to authenticate or
+// to complete handshakes, and bans them for a while after too many failures.
+package throttle
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// forget is how long failures are remembered after the last one, unless
+// the address is backed off or banned for longer.
+const forget = time.Hour
+
+// Throttle counts failures per address. After n failures an address is
+// refused for backoff * 2^(n-1), at most maxBackoff, and for ban once it
+// failed banAfter times.
+type Throttle struct {
+	backoff    time.Duration
+	maxBackoff time.Duration
+	banAfter   int
+	ban        time.Duration
+
+	mu     sync.Mutex
+	hosts  map[netip.Addr]*host
+	pruned time.Time
+}
+
+type host struct {
+	failures int
+	last     time.Time
+	until    time.Time
+}
+
+// New creates a throttle. Addresses are never banned if banAfter is zero.
+func New(backoff, maxBackoff time.Duration, banAfter int, ban time.Duration) *Throttle {
+	return &Throttle{
+		backoff:    backoff,
+		maxBackoff: maxBackoff,
+		banAfter:   banAfter,
+		ban:        ban,
+		hosts:      map[netip.Addr]*host{},
+	}
+}
+
+// Allow reports whether addr may connect now, and otherwise for how long
+// it is refused. A nil throttle allows every address.
+func (t *Throttle) Allow(addr net.Addr) (time.Duration, bool) {
+	if t == nil {
+		return 0, true
+	}
+
+	ip, ok := parse(addr)
+	if !ok {
+		return 0, true
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	h, ok := t.hosts[ip]
+	if !ok {
+		return 0, true
+	}
+
+	wait := time.Until(h.until)
+	return wait, wait <= 0
+}
+
+// Fail records a failure of addr and returns whether it is banned now.
+func (t *Throttle) Fail(addr net.Addr) bool {
+	if t == nil {
+		return false
+	}
+
+	ip, ok := parse(addr)
+	if !ok {
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	t.prune(now)
+
+	h, ok := t.hosts[ip]
+	if !ok {
+		h = &host{}
+		t.hosts[ip] = h
+	}
+	h.failures++
+	h.last = now
+
+	if t.banAfter > 0 && h.failures >= t.banAfter {
+		h.until = now.Add(t.ban)
+		return true
+	}
+
+	wait := t.backoff << min(h.failures-1, 30) //nolint:mnd // avoid overflowing the shift
+	if wait <= 0 || wait > t.maxBackoff {
+		wait = t.maxBackoff
+	}
+	h.until = now.Add(wait)
+
+	return false
+}
+
+// Succeed forgets the failures of addr.
+func (t *Throttle) Succeed(addr net.Addr) {
+	if t == nil {
+		return
+	}
+
+	ip, ok := parse(addr)
+	if !ok {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.hosts, ip)
+}
+
+// prune forgets addresses that neither failed nor were refused for a while,
+// so that the number of addresses stays bounded.
+func (t *Throttle) prune(now time.Time) {
+	if now.Sub(t.pruned) < time.Minute {
+		return
+	}
+	t.pruned = now
+
+	for ip, h := range t.hosts {
+		if now.Sub(h.last) > forget && now.After(h.until) {
+			delete(t.hosts, ip)
+		}
+	}
+}
+
+func parse(addr net.Addr) (netip.Addr, bool) {
+	addrPort, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.Addr{}, false
+	}
+
+	return addrPort.Addr().Unmap(), true
+}
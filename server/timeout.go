@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/trunners/runners/callback"
+	"github.com/trunners/runners/logger"
+)
+
+var (
+	errIdle      = errors.New("idle timeout")
+	errTimeLimit = errors.New("time limit reached")
+)
+
+// activity records when data last passed through any channel of a session.
+type activity struct {
+	last atomic.Int64
+}
+
+func (a *activity) touch() {
+	a.last.Store(time.Now().UnixNano())
+}
+
+// Write records activity, it never fails so that it can be teed into copies.
+func (a *activity) Write(p []byte) (int, error) {
+	a.touch()
+	return len(p), nil
+}
+
+func (a *activity) since() time.Duration {
+	return time.Since(time.Unix(0, a.last.Load()))
+}
+
+// timeouts ends a session that was idle for too long or reached its deadline.
+type timeouts struct {
+	idle     time.Duration
+	deadline time.Time
+	warnings []time.Duration
+}
+
+// watch warns the user before the session times out and ends it with
+// errIdle or errTimeLimit when it does.
+func (t timeouts) watch(ctx context.Context, s *session) {
+	if t.idle <= 0 && t.deadline.IsZero() {
+		return
+	}
+
+	warnings := slices.Clone(t.warnings)
+	slices.SortFunc(warnings, func(a, b time.Duration) int {
+		return int(b - a)
+	})
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	// the smallest warning given so far, reset by activity for the idle timeout
+	idleWarned, deadlineWarned := time.Duration(0), time.Duration(0)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if !t.deadline.IsZero() {
+			left := time.Until(t.deadline)
+			if left <= 0 {
+				s.end(ctx, errTimeLimit, "The session reached its time limit.")
+				return
+			}
+
+			if warning, ok := due(warnings, left, deadlineWarned); ok {
+				deadlineWarned = warning
+				s.notify(fmt.Sprintf("The session reaches its time limit in %s.", left.Round(time.Second)))
+			}
+		}
+
+		if t.idle > 0 {
+			left := t.idle - s.activity.since()
+			if left <= 0 {
+				s.end(ctx, errIdle, fmt.Sprintf("The session was idle for %s.", t.idle))
+				return
+			}
+
+			if left > idleWarned {
+				idleWarned = 0
+			}
+			if warning, ok := due(warnings, left, idleWarned); ok {
+				idleWarned = warning
+				s.notify(fmt.Sprintf("The session is idle and ends in %s without any input or output.", left.Round(time.Second)))
+			}
+		}
+	}
+}
+
+// due returns the smallest warning that is due with left time remaining,
+// unless it was given already.
+func due(warnings []time.Duration, left, given time.Duration) (time.Duration, bool) {
+	due := time.Duration(0)
+	for _, warning := range warnings {
+		if left <= warning {
+			due = warning
+		}
+	}
+
+	return due, due > 0 && (given == 0 || due < given)
+}
+
+// end tells the user why the session ends and the runner to exit, then
+// cancels the session with cause.
+func (s *session) end(ctx context.Context, cause error, message string) {
+	log := logger.FromContext(ctx)
+	log.InfoContext(ctx, "Ending session", "reason", cause)
+
+	s.notify(message)
+
+	if client := s.runner(); client != nil {
+		_, _, err := client.SendRequest(callback.ExitRequest, false, nil)
+		if err != nil {
+			log.WarnContext(ctx, "Could not tell runner to exit", "error", err)
+		}
+	}
+
+	s.cancel(cause)
+}
+
+// notify writes a message into the terminals of all session channels,
+// including one held while waiting for the runner.
+func (s *session) notify(message string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for channel := range s.channels {
+		_, _ = channel.Stderr().Write([]byte("\r\n*** " + message + " ***\r\n"))
+	}
+
+	// the user is still waiting for the runner
+	s.lobby.notify("*** " + message + " ***")
+}
+
+// track adds a session channel to those notified, until untrack is called.
+func (s *session) track(channel ssh.Channel) (untrack func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.channels[channel] = struct{}{}
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		delete(s.channels, channel)
+	}
+}
+
+// runner returns the connection to the runner once it connected.
+func (s *session) runner() *ssh.Client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.client
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/trunners/runners/logger"
+)
+
+// socketsEnv passes the listening sockets on to a new broker process as
+// name=fd pairs, like "broker=3,metrics=4".
+const socketsEnv = "RUNNERS_SOCKETS"
+
+// firstFD is the first file descriptor of files passed on to a process.
+const firstFD = 3
+
+// sockets are the listening sockets of the broker. They are passed on to a
+// new process when upgrading the broker, so that it accepts new connections
+// while the sessions of the old process finish.
+type sockets struct {
+	mu        sync.Mutex
+	inherited map[string]*os.File
+	names     []string
+	listeners map[string]*net.TCPListener
+}
+
+// inheritSockets takes over the sockets passed on by the process that
+// started this one, if any.
+func inheritSockets() (*sockets, error) {
+	s := &sockets{
+		inherited: map[string]*os.File{},
+		listeners: map[string]*net.TCPListener{},
+	}
+
+	value := os.Getenv(socketsEnv)
+	if value == "" {
+		return s, nil
+	}
+	_ = os.Unsetenv(socketsEnv)
+
+	for pair := range strings.SplitSeq(value, ",") {
+		name, fd, ok := strings.Cut(pair, "=")
+		n, err := strconv.Atoi(fd)
+		if !ok || err != nil || n < firstFD {
+			return nil, fmt.Errorf("%s: invalid socket %q", socketsEnv, pair)
+		}
+
+		s.inherited[name] = os.NewFile(uintptr(n), name)
+	}
+
+	return s, nil
+}
+
+// listen returns the socket of the given name, listening on address unless
+// it was inherited.
+func (s *sockets) listen(ctx context.Context, name, address string) (net.Listener, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	log := logger.FromContext(ctx)
+
+	var listener net.Listener
+	var err error
+	file, inherited := s.inherited[name]
+	if inherited {
+		delete(s.inherited, name)
+		listener, err = net.FileListener(file)
+		_ = file.Close()
+	} else {
+		listener, err = (&net.ListenConfig{}).Listen(ctx, "tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if inherited {
+		log.InfoContext(ctx, "Inherited socket", "name", name, "address", listener.Addr())
+		if !sameAddress(address, listener.Addr()) {
+			log.WarnContext(ctx, "Inherited socket listens on another address than configured, restart the broker to change it",
+				"name", name, "address", listener.Addr(), "configured", address)
+		}
+	}
+
+	tcp, ok := listener.(*net.TCPListener)
+	if !ok {
+		_ = listener.Close()
+		return nil, fmt.Errorf("socket %s is not a TCP socket", name)
+	}
+
+	s.names = append(s.names, name)
+	s.listeners[name] = tcp
+	return tcp, nil
+}
+
+// sameAddress reports whether addr is the configured address, where an
+// unspecified host matches any unspecified address.
+func sameAddress(address string, addr net.Addr) bool {
+	want, err := net.ResolveTCPAddr("tcp", address)
+	got, ok := addr.(*net.TCPAddr)
+	if err != nil || !ok || want.Port != got.Port {
+		return false
+	}
+
+	if want.IP == nil || want.IP.IsUnspecified() {
+		return got.IP == nil || got.IP.IsUnspecified()
+	}
+
+	return want.IP.Equal(got.IP)
+}
+
+// close closes inherited sockets that are not used anymore.
+func (s *sockets) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for name, file := range s.inherited {
+		_ = file.Close()
+		delete(s.inherited, name)
+	}
+}
+
+// upgrade starts the broker's executable again, passing on the sockets.
+func (s *sockets) upgrade(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	var files []*os.File
+	defer func() {
+		for _, file := range files {
+			_ = file.Close()
+		}
+	}()
+
+	var pairs []string
+	for _, name := range s.names {
+		file, err := s.listeners[name].File()
+		if err != nil {
+			return fmt.Errorf("socket %s: %w", name, err)
+		}
+
+		pairs = append(pairs, fmt.Sprintf("%s=%d", name, firstFD+len(files)))
+		files = append(files, file)
+	}
+	if len(files) == 0 {
+		return errors.New("no sockets to pass on")
+	}
+
+	cmd := exec.CommandContext(context.WithoutCancel(ctx), executable, os.Args[1:]...) //nolint:gosec // the broker itself
+	cmd.Env = append(os.Environ(), socketsEnv+"="+strings.Join(pairs, ","))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	logger.FromContext(ctx).InfoContext(ctx, "Started upgraded broker", "pid", cmd.Process.Pid, "sockets", pairs)
+	return cmd.Process.Release()
+}
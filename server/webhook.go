@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/trunners/runners/logger"
+	"github.com/trunners/runners/server/github"
+)
+
+var errRunCancelled = errors.New("workflow run cancelled")
+
+// runError ends a session whose workflow run ended before its runner called back.
+type runError struct {
+	conclusion string
+	url        string
+}
+
+func (e *runError) Error() string {
+	return "workflow run ended before callback: " + e.conclusion
+}
+
+// webhook receives workflow_run and workflow_job events from GitHub and
+// passes them to the sessions of their runs. Without a secret it serves nothing.
+func webhook(secret func() string, active *sessions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		log := logger.FromContext(ctx)
+
+		key := secret()
+		if key == "" {
+			http.NotFound(w, r)
+			return
+		}
+
+		event, err := github.ReadWebhook(r, key)
+		if errors.Is(err, github.ErrSignature) {
+			log.WarnContext(ctx, "Webhook with invalid signature", "remote", r.RemoteAddr)
+			writeError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		if err != nil {
+			log.WarnContext(ctx, "Could not read webhook", "error", err)
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		if event.RunID != 0 {
+			if s, ok := active.run(event.RunID); ok {
+				log.InfoContext(ctx, "Workflow event", "session", s.id, "event", event.Type, "action", event.Action, "status", event.Status, "conclusion", event.Conclusion)
+				s.event(r.Context(), event)
+			}
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// run returns the session of a workflow run.
+func (a *sessions) run(id int64) (*session, bool) {
+	for _, s := range a.list() {
+		s.mu.Lock()
+		runID := s.runID
+		s.mu.Unlock()
+
+		if runID == id {
+			return s, true
+		}
+	}
+
+	return nil, false
+}
+
+// event tells the user how the job of their session progresses until its
+// runner calls back, and ends the session if the run ends before that or is
+// cancelled.
+func (s *session) event(ctx context.Context, event github.WebhookEvent) {
+	connected := s.runner() != nil
+
+	switch {
+	case connected:
+		if event.Type == github.WorkflowRunEvent && event.Status == "completed" && event.Conclusion == "cancelled" {
+			s.end(ctx, errRunCancelled, "The workflow run was cancelled.")
+		}
+
+	case event.Status == "completed":
+		s.cancel(&runError{conclusion: event.Conclusion, url: event.HTMLURL})
+
+	case event.Type != github.WorkflowJobEvent:
+
+	case event.Status == "queued":
+		s.lobby.notify("The job is queued, waiting for a runner.")
+
+	case event.Status == "waiting":
+		s.lobby.notify("The job is waiting for approval.")
+
+	case event.Status == "in_progress":
+		s.lobby.notify(fmt.Sprintf("Runner %s picked up the job, connecting.", event.RunnerName))
+	}
+}